@@ -17,26 +17,28 @@
 package config
 
 import (
+	"fmt"
 	log "github.com/Sirupsen/logrus"
 	logstash "github.com/bshuster-repo/logrus-logstash-hook"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 	"os"
+	"path"
 )
 
-// BindStompFlags registers common stomp related flags
+// BindStompFlags registers common stomp related flags, inherited by the subcommands
 func BindStompFlags(cmd *cobra.Command) {
-	cmd.Flags().String("Stomp", "localhost:61613", "Stomp host and port")
-	cmd.Flags().Int("StompReconnectRetry", 5, "Maximum number of reconnect retries")
-	cmd.Flags().Int("StompReconnectWait", 1, "Number of seconds to wait between reconnection attemps")
-	cmd.Flags().String("StompLogin", "fts", "Stomp user")
-	cmd.Flags().String("StompPasscode", "fts", "Stomp passcode")
+	cmd.PersistentFlags().String("Stomp", "localhost:61613", "Stomp host and port")
+	cmd.PersistentFlags().Int("StompReconnectRetry", 5, "Maximum number of reconnect retries")
+	cmd.PersistentFlags().Int("StompReconnectWait", 1, "Number of seconds to wait between reconnection attemps")
+	cmd.PersistentFlags().String("StompLogin", "fts", "Stomp user")
+	cmd.PersistentFlags().String("StompPasscode", "fts", "Stomp passcode")
 
-	viper.BindPFlag("stomp", cmd.Flags().Lookup("Stomp"))
-	viper.BindPFlag("stomp.reconnect.retry", cmd.Flags().Lookup("StompReconnectRetry"))
-	viper.BindPFlag("stomp.reconnect.wait", cmd.Flags().Lookup("StompReconnectWait"))
-	viper.BindPFlag("stomp.login", cmd.Flags().Lookup("StompLogin"))
-	viper.BindPFlag("stomp.passcode", cmd.Flags().Lookup("StompPasscode"))
+	viper.BindPFlag("stomp", cmd.PersistentFlags().Lookup("Stomp"))
+	viper.BindPFlag("stomp.reconnect.retry", cmd.PersistentFlags().Lookup("StompReconnectRetry"))
+	viper.BindPFlag("stomp.reconnect.wait", cmd.PersistentFlags().Lookup("StompReconnectWait"))
+	viper.BindPFlag("stomp.login", cmd.PersistentFlags().Lookup("StompLogin"))
+	viper.BindPFlag("stomp.passcode", cmd.PersistentFlags().Lookup("StompPasscode"))
 }
 
 // ReadConfigFile reads the configuration file passed as parameter, aborts on error
@@ -62,3 +64,15 @@ func RedirectLog(logFile string) {
 		log.SetFormatter(&logstash.LogstashFormatter{})
 	}
 }
+
+// CancelDir returns the directory, under the dirq base directory of the worker, where
+// it leaves the ids of the transfers to cancel. Only the worker user can write into it.
+func CancelDir(dirqPath string) string {
+	return path.Join(dirqPath, "cancel")
+}
+
+// CancelFile returns the file where the worker leaves the ids of the transfers the
+// url-copy process with the given pid must cancel, one per line
+func CancelFile(dirqPath string, pid int) string {
+	return path.Join(CancelDir(dirqPath), fmt.Sprint(pid))
+}
@@ -0,0 +1,142 @@
+/*
+ * Copyright (c) CERN 2016
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package config
+
+import (
+	"fmt"
+	"github.com/spf13/viper"
+	"strings"
+)
+
+type (
+	// Limit pins the number of actives of a storage, or of a link if both
+	// source and destination are set. A fixed value overrides the range.
+	// With a VO, and optionally an activity, it caps the actives of the VO or activity
+	// writing into the storage.
+	Limit struct {
+		Storage     string
+		Vo          string
+		Activity    string
+		Source      string
+		Destination string
+		Min         int
+		Max         int
+		Fixed       int
+	}
+
+	// Limits holds the static limits indexed by scoreboard key
+	Limits map[string]Limit
+)
+
+// Key returns the scoreboard key the limit applies to
+func (l *Limit) Key() string {
+	if l.Activity != "" {
+		return strings.Join([]string{l.Storage, l.Vo, l.Activity}, ScoreboardKeySeparator)
+	} else if l.Vo != "" {
+		return l.Storage + ScoreboardKeySeparator + l.Vo
+	} else if l.Storage != "" {
+		return l.Storage
+	}
+	return l.Source + ScoreboardKeySeparator + l.Destination
+}
+
+// validate checks the limit is consistent
+func (l *Limit) validate() error {
+	switch {
+	case l.Storage != "" && (l.Source != "" || l.Destination != ""):
+		return fmt.Errorf("Limit can not be for both a storage and a link")
+	case l.Storage == "" && (l.Source == "" || l.Destination == ""):
+		return fmt.Errorf("Limit needs a storage, or a source and a destination")
+	case l.Storage == "" && l.Vo != "":
+		return fmt.Errorf("Limit for the VO %s needs a storage", l.Vo)
+	case l.Vo == "" && l.Activity != "":
+		return fmt.Errorf("Limit for the activity %s needs a VO", l.Activity)
+	case l.Min < 0 || l.Max < 0 || l.Fixed < 0:
+		return fmt.Errorf("Negative limit for %s", l.Key())
+	case l.Fixed > 0 && (l.Min > 0 || l.Max > 0):
+		return fmt.Errorf("Fixed limit for %s can not have a range", l.Key())
+	case l.Max > 0 && l.Min > l.Max:
+		return fmt.Errorf("Minimum above maximum for %s", l.Key())
+	}
+	return nil
+}
+
+// bound keeps the number of actives within the limit
+func (l *Limit) bound(actives int) int {
+	if l.Fixed > 0 {
+		return l.Fixed
+	}
+	if l.Min > 0 && actives < l.Min {
+		actives = l.Min
+	}
+	if l.Max > 0 && actives > l.Max {
+		actives = l.Max
+	}
+	return actives
+}
+
+// GetLimits reads the static limits from the "limits" list of the configuration
+func GetLimits() (Limits, error) {
+	var list []Limit
+	if err := viper.UnmarshalKey("limits", &list); err != nil {
+		return nil, err
+	}
+	limits := make(Limits)
+	for _, limit := range list {
+		if err := limit.validate(); err != nil {
+			return nil, err
+		}
+		if _, ok := limits[limit.Key()]; ok {
+			return nil, fmt.Errorf("Duplicated limit for %s", limit.Key())
+		}
+		limits[limit.Key()] = limit
+	}
+	return limits, nil
+}
+
+// Bound keeps the number of actives for the scoreboard key within its static limit, if any
+func (l Limits) Bound(key string, actives int) int {
+	if limit, ok := l[key]; ok {
+		return limit.bound(actives)
+	}
+	return actives
+}
+
+// Range returns the minimum and maximum number of actives for the scoreboard key,
+// 0 meaning there is no bound
+func (l Limits) Range(key string) (int, int) {
+	limit := l[key]
+	if limit.Fixed > 0 {
+		return limit.Fixed, limit.Fixed
+	}
+	return limit.Min, limit.Max
+}
+
+// Cap returns the maximum number of actives for the scoreboard key, or 0 if there is none
+func (l Limits) Cap(key string) int {
+	limit := l[key]
+	if limit.Fixed > 0 {
+		return limit.Fixed
+	}
+	return limit.Max
+}
+
+// Initial returns the number of actives to use for the scoreboard key when nothing
+// has been decided yet
+func (l Limits) Initial(key string) int {
+	return l.Bound(key, ScoreboardDefaultSlots)
+}
@@ -0,0 +1,102 @@
+/*
+ * Copyright (c) CERN 2016
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package config
+
+import (
+	"bytes"
+	"github.com/spf13/viper"
+	"testing"
+)
+
+const testLimits = `
+limits:
+  - storage: srm://tape.example.com
+    max: 5
+  - source: gsiftp://source.example.com
+    destination: gsiftp://dest.example.com
+    fixed: 20
+  - source: gsiftp://source.example.com
+    destination: gsiftp://other.example.com
+    min: 4
+    max: 10
+  - storage: srm://tape.example.com
+    vo: atlas
+    max: 3
+  - storage: srm://tape.example.com
+    vo: atlas
+    activity: Express
+    fixed: 2
+`
+
+// Limits must be read from the configuration, and applied by key.
+func TestLimits(t *testing.T) {
+	viper.Reset()
+	viper.SetConfigType("yaml")
+	if err := viper.ReadConfig(bytes.NewBufferString(testLimits)); err != nil {
+		t.Fatal(err)
+	}
+	limits, err := GetLimits()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(limits) != 5 {
+		t.Fatal("Expecting 5 limits, got ", len(limits))
+	}
+
+	if actives := limits.Bound("srm://tape.example.com", 60); actives != 5 {
+		t.Error("Expecting the storage maximum, got ", actives)
+	}
+	if actives := limits.Initial("srm://tape.example.com"); actives != ScoreboardDefaultSlots {
+		t.Error("Expecting the default within the range, got ", actives)
+	}
+	if actives := limits.Bound("gsiftp://source.example.com#gsiftp://dest.example.com", 2); actives != 20 {
+		t.Error("Expecting the fixed value, got ", actives)
+	}
+	if actives := limits.Initial("gsiftp://source.example.com#gsiftp://other.example.com"); actives != 4 {
+		t.Error("Expecting the link minimum as initial value, got ", actives)
+	}
+	if actives := limits.Bound("gsiftp://unknown.example.com", 42); actives != 42 {
+		t.Error("Expecting no limit, got ", actives)
+	}
+	if max := limits.Cap("srm://tape.example.com#atlas"); max != 3 {
+		t.Error("Expecting a cap of 3 for the VO, got ", max)
+	}
+	if max := limits.Cap("srm://tape.example.com#atlas#Express"); max != 2 {
+		t.Error("Expecting a cap of 2 for the activity, got ", max)
+	}
+	if max := limits.Cap("srm://tape.example.com#cms"); max != 0 {
+		t.Error("Expecting no cap, got ", max)
+	}
+}
+
+// Inconsistent limits must be rejected.
+func TestInvalidLimits(t *testing.T) {
+	invalid := []Limit{
+		{Max: 5},
+		{Storage: "srm://a", Source: "srm://b", Max: 5},
+		{Source: "srm://a", Max: 5},
+		{Storage: "srm://a", Fixed: 5, Max: 10},
+		{Storage: "srm://a", Min: 10, Max: 5},
+		{Vo: "atlas", Max: 5},
+		{Storage: "srm://a", Activity: "Express", Max: 5},
+	}
+	for _, limit := range invalid {
+		if err := limit.validate(); err == nil {
+			t.Error("Expecting an error for ", limit)
+		}
+	}
+}
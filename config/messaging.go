@@ -20,6 +20,10 @@ const (
 	TransferTopic    = "/topic/fts.transfer"
 	PerformanceTopic = "/topic/fts.performance"
 	SchedulerQueue   = "/queue/Consumer.scheduler.fts.transfer"
+	OptimizerQueue   = "/queue/Consumer.optimizer.fts.transfer"
 	WorkerQueue      = "/queue/Consumer.worker.fts.transfer"
+	AuditKillQueue   = "/queue/Consumer.audit.fts.kill"
+	AuditResultQueue = "/queue/Consumer.audit.fts.kill.result"
 	KillTopic        = "/topic/fts.kill"
+	KillResultTopic  = "/topic/fts.kill.result"
 )
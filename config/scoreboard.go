@@ -0,0 +1,45 @@
+/*
+ * Copyright (c) CERN 2016
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package config
+
+// Layout of the scoreboard hashes stored in Redis. They are written by the scheduler,
+// which accounts running transfers, and by the optimizer, which decides the limits.
+const (
+	// ScoreboardKeySeparator is used to join scoreboard keys together
+	ScoreboardKeySeparator = "#"
+	// ScoreboardCounterField holds the number of running transfers
+	ScoreboardCounterField = "counter"
+	// ScoreboardMaxField holds the maximum number of running transfers
+	ScoreboardMaxField = "max"
+	// ScoreboardStreamsField holds the number of streams to use per transfer, only for links
+	ScoreboardStreamsField = "streams"
+	// ScoreboardBreakerField holds the state of the circuit breaker of a link, if any
+	ScoreboardBreakerField = "breaker"
+	// ScoreboardDefaultSlots is the number of parallel transfers by default
+	ScoreboardDefaultSlots = 2
+)
+
+// States of the circuit breaker of a link. When there is none, the breaker is closed
+// and the link works normally.
+const (
+	// BreakerOpen means no transfer can run on the link
+	BreakerOpen = "open"
+	// BreakerProbe means only one transfer can run on the link, to see if it recovered
+	BreakerProbe = "probe"
+	// BreakerClosed is never stored, it is used to signal the breaker is removed
+	BreakerClosed = "closed"
+)
@@ -0,0 +1,92 @@
+/*
+ * Copyright (c) CERN 2016
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package config
+
+import (
+	"fmt"
+	"github.com/spf13/viper"
+	"strings"
+)
+
+// Share tables give the relative weight of the VOs writing into a destination, and
+// of the activities within a VO. They can be set in the configuration file, and
+// overridden in Redis with a hash per table.
+const (
+	// ShareVo identifies the tables of VO weights, one per destination
+	ShareVo = "vo"
+	// ShareActivity identifies the tables of activity weights, one per VO
+	ShareActivity = "activity"
+	// ShareWildcard is the table used when there is none for the destination or VO
+	ShareWildcard = "*"
+	// ShareDefault is the weight used for entries missing in a table
+	ShareDefault = "default"
+	// SharePrefix is prepended to the Redis keys of the tables
+	SharePrefix = "fts-shares"
+)
+
+type (
+	// ShareTable holds the weights by name
+	ShareTable map[string]float32
+
+	// Shares holds the share tables by type and owner (destination or VO)
+	Shares map[string]map[string]ShareTable
+)
+
+// ShareKey returns the Redis key of a share table
+func ShareKey(kind, owner string) string {
+	return strings.Join([]string{SharePrefix, kind, strings.ToLower(owner)}, ScoreboardKeySeparator)
+}
+
+// GetShares reads the share tables from the "shares" entry of the configuration.
+// Names are case insensitive.
+func GetShares() (Shares, error) {
+	var raw map[string]map[string]map[string]float32
+	if err := viper.UnmarshalKey("shares", &raw); err != nil {
+		return nil, err
+	}
+	shares := Shares{
+		ShareVo:       make(map[string]ShareTable),
+		ShareActivity: make(map[string]ShareTable),
+	}
+	for kind, tables := range raw {
+		if _, ok := shares[kind]; !ok {
+			return nil, fmt.Errorf("Unknown share type %s", kind)
+		}
+		for owner, weights := range tables {
+			table := make(ShareTable, len(weights))
+			for name, weight := range weights {
+				if weight < 0 {
+					return nil, fmt.Errorf("Negative share for %s in %s/%s", name, kind, owner)
+				}
+				table[strings.ToLower(name)] = weight
+			}
+			shares[kind][strings.ToLower(owner)] = table
+		}
+	}
+	return shares, nil
+}
+
+// Weight returns the weight for the name, falling back to the table default, and then to 1
+func (t ShareTable) Weight(name string) float32 {
+	if weight, ok := t[strings.ToLower(name)]; ok {
+		return weight
+	}
+	if weight, ok := t[ShareDefault]; ok {
+		return weight
+	}
+	return 1.0
+}
@@ -0,0 +1,67 @@
+/*
+ * Copyright (c) CERN 2016
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package config
+
+import (
+	"bytes"
+	"github.com/spf13/viper"
+	"testing"
+)
+
+const testShares = `
+shares:
+  vo:
+    "*":
+      atlas: 3
+      cms: 2
+    "gsiftp://dest.example.com":
+      atlas: 1
+      default: 0.5
+  activity:
+    atlas:
+      Express: 10
+      Data Consolidation: 1
+`
+
+// Share tables must be read from the configuration, with case insensitive names.
+func TestShares(t *testing.T) {
+	viper.Reset()
+	viper.SetConfigType("yaml")
+	if err := viper.ReadConfig(bytes.NewBufferString(testShares)); err != nil {
+		t.Fatal(err)
+	}
+	shares, err := GetShares()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if weight := shares[ShareVo][ShareWildcard].Weight("ATLAS"); weight != 3 {
+		t.Error("Expecting a weight of 3, got ", weight)
+	}
+	if weight := shares[ShareVo][ShareWildcard].Weight("lhcb"); weight != 1 {
+		t.Error("Expecting a weight of 1 without default, got ", weight)
+	}
+	if weight := shares[ShareVo]["gsiftp://dest.example.com"].Weight("cms"); weight != 0.5 {
+		t.Error("Expecting the default weight, got ", weight)
+	}
+	if weight := shares[ShareActivity]["atlas"].Weight("Data Consolidation"); weight != 1 {
+		t.Error("Expecting a weight of 1, got ", weight)
+	}
+	if weight := shares[ShareActivity]["atlas"].Weight("express"); weight != 10 {
+		t.Error("Expecting a weight of 10, got ", weight)
+	}
+}
@@ -17,6 +17,7 @@ It has these top-level messages:
 	Batch
 	Interval
 	Kill
+	KillResult
 	PerformanceMarker
 	TransferParameters
 	Transfer
@@ -73,6 +74,33 @@ func (x Batch_State) String() string {
 }
 func (Batch_State) EnumDescriptor() ([]byte, []int) { return fileDescriptor0, []int{0, 0} }
 
+type Batch_Type int32
+
+const (
+	// All transfers are independent
+	Batch_SIMPLE Batch_Type = 0
+	// The transfers are alternatives for the same file, only one has to succeed
+	Batch_MULTISOURCE Batch_Type = 1
+	// Each transfer is a hop, to run in order
+	Batch_MULTIHOP Batch_Type = 2
+)
+
+var Batch_Type_name = map[int32]string{
+	0: "SIMPLE",
+	1: "MULTISOURCE",
+	2: "MULTIHOP",
+}
+var Batch_Type_value = map[string]int32{
+	"SIMPLE":      0,
+	"MULTISOURCE": 1,
+	"MULTIHOP":    2,
+}
+
+func (x Batch_Type) String() string {
+	return proto.EnumName(Batch_Type_name, int32(x))
+}
+func (Batch_Type) EnumDescriptor() ([]byte, []int) { return fileDescriptor0, []int{0, 1} }
+
 // Batch contains a set of transfer that form a logical unit of work
 type Batch struct {
 	// Submission timestamp, used for scheduling
@@ -87,6 +115,10 @@ type Batch struct {
 	Vo       string `protobuf:"bytes,7,opt,name=vo" json:"vo,omitempty"`
 	Activity string `protobuf:"bytes,8,opt,name=activity" json:"activity,omitempty"`
 	Priority uint32 `protobuf:"varint,9,opt,name=priority" json:"priority,omitempty"`
+	// How the transfers relate to each other
+	Type Batch_Type `protobuf:"varint,10,opt,name=type,enum=messages.Batch_Type" json:"type,omitempty"`
+	// Order of the batch within its queue, set by the scheduler
+	Queued *google_protobuf.Timestamp `protobuf:"bytes,11,opt,name=queued" json:"queued,omitempty"`
 }
 
 func (m *Batch) Reset()                    { *m = Batch{} }
@@ -157,34 +189,54 @@ func (m *Batch) GetPriority() uint32 {
 	return 0
 }
 
+func (m *Batch) GetType() Batch_Type {
+	if m != nil {
+		return m.Type
+	}
+	return Batch_SIMPLE
+}
+
+func (m *Batch) GetQueued() *google_protobuf.Timestamp {
+	if m != nil {
+		return m.Queued
+	}
+	return nil
+}
+
 func init() {
 	proto.RegisterType((*Batch)(nil), "messages.Batch")
 	proto.RegisterEnum("messages.Batch_State", Batch_State_name, Batch_State_value)
+	proto.RegisterEnum("messages.Batch_Type", Batch_Type_name, Batch_Type_value)
 }
 
 func init() { proto.RegisterFile("batch.proto", fileDescriptor0) }
 
 var fileDescriptor0 = []byte{
-	// 328 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x09, 0x6e, 0x88, 0x02, 0xff, 0x44, 0x90, 0xcf, 0x6b, 0xc2, 0x30,
-	0x14, 0xc7, 0xd7, 0x6a, 0xb5, 0x7d, 0x45, 0x29, 0x81, 0xb1, 0xd0, 0x1d, 0x56, 0x3c, 0x15, 0x06,
-	0x71, 0xb8, 0xcb, 0xae, 0x8a, 0x45, 0x3c, 0xac, 0x83, 0xb4, 0x1e, 0x76, 0x92, 0xfe, 0x88, 0xae,
-	0xb0, 0x2e, 0x92, 0x44, 0x61, 0xff, 0xfc, 0x18, 0x69, 0xd6, 0x79, 0xfc, 0xbe, 0xcf, 0xf7, 0xf3,
-	0x78, 0x09, 0xf8, 0x65, 0xa1, 0xaa, 0x0f, 0x72, 0x12, 0x5c, 0x71, 0xe4, 0xb6, 0x4c, 0xca, 0xe2,
-	0xc8, 0x64, 0x38, 0x55, 0xa2, 0xf8, 0x92, 0x07, 0x26, 0x0c, 0x09, 0x1f, 0x8e, 0x9c, 0x1f, 0x3f,
-	0xd9, 0xbc, 0x4b, 0xe5, 0xf9, 0x30, 0x57, 0x4d, 0xcb, 0xa4, 0x2a, 0xda, 0x93, 0x29, 0xcc, 0x7e,
-	0x6c, 0x70, 0x56, 0x7a, 0x15, 0x7a, 0x01, 0x4f, 0x9e, 0xcb, 0xb6, 0x51, 0x8a, 0xd5, 0xd8, 0x8a,
-	0xac, 0xd8, 0x5f, 0x84, 0xc4, 0xe8, 0xa4, 0xd7, 0x49, 0xde, 0xeb, 0xf4, 0x5a, 0x46, 0x8f, 0xe0,
-	0x48, 0x55, 0x28, 0x86, 0xed, 0xc8, 0x8a, 0xa7, 0x8b, 0x5b, 0xd2, 0x9f, 0x43, 0xba, 0xcd, 0x24,
-	0xd3, 0x90, 0x9a, 0x0e, 0x7a, 0x02, 0xaf, 0xbf, 0x51, 0xe2, 0x41, 0x34, 0x88, 0xfd, 0x05, 0xba,
-	0x0a, 0xf9, 0x1f, 0xa2, 0xd7, 0x12, 0xba, 0x83, 0x71, 0x25, 0x58, 0xbd, 0x6f, 0x6a, 0x3c, 0x8c,
-	0xac, 0xd8, 0xa3, 0x23, 0x1d, 0xb7, 0x35, 0xba, 0x07, 0x4f, 0xf2, 0xb3, 0xa8, 0xd8, 0x5e, 0x32,
-	0xec, 0x74, 0xc8, 0x35, 0x83, 0x8c, 0x69, 0xab, 0x66, 0x52, 0x69, 0x34, 0x32, 0x96, 0x8e, 0x19,
-	0x43, 0x53, 0xb0, 0x2f, 0x1c, 0x8f, 0xbb, 0x99, 0x7d, 0xe1, 0x28, 0x04, 0xb7, 0xa8, 0x54, 0x73,
-	0x69, 0xd4, 0x37, 0x76, 0xcd, 0x92, 0x3e, 0x6b, 0x76, 0x12, 0x0d, 0x17, 0x9a, 0x79, 0x91, 0x15,
-	0x4f, 0xe8, 0x7f, 0x9e, 0x25, 0xe0, 0x74, 0x0f, 0x43, 0x3e, 0x8c, 0xb3, 0x7c, 0xb9, 0xd9, 0xa6,
-	0x9b, 0xe0, 0x06, 0x4d, 0xc0, 0xcb, 0x76, 0xab, 0xd7, 0x6d, 0x9e, 0x27, 0xeb, 0xc0, 0x42, 0x1e,
-	0x38, 0x34, 0x59, 0xae, 0xdf, 0x03, 0x5b, 0xd7, 0xe8, 0x2e, 0x4d, 0x75, 0x6d, 0x80, 0x5c, 0x18,
-	0xae, 0xdf, 0xd2, 0x24, 0x18, 0x96, 0xa3, 0xee, 0x6f, 0x9f, 0x7f, 0x03, 0x00, 0x00, 0xff, 0xff,
-	0x9b, 0xb3, 0x93, 0xa5, 0xd1, 0x01, 0x00, 0x00,
+	// 401 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x09, 0x6e, 0x88, 0x02, 0xff, 0x84, 0x90, 0xc1, 0x8f, 0x93, 0x50,
+	0x10, 0xc6, 0x17, 0x0a, 0x14, 0x06, 0xb7, 0x92, 0x89, 0xc6, 0x97, 0x7a, 0x90, 0xf4, 0x44, 0x62,
+	0xc2, 0x6a, 0xbd, 0x78, 0xdd, 0xb5, 0x64, 0x25, 0xd9, 0xb6, 0x9b, 0x07, 0x3d, 0x78, 0xda, 0xd0,
+	0x32, 0x5b, 0x49, 0xac, 0x20, 0xef, 0xd1, 0xa4, 0x7f, 0x85, 0xff, 0xb2, 0x79, 0x8f, 0x62, 0x13,
+	0x2f, 0x1e, 0xbf, 0xf9, 0x7e, 0xdf, 0xe4, 0x9b, 0x01, 0x7f, 0x5b, 0xc8, 0xdd, 0xf7, 0xb8, 0x69,
+	0x6b, 0x59, 0xa3, 0x7b, 0x20, 0x21, 0x8a, 0x3d, 0x89, 0xe9, 0x44, 0xb6, 0xc5, 0x4f, 0xf1, 0x4c,
+	0x6d, 0xef, 0x4c, 0xdf, 0xed, 0xeb, 0x7a, 0xff, 0x83, 0x6e, 0xb4, 0xda, 0x76, 0xcf, 0x37, 0xb2,
+	0x3a, 0x90, 0x90, 0xc5, 0xa1, 0xe9, 0x81, 0xd9, 0x6f, 0x0b, 0xec, 0x3b, 0xb5, 0x0a, 0x3f, 0x83,
+	0x27, 0xba, 0xed, 0xa1, 0x92, 0x92, 0x4a, 0x66, 0x84, 0x46, 0xe4, 0xcf, 0xa7, 0x71, 0x1f, 0x8f,
+	0x87, 0x78, 0x9c, 0x0f, 0x71, 0x7e, 0x81, 0xf1, 0x3d, 0xd8, 0x42, 0x16, 0x92, 0x98, 0x19, 0x1a,
+	0xd1, 0x64, 0xfe, 0x3a, 0x1e, 0xea, 0xc4, 0x7a, 0x73, 0x9c, 0x29, 0x93, 0xf7, 0x0c, 0x7e, 0x00,
+	0x6f, 0xe8, 0x28, 0xd8, 0x28, 0x1c, 0x45, 0xfe, 0x1c, 0x2f, 0x81, 0xfc, 0x6c, 0xf1, 0x0b, 0x84,
+	0x6f, 0x60, 0xbc, 0x6b, 0xa9, 0x7c, 0xaa, 0x4a, 0x66, 0x85, 0x46, 0xe4, 0x71, 0x47, 0xc9, 0xb4,
+	0xc4, 0xb7, 0xe0, 0x89, 0xba, 0x6b, 0x77, 0xf4, 0x24, 0x88, 0xd9, 0xda, 0x72, 0xfb, 0x41, 0x46,
+	0x2a, 0x55, 0x92, 0x90, 0xca, 0x72, 0xfa, 0x94, 0x92, 0x19, 0xe1, 0x04, 0xcc, 0x63, 0xcd, 0xc6,
+	0x7a, 0x66, 0x1e, 0x6b, 0x9c, 0x82, 0x5b, 0xec, 0x64, 0x75, 0xac, 0xe4, 0x89, 0xb9, 0xfd, 0x92,
+	0x41, 0x2b, 0xaf, 0x69, 0xab, 0xba, 0x55, 0x9e, 0x17, 0x1a, 0xd1, 0x35, 0xff, 0xab, 0x31, 0x02,
+	0x4b, 0x9e, 0x1a, 0x62, 0xa0, 0x8f, 0x7e, 0xf5, 0xef, 0xd1, 0xf9, 0xa9, 0x21, 0xae, 0x09, 0x9c,
+	0x83, 0xf3, 0xab, 0xa3, 0x8e, 0x4a, 0xe6, 0xff, 0xf7, 0xad, 0x67, 0x72, 0x96, 0x80, 0xad, 0xdf,
+	0x86, 0x3e, 0x8c, 0xb3, 0xfc, 0xf6, 0x3e, 0x5d, 0xdd, 0x07, 0x57, 0x78, 0x0d, 0x5e, 0xb6, 0xb9,
+	0x5b, 0xa6, 0x79, 0x9e, 0x2c, 0x02, 0x03, 0x3d, 0xb0, 0x79, 0x72, 0xbb, 0xf8, 0x16, 0x98, 0x0a,
+	0xe3, 0x9b, 0xd5, 0x4a, 0x61, 0x23, 0x74, 0xc1, 0x5a, 0xac, 0x57, 0x49, 0x60, 0xcd, 0x3e, 0x82,
+	0xa5, 0x8a, 0x20, 0x80, 0x93, 0xa5, 0xcb, 0xc7, 0x87, 0x24, 0xb8, 0xc2, 0x97, 0xe0, 0x2f, 0x37,
+	0x0f, 0x79, 0x9a, 0xad, 0x37, 0xfc, 0x4b, 0x12, 0x18, 0xf8, 0x02, 0x5c, 0x3d, 0xf8, 0xba, 0x7e,
+	0x0c, 0xcc, 0xad, 0xa3, 0x5b, 0x7d, 0xfa, 0x33, 0x00, 0x18, 0x07, 0x0b, 0x16, 0x62, 0x02, 0x00,
+	0x00,
 }
@@ -20,9 +20,16 @@ import (
 	"crypto/md5"
 	"errors"
 	"fmt"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"net/url"
 	"time"
 )
 
+// DefaultPriority is assumed for batches without one. Priorities go from 1 to 5,
+// the higher the more urgent.
+const DefaultPriority = 3
+
 var (
 	// ErrEmptyTransferSet is returned when the batch is empty (has no transfers)
 	ErrEmptyTransferSet = errors.New("Empty batch")
@@ -50,27 +57,146 @@ func (b *Batch) Validate() error {
 	return nil
 }
 
-// GetID gets a unique id associated to the batch
+// GetID gets a unique id associated to the batch. Retries of the same transfers get
+// a different one.
 func (b *Batch) GetID() string {
 	hash := md5.New()
 	for _, transfer := range b.Transfers {
 		hash.Write([]byte(transfer.TransferId))
+		if transfer.Retry > 0 {
+			fmt.Fprintf(hash, "#%d", transfer.Retry)
+		}
 	}
 	var sum []byte
 	sum = hash.Sum(sum)
 	return fmt.Sprintf("%x", sum)
 }
 
+// sameParameters returns true if both sets of parameters are the same, missing ones
+// being the same as the defaults
+func sameParameters(a, b *TransferParameters) bool {
+	if a == nil {
+		a = &TransferParameters{}
+	}
+	if b == nil {
+		b = &TransferParameters{}
+	}
+	return proto.Equal(a, b)
+}
+
+// Merge appends the transfers of other to the batch, which keeps the earliest submission
+// time. Both must be simple batches in the same state, for the same link, VO, activity,
+// credentials and priority, and all the transfers must have the same parameters.
+// Otherwise ErrCannotMerge is returned, and the batch is left untouched.
+func (b *Batch) Merge(other *Batch) error {
+	if b.Type != Batch_SIMPLE || other.Type != Batch_SIMPLE || b.State != other.State ||
+		b.SourceSe != other.SourceSe || b.DestSe != other.DestSe ||
+		b.Vo != other.Vo || b.Activity != other.Activity ||
+		b.CredId != other.CredId || b.Priority != other.Priority {
+		return ErrCannotMerge
+	}
+	if len(b.Transfers) > 0 {
+		for _, t := range other.Transfers {
+			if !sameParameters(b.Transfers[0].Parameters, t.Parameters) {
+				return ErrCannotMerge
+			}
+		}
+	}
+
+	b.Transfers = append(b.Transfers, other.Transfers...)
+	if b.Submitted == nil || (other.Submitted != nil && other.GetSubmitTime().Before(b.GetSubmitTime())) {
+		b.Submitted = other.Submitted
+	}
+	return nil
+}
+
 // GetPath is called by the scheduler to decide the scheduling levels
 func (b *Batch) GetPath() []string {
 	return []string{b.DestSe, b.Vo, b.Activity, b.SourceSe}
 }
 
-// GetTimestamp returns the submit timestamp of the batch
-func (b *Batch) GetTimestamp() time.Time {
+// GetSubmitTime returns the submit timestamp of the batch
+func (b *Batch) GetSubmitTime() time.Time {
 	return time.Unix(b.Submitted.Seconds, int64(b.Submitted.Nanos)).UTC()
 }
 
+// GetTimestamp returns the timestamp used to order the batch in its queue: the one set
+// when queued, or the submit timestamp
+func (b *Batch) GetTimestamp() time.Time {
+	if b.Queued == nil {
+		return b.GetSubmitTime()
+	}
+	return time.Unix(b.Queued.Seconds, int64(b.Queued.Nanos)).UTC()
+}
+
+// SetPriorityOrder orders the batch in its queue by the submit timestamp, shifted aging
+// earlier for each level of priority above the default, or later for each level below.
+// A batch can then only be overtaken by batches of higher priority submitted less than
+// that much later per level, so none waits forever.
+func (b *Batch) SetPriorityOrder(aging time.Duration) {
+	priority := int(b.Priority)
+	if priority == 0 {
+		priority = DefaultPriority
+	}
+	queued := b.GetSubmitTime().Add(-time.Duration(priority-DefaultPriority) * aging)
+	b.Queued = &timestamp.Timestamp{Seconds: queued.Unix(), Nanos: int32(queued.Nanosecond())}
+}
+
+// GetDeadline returns when the batch must leave the queue, given by the earliest
+// queue timeout or expiration time of its transfers, or zero if there is none
+func (b *Batch) GetDeadline() time.Time {
+	var deadline time.Time
+	for _, t := range b.Transfers {
+		candidates := make([]time.Time, 0, 2)
+		if timeout := t.GetParameters().GetQueueTimeout(); timeout != nil && timeout.Seconds > 0 && b.Submitted != nil {
+			candidates = append(candidates, b.GetSubmitTime().Add(time.Duration(timeout.Seconds)*time.Second))
+		}
+		if expiration := t.GetExpirationTime(); expiration != nil && expiration.Seconds > 0 {
+			candidates = append(candidates, time.Unix(expiration.Seconds, int64(expiration.Nanos)).UTC())
+		}
+		for _, candidate := range candidates {
+			if deadline.IsZero() || candidate.Before(deadline) {
+				deadline = candidate
+			}
+		}
+	}
+	return deadline
+}
+
+// Ran returns the transfers that run in the last attempt of the batch. A multihop batch
+// keeps all the hops, but only one runs each time: the first one not finished, unless it
+// is on hold, waiting for its turn after the one before, which is then the one that ran.
+// If all of them are finished, the last one ran.
+func (b *Batch) Ran() []*Transfer {
+	if b.Type != Batch_MULTIHOP {
+		return b.Transfers
+	}
+	for i, t := range b.Transfers {
+		if t.State == Transfer_FINISHED {
+			continue
+		} else if t.State != Transfer_ON_HOLD {
+			return b.Transfers[i : i+1]
+		} else if i == 0 {
+			return nil
+		}
+		return b.Transfers[i-1 : i]
+	}
+	if len(b.Transfers) == 0 {
+		return nil
+	}
+	return b.Transfers[len(b.Transfers)-1:]
+}
+
+// GetStorage returns the storage of the surl, as scheme://host, or an empty string
+// if it can not be parsed
+func GetStorage(surl string) string {
+	parsed, err := url.Parse(surl)
+	if err != nil || parsed.Scheme == "" || parsed.Host == "" {
+		return ""
+	}
+	return parsed.Scheme + "://" + parsed.Host
+}
+
 // Validate checks if a transfer is properly defined
 func (t *Transfer) Validate() error {
 	if t.TransferId == "" {
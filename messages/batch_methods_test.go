@@ -0,0 +1,133 @@
+/*
+ * Copyright (c) CERN 2016
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package messages
+
+import (
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"testing"
+	"time"
+)
+
+// newMergeBatch returns a single transfer batch for the same link
+func newMergeBatch(id string, submitted int64) *Batch {
+	return &Batch{
+		Submitted: &timestamp.Timestamp{Seconds: submitted},
+		State:     Batch_SUBMITTED,
+		SourceSe:  "mock://source",
+		DestSe:    "mock://destination",
+		Vo:        "dteam",
+		Activity:  "default",
+		CredId:    "1234",
+		Transfers: []*Transfer{{TransferId: id}},
+	}
+}
+
+func TestMerge(t *testing.T) {
+	batch := newMergeBatch("a", 20)
+	if err := batch.Merge(newMergeBatch("b", 10)); err != nil {
+		t.Fatal("Expected the batches to merge, got ", err)
+	}
+	if len(batch.Transfers) != 2 || batch.Transfers[1].TransferId != "b" {
+		t.Fatal("Expected the transfers of both batches, got ", batch.Transfers)
+	}
+	if batch.Submitted.Seconds != 10 {
+		t.Error("Expected the earliest submission, got ", batch.Submitted.Seconds)
+	}
+
+	other := newMergeBatch("c", 30)
+	other.Vo = "atlas"
+	if err := batch.Merge(other); err != ErrCannotMerge {
+		t.Error("Expected a different VO to prevent the merge, got ", err)
+	}
+
+	other = newMergeBatch("c", 30)
+	other.Transfers[0].Parameters = &TransferParameters{Nstreams: 4}
+	if err := batch.Merge(other); err != ErrCannotMerge {
+		t.Error("Expected different parameters to prevent the merge, got ", err)
+	}
+
+	other = newMergeBatch("c", 30)
+	other.Transfers[0].Parameters = &TransferParameters{}
+	if err := batch.Merge(other); err != nil {
+		t.Error("Expected default parameters to merge, got ", err)
+	}
+	if len(batch.Transfers) != 3 {
+		t.Error("Expected three transfers, got ", len(batch.Transfers))
+	}
+}
+
+// Batches must be ordered by submission, shifted by their priority once queued.
+func TestPriorityOrder(t *testing.T) {
+	batch := newMergeBatch("a", 1000)
+	if batch.GetTimestamp().Unix() != 1000 {
+		t.Fatal("Expecting the submission time before being queued, got ", batch.GetTimestamp())
+	}
+	batch.SetPriorityOrder(100 * time.Second)
+	if batch.GetTimestamp().Unix() != 1000 {
+		t.Fatal("Expecting the default priority not to shift the order, got ", batch.GetTimestamp())
+	}
+
+	batch.Priority = 5
+	batch.SetPriorityOrder(100 * time.Second)
+	if batch.GetTimestamp().Unix() != 800 {
+		t.Fatal("Expecting two levels up to move the batch ahead, got ", batch.GetTimestamp())
+	}
+	batch.Priority = 1
+	batch.SetPriorityOrder(100 * time.Second)
+	if batch.GetTimestamp().Unix() != 1200 {
+		t.Fatal("Expecting two levels down to move the batch back, got ", batch.GetTimestamp())
+	}
+	if batch.GetSubmitTime().Unix() != 1000 {
+		t.Fatal("Expecting the submission time to be kept, got ", batch.GetSubmitTime())
+	}
+}
+
+// Only the hop that ended must count as run for multihop batches, not those on hold,
+// and every transfer for the rest.
+func TestRan(t *testing.T) {
+	batch := newMergeBatch("a", 10)
+	batch.Transfers = append(batch.Transfers, &Transfer{TransferId: "b"}, &Transfer{TransferId: "c"})
+	if ran := batch.Ran(); len(ran) != 3 {
+		t.Fatal("Expecting all the transfers to run, got ", ran)
+	}
+
+	batch.Type = Batch_MULTIHOP
+	batch.Transfers[0].State = Transfer_FINISHED
+	batch.Transfers[1].State = Transfer_FAILED
+	batch.Transfers[2].State = Transfer_ON_HOLD
+	if ran := batch.Ran(); len(ran) != 1 || ran[0].TransferId != "b" {
+		t.Fatal("Expecting the second hop to run, got ", ran)
+	}
+	batch.Transfers[1].State = Transfer_ON_HOLD
+	if ran := batch.Ran(); len(ran) != 1 || ran[0].TransferId != "a" {
+		t.Fatal("Expecting the first hop to run while the next is on hold, got ", ran)
+	}
+	batch.Transfers[0].State = Transfer_ON_HOLD
+	if ran := batch.Ran(); ran != nil {
+		t.Fatal("Not expecting any hop to run while all are on hold, got ", ran)
+	}
+	for _, transfer := range batch.Transfers {
+		transfer.State = Transfer_FINISHED
+	}
+	if ran := batch.Ran(); len(ran) != 1 || ran[0].TransferId != "c" {
+		t.Fatal("Expecting the last hop once all are finished, got ", ran)
+	}
+	batch.Transfers = nil
+	if ran := batch.Ran(); ran != nil {
+		t.Fatal("Not expecting any transfer to run, got ", ran)
+	}
+}
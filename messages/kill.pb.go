@@ -7,15 +7,25 @@ package messages
 import proto "github.com/golang/protobuf/proto"
 import fmt "fmt"
 import math "math"
+import google_protobuf "github.com/golang/protobuf/ptypes/timestamp"
 
 // Reference imports to suppress errors if they are not otherwise used.
 var _ = proto.Marshal
 var _ = fmt.Errorf
 var _ = math.Inf
 
-// Kill signals a cancellation of a transfer
+// Kill signals a cancellation of the transfers matching all the fields set
 type Kill struct {
 	TransferId string `protobuf:"bytes,1,opt,name=transfer_id,json=transferId" json:"transfer_id,omitempty"`
+	JobId      string `protobuf:"bytes,2,opt,name=job_id,json=jobId" json:"job_id,omitempty"`
+	SourceSe   string `protobuf:"bytes,3,opt,name=source_se,json=sourceSe" json:"source_se,omitempty"`
+	DestSe     string `protobuf:"bytes,4,opt,name=dest_se,json=destSe" json:"dest_se,omitempty"`
+	Vo         string `protobuf:"bytes,5,opt,name=vo" json:"vo,omitempty"`
+	CredId     string `protobuf:"bytes,6,opt,name=cred_id,json=credId" json:"cred_id,omitempty"`
+	// Identifies the request, and who made it and when, for the audit trail
+	Id        string                     `protobuf:"bytes,7,opt,name=id" json:"id,omitempty"`
+	Requester string                     `protobuf:"bytes,8,opt,name=requester" json:"requester,omitempty"`
+	Requested *google_protobuf.Timestamp `protobuf:"bytes,9,opt,name=requested" json:"requested,omitempty"`
 }
 
 func (m *Kill) Reset()                    { *m = Kill{} }
@@ -30,18 +40,196 @@ func (m *Kill) GetTransferId() string {
 	return ""
 }
 
+func (m *Kill) GetJobId() string {
+	if m != nil {
+		return m.JobId
+	}
+	return ""
+}
+
+func (m *Kill) GetSourceSe() string {
+	if m != nil {
+		return m.SourceSe
+	}
+	return ""
+}
+
+func (m *Kill) GetDestSe() string {
+	if m != nil {
+		return m.DestSe
+	}
+	return ""
+}
+
+func (m *Kill) GetVo() string {
+	if m != nil {
+		return m.Vo
+	}
+	return ""
+}
+
+func (m *Kill) GetCredId() string {
+	if m != nil {
+		return m.CredId
+	}
+	return ""
+}
+
+func (m *Kill) GetId() string {
+	if m != nil {
+		return m.Id
+	}
+	return ""
+}
+
+func (m *Kill) GetRequester() string {
+	if m != nil {
+		return m.Requester
+	}
+	return ""
+}
+
+func (m *Kill) GetRequested() *google_protobuf.Timestamp {
+	if m != nil {
+		return m.Requested
+	}
+	return nil
+}
+
+// KillResult reports what an agent did for a kill
+type KillResult struct {
+	Kill *Kill `protobuf:"bytes,1,opt,name=kill" json:"kill,omitempty"`
+	// Service and host that handled the kill
+	Agent    string                     `protobuf:"bytes,2,opt,name=agent" json:"agent,omitempty"`
+	Host     string                     `protobuf:"bytes,3,opt,name=host" json:"host,omitempty"`
+	Received *google_protobuf.Timestamp `protobuf:"bytes,4,opt,name=received" json:"received,omitempty"`
+	Finished *google_protobuf.Timestamp `protobuf:"bytes,5,opt,name=finished" json:"finished,omitempty"`
+	// Empty if nothing matched
+	Targets []*KillResult_Target `protobuf:"bytes,6,rep,name=targets" json:"targets,omitempty"`
+}
+
+func (m *KillResult) Reset()                    { *m = KillResult{} }
+func (m *KillResult) String() string            { return proto.CompactTextString(m) }
+func (*KillResult) ProtoMessage()               {}
+func (*KillResult) Descriptor() ([]byte, []int) { return fileDescriptor2, []int{1} }
+
+func (m *KillResult) GetKill() *Kill {
+	if m != nil {
+		return m.Kill
+	}
+	return nil
+}
+
+func (m *KillResult) GetAgent() string {
+	if m != nil {
+		return m.Agent
+	}
+	return ""
+}
+
+func (m *KillResult) GetHost() string {
+	if m != nil {
+		return m.Host
+	}
+	return ""
+}
+
+func (m *KillResult) GetReceived() *google_protobuf.Timestamp {
+	if m != nil {
+		return m.Received
+	}
+	return nil
+}
+
+func (m *KillResult) GetFinished() *google_protobuf.Timestamp {
+	if m != nil {
+		return m.Finished
+	}
+	return nil
+}
+
+func (m *KillResult) GetTargets() []*KillResult_Target {
+	if m != nil {
+		return m.Targets
+	}
+	return nil
+}
+
+// Target is a set of matched transfers, with the process running them, if any,
+// and the signal it took to stop them
+type KillResult_Target struct {
+	Pid         int32    `protobuf:"varint,1,opt,name=pid" json:"pid,omitempty"`
+	TransferIds []string `protobuf:"bytes,2,rep,name=transfer_ids,json=transferIds" json:"transfer_ids,omitempty"`
+	Signal      string   `protobuf:"bytes,3,opt,name=signal" json:"signal,omitempty"`
+	Error       string   `protobuf:"bytes,4,opt,name=error" json:"error,omitempty"`
+}
+
+func (m *KillResult_Target) Reset()                    { *m = KillResult_Target{} }
+func (m *KillResult_Target) String() string            { return proto.CompactTextString(m) }
+func (*KillResult_Target) ProtoMessage()               {}
+func (*KillResult_Target) Descriptor() ([]byte, []int) { return fileDescriptor2, []int{1, 0} }
+
+func (m *KillResult_Target) GetPid() int32 {
+	if m != nil {
+		return m.Pid
+	}
+	return 0
+}
+
+func (m *KillResult_Target) GetTransferIds() []string {
+	if m != nil {
+		return m.TransferIds
+	}
+	return nil
+}
+
+func (m *KillResult_Target) GetSignal() string {
+	if m != nil {
+		return m.Signal
+	}
+	return ""
+}
+
+func (m *KillResult_Target) GetError() string {
+	if m != nil {
+		return m.Error
+	}
+	return ""
+}
+
 func init() {
 	proto.RegisterType((*Kill)(nil), "messages.Kill")
+	proto.RegisterType((*KillResult)(nil), "messages.KillResult")
+	proto.RegisterType((*KillResult_Target)(nil), "messages.KillResult.Target")
 }
 
 func init() { proto.RegisterFile("kill.proto", fileDescriptor2) }
 
 var fileDescriptor2 = []byte{
-	// 86 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x09, 0x6e, 0x88, 0x02, 0xff, 0xe2, 0xe2, 0xca, 0xce, 0xcc, 0xc9,
-	0xd1, 0x2b, 0x28, 0xca, 0x2f, 0xc9, 0x17, 0xe2, 0xc8, 0x4d, 0x2d, 0x2e, 0x4e, 0x4c, 0x4f, 0x2d,
-	0x56, 0x52, 0xe7, 0x62, 0xf1, 0xce, 0xcc, 0xc9, 0x11, 0x92, 0xe7, 0xe2, 0x2e, 0x29, 0x4a, 0xcc,
-	0x2b, 0x4e, 0x4b, 0x2d, 0x8a, 0xcf, 0x4c, 0x91, 0x60, 0x54, 0x60, 0xd4, 0xe0, 0x0c, 0xe2, 0x82,
-	0x09, 0x79, 0xa6, 0x24, 0xb1, 0x81, 0x75, 0x1a, 0x03, 0x02, 0x00, 0x00, 0xff, 0xff, 0xe0, 0xe8,
-	0xca, 0xec, 0x47, 0x00, 0x00, 0x00,
+	// 387 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x09, 0x6e, 0x88, 0x02, 0xff, 0x84, 0x92, 0xcd, 0x6e, 0x9b, 0x40,
+	0x10, 0xc7, 0x65, 0x0c, 0xd8, 0x0c, 0x55, 0x54, 0x8d, 0xfa, 0xb1, 0x72, 0x2a, 0x85, 0xfa, 0xc4,
+	0x89, 0x48, 0xae, 0x5a, 0xf5, 0x15, 0xac, 0xde, 0x48, 0xee, 0x11, 0x78, 0xc7, 0x64, 0x13, 0xcc,
+	0xba, 0x3b, 0x8b, 0xdf, 0xa0, 0xaf, 0xdb, 0x67, 0xa8, 0x76, 0x81, 0x52, 0xf5, 0xe2, 0xdb, 0xfe,
+	0x3f, 0x06, 0x31, 0x3f, 0x0d, 0xc0, 0xab, 0x6a, 0xdb, 0xe2, 0x6c, 0xb4, 0xd5, 0xb8, 0x3e, 0x11,
+	0x73, 0xd5, 0x10, 0x6f, 0xee, 0x1a, 0xad, 0x9b, 0x96, 0xee, 0xbd, 0x5f, 0xf7, 0xc7, 0x7b, 0xab,
+	0x4e, 0xc4, 0xb6, 0x3a, 0x9d, 0x87, 0xea, 0xf6, 0x57, 0x00, 0xe1, 0x0f, 0xd5, 0xb6, 0x78, 0x07,
+	0xa9, 0x35, 0x55, 0xc7, 0x47, 0x32, 0x4f, 0x4a, 0x8a, 0x45, 0xb6, 0xc8, 0x93, 0x12, 0x26, 0x6b,
+	0x2f, 0xf1, 0x3d, 0xc4, 0x2f, 0xba, 0x76, 0x59, 0xe0, 0xb3, 0xe8, 0x45, 0xd7, 0x7b, 0x89, 0xb7,
+	0x90, 0xb0, 0xee, 0xcd, 0x81, 0x9e, 0x98, 0xc4, 0xd2, 0x27, 0xeb, 0xc1, 0x78, 0x20, 0xfc, 0x08,
+	0x2b, 0x49, 0x6c, 0x5d, 0x14, 0xfa, 0x28, 0x76, 0xf2, 0x81, 0xf0, 0x06, 0x82, 0x8b, 0x16, 0x91,
+	0xf7, 0x82, 0x8b, 0x76, 0xc5, 0x83, 0x21, 0xe9, 0xbe, 0x1e, 0x0f, 0x45, 0x27, 0xf7, 0xd2, 0x15,
+	0x95, 0x14, 0xab, 0xa1, 0xa8, 0x24, 0x7e, 0x82, 0xc4, 0xd0, 0xcf, 0x9e, 0xd8, 0x92, 0x11, 0x6b,
+	0x6f, 0xcf, 0x06, 0x7e, 0x9f, 0x53, 0x29, 0x92, 0x6c, 0x91, 0xa7, 0xbb, 0x4d, 0x31, 0x20, 0x28,
+	0x26, 0x04, 0xc5, 0xe3, 0x84, 0x60, 0x9e, 0x94, 0xdb, 0xdf, 0x01, 0x80, 0xe3, 0x50, 0x12, 0xf7,
+	0xad, 0xc5, 0x2d, 0x84, 0x8e, 0xa7, 0xc7, 0x90, 0xee, 0x6e, 0x8a, 0x09, 0x68, 0xe1, 0x3b, 0x3e,
+	0xc3, 0x77, 0x10, 0x55, 0x0d, 0x75, 0x76, 0xe2, 0xe1, 0x05, 0x22, 0x84, 0xcf, 0x9a, 0xed, 0x88,
+	0xc2, 0xbf, 0xf1, 0x1b, 0xac, 0x0d, 0x1d, 0x48, 0x5d, 0x48, 0x8a, 0xf0, 0xea, 0x5f, 0xfd, 0xed,
+	0xba, 0xb9, 0xa3, 0xea, 0x14, 0x3f, 0x93, 0x14, 0xd1, 0xf5, 0xb9, 0xa9, 0x8b, 0x5f, 0x61, 0x65,
+	0x2b, 0xd3, 0x90, 0x65, 0x11, 0x67, 0xcb, 0x3c, 0xdd, 0xdd, 0xfe, 0xb7, 0x80, 0x5f, 0xb2, 0x78,
+	0xf4, 0x9d, 0x72, 0xea, 0x6e, 0x5e, 0x21, 0x1e, 0x2c, 0x7c, 0x0b, 0xcb, 0xf3, 0x78, 0x04, 0x51,
+	0xe9, 0x9e, 0xf8, 0x19, 0xde, 0xfc, 0x73, 0x1e, 0x2c, 0x82, 0x6c, 0x99, 0x27, 0x65, 0x3a, 0xdf,
+	0x07, 0xe3, 0x07, 0x88, 0x59, 0x35, 0x5d, 0xd5, 0x8e, 0xbb, 0x8f, 0xca, 0x71, 0x22, 0x63, 0xb4,
+	0x19, 0x4f, 0x60, 0x10, 0x75, 0xec, 0x37, 0xf8, 0xf2, 0x67, 0x00, 0x1d, 0xd6, 0x7a, 0xfd, 0xb8,
+	0x02, 0x00, 0x00,
 }
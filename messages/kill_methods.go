@@ -0,0 +1,69 @@
+/*
+ * Copyright (c) CERN 2016
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package messages
+
+import (
+	"crypto/md5"
+	"fmt"
+	"github.com/golang/protobuf/proto"
+)
+
+// EnsureID gives the kill an id derived from its content, unless it has one, so every
+// agent receiving it, and the audit trail, agree on it
+func (k *Kill) EnsureID() {
+	if k.Id != "" {
+		return
+	}
+	data, _ := proto.Marshal(k)
+	k.Id = fmt.Sprintf("%x", md5.Sum(data))
+}
+
+// IsEmpty returns true if the kill has no selector. It matches nothing, rather than everything.
+func (k *Kill) IsEmpty() bool {
+	return k.TransferId == "" && k.JobId == "" && k.SourceSe == "" && k.DestSe == "" &&
+		k.Vo == "" && k.CredId == ""
+}
+
+// Matches returns true if the transfer, part of the batch, matches all the selectors set
+func (k *Kill) Matches(batch *Batch, transfer *Transfer) bool {
+	return !k.IsEmpty() &&
+		(k.TransferId == "" || k.TransferId == transfer.TransferId) &&
+		(k.JobId == "" || k.JobId == transfer.JobId) &&
+		(k.SourceSe == "" || k.SourceSe == batch.SourceSe) &&
+		(k.DestSe == "" || k.DestSe == batch.DestSe) &&
+		(k.Vo == "" || k.Vo == batch.Vo) &&
+		(k.CredId == "" || k.CredId == batch.CredId)
+}
+
+// Select returns the ids of the transfers of the batch matched by the kill. The transfers
+// of a multiple source or multihop batch are all for the same file, so any match selects
+// all of them.
+func (k *Kill) Select(batch *Batch) []string {
+	ids := make([]string, 0)
+	for _, t := range batch.Transfers {
+		if k.Matches(batch, t) {
+			ids = append(ids, t.TransferId)
+		}
+	}
+	if len(ids) > 0 && batch.Type != Batch_SIMPLE {
+		ids = ids[:0]
+		for _, t := range batch.Transfers {
+			ids = append(ids, t.TransferId)
+		}
+	}
+	return ids
+}
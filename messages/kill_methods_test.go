@@ -0,0 +1,72 @@
+/*
+ * Copyright (c) CERN 2016
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package messages
+
+import (
+	"testing"
+)
+
+// newKillBatch returns a batch of the merge tests with two transfers from different jobs
+func newKillBatch(batchType Batch_Type) *Batch {
+	batch := newMergeBatch("a", 10)
+	batch.Type = batchType
+	batch.Transfers[0].JobId = "job1"
+	batch.Transfers = append(batch.Transfers, &Transfer{TransferId: "b", JobId: "job2"})
+	return batch
+}
+
+func TestKillSelect(t *testing.T) {
+	batch := newKillBatch(Batch_SIMPLE)
+
+	if ids := (&Kill{}).Select(batch); len(ids) != 0 {
+		t.Error("An empty kill must match nothing, got ", ids)
+	}
+	if ids := (&Kill{JobId: "job2"}).Select(batch); len(ids) != 1 || ids[0] != "b" {
+		t.Error("Expecting only b, got ", ids)
+	}
+	if ids := (&Kill{Vo: "dteam", CredId: "1234"}).Select(batch); len(ids) != 2 {
+		t.Error("Expecting both transfers, got ", ids)
+	}
+	if ids := (&Kill{Vo: "dteam", DestSe: "mock://other"}).Select(batch); len(ids) != 0 {
+		t.Error("All the selectors must match, got ", ids)
+	}
+	if ids := (&Kill{SourceSe: "mock://source", TransferId: "a"}).Select(batch); len(ids) != 1 || ids[0] != "a" {
+		t.Error("Expecting only a, got ", ids)
+	}
+}
+
+func TestKillSelectMultihop(t *testing.T) {
+	batch := newKillBatch(Batch_MULTIHOP)
+	if ids := (&Kill{TransferId: "b"}).Select(batch); len(ids) != 2 {
+		t.Error("Killing a hop must kill them all, got ", ids)
+	}
+}
+
+// Kills without id must get the same one for the same request.
+func TestKillEnsureID(t *testing.T) {
+	kill, same, other := &Kill{JobId: "job1"}, &Kill{JobId: "job1"}, &Kill{JobId: "job2"}
+	for _, k := range []*Kill{kill, same, other} {
+		k.EnsureID()
+	}
+	if kill.Id == "" || kill.Id != same.Id || kill.Id == other.Id {
+		t.Fatal("Expecting the same id only for the same request, got ", kill.Id, same.Id, other.Id)
+	}
+	given := &Kill{JobId: "job1", Id: "given"}
+	if given.EnsureID(); given.Id != "given" {
+		t.Fatal("Expecting the given id to be kept, got ", given.Id)
+	}
+}
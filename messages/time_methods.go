@@ -43,7 +43,7 @@ func (m *Interval) Elapsed() time.Duration {
 func (m *Interval) SetStart(t time.Time) {
 	utc := t.UTC()
 	m.Start = &timestamp.Timestamp{
-		Seconds: int64(utc.Second()),
+		Seconds: utc.Unix(),
 		Nanos:   int32(utc.Nanosecond()),
 	}
 }
@@ -52,7 +52,7 @@ func (m *Interval) SetStart(t time.Time) {
 func (m *Interval) SetEnd(t time.Time) {
 	utc := t.UTC()
 	m.End = &timestamp.Timestamp{
-		Seconds: int64(utc.Second()),
+		Seconds: utc.Unix(),
 		Nanos:   int32(utc.Nanosecond()),
 	}
 }
@@ -61,7 +61,7 @@ func (m *Interval) SetEnd(t time.Time) {
 func Now() *timestamp.Timestamp {
 	utc := time.Now().UTC()
 	return &timestamp.Timestamp{
-		Seconds: int64(utc.Second()),
+		Seconds: utc.Unix(),
 		Nanos:   int32(utc.Nanosecond()),
 	}
 }
@@ -0,0 +1,59 @@
+/*
+ * Copyright (c) CERN 2016
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"time"
+)
+
+// Factor applied to the number of actives when the link degrades
+const aimdDecreaseFactor = 0.5
+
+// aimdAlgorithm does additive increase, multiplicative decrease, as TCP congestion control.
+// It backs off faster than the step algorithm when a link starts misbehaving.
+type aimdAlgorithm struct {
+	linkWindows
+}
+
+func newAIMDAlgorithm(params Params) Algorithm {
+	return &aimdAlgorithm{newLinkWindows(params)}
+}
+
+// Decide implements Algorithm.Decide
+func (a *aimdAlgorithm) Decide(link string, current int, now time.Time) Decision {
+	stats, lastThroughput := a.evaluate(link, now)
+	decision := newDecision(link, current, stats, now)
+	decision.NewMax, decision.Reason = a.decide(current, stats, lastThroughput)
+	return decision
+}
+
+// decide returns the new number of actives for a link, and the reason for it
+func (a *aimdAlgorithm) decide(current int, stats linkStats, lastThroughput float64) (int, string) {
+	decreased := int(float64(current) * aimdDecreaseFactor)
+	switch {
+	case stats.Samples < a.params.MinSamples:
+		return current, "Not enough samples"
+	case stats.SuccessRate < lowSuccessRate:
+		return decreased, "Low success rate"
+	case lastThroughput > 0 && stats.Throughput < lastThroughput*(1-throughputTolerance):
+		return decreased, "Throughput decreased"
+	case stats.SuccessRate >= highSuccessRate:
+		return current + 1, "Good success rate and throughput did not decrease"
+	default:
+		return current, "Stable"
+	}
+}
@@ -0,0 +1,167 @@
+/*
+ * Copyright (c) CERN 2016
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"gitlab.cern.ch/flutter/fts/messages"
+	"sort"
+	"time"
+)
+
+const (
+	// Below this success rate, the number of actives is decreased
+	lowSuccessRate = 0.9
+	// From this success rate on, the number of actives can be increased
+	highSuccessRate = 0.99
+	// Relative throughput drop considered noise
+	throughputTolerance = 0.1
+)
+
+type (
+	// Algorithm decides the number of actives of the links from the transfers outcome
+	Algorithm interface {
+		// Feed is called with each batch in a terminal state
+		Feed(batch *messages.Batch, now time.Time)
+		// FeedMarker is called with the performance markers of the running transfers
+		FeedMarker(marker *messages.PerformanceMarker, now time.Time)
+		// Links returns the links that need to be evaluated
+		Links(now time.Time) []string
+		// Decide returns the new number of actives for the link, given the current one.
+		// The result is bounded afterwards by the caller.
+		Decide(link string, current int, now time.Time) Decision
+		// Streams returns the number of streams per transfer to use for the link, and why
+		Streams(link string, current int) (int, string)
+	}
+
+	// AlgorithmFactory creates a new instance of an algorithm
+	AlgorithmFactory func(params Params) Algorithm
+)
+
+// Algorithms holds the available algorithms by name
+var Algorithms = map[string]AlgorithmFactory{
+	"step": newStepAlgorithm,
+	"aimd": newAIMDAlgorithm,
+}
+
+// NewAlgorithm returns a new instance of the algorithm with the given name
+func NewAlgorithm(name string, params Params) (Algorithm, error) {
+	factory, ok := Algorithms[name]
+	if !ok {
+		return nil, fmt.Errorf("Unknown algorithm %s (available: %v)", name, AlgorithmNames())
+	}
+	return factory(params), nil
+}
+
+// AlgorithmNames returns the sorted list of algorithm names
+func AlgorithmNames() []string {
+	names := make([]string, 0, len(Algorithms))
+	for name := range Algorithms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// newDecision fills a decision that keeps the current number of actives
+func newDecision(link string, current int, stats linkStats, now time.Time) Decision {
+	return Decision{
+		Timestamp:   now.UTC(),
+		Link:        link,
+		PreviousMax: current,
+		NewMax:      current,
+		Throughput:  stats.Throughput,
+		SuccessRate: stats.SuccessRate,
+		Samples:     stats.Samples,
+	}
+}
+
+// bound keeps the number of actives within the configured range, and then within
+// the static limits of the link
+func (p *Params) bound(link string, actives int) int {
+	if actives < p.MinActive {
+		actives = p.MinActive
+	} else if actives > p.MaxActive {
+		actives = p.MaxActive
+	}
+	return p.Limits.Bound(link, actives)
+}
+
+// changed returns true if the decision modifies any of the link limits
+func (d *Decision) changed() bool {
+	return d.NewMax != d.PreviousMax || d.NewStreams != d.PreviousStreams || d.Breaker != ""
+}
+
+// evaluate runs the algorithm over all its links and stores the decisions that change the
+// number of actives or streams. All decisions are returned, even those that do not change anything.
+// Streams are only tuned if MaxStreams is set. Links with a tripped breaker are left alone,
+// but the breakers due are moved to probing.
+func evaluate(algorithm Algorithm, breakers *Breakers, store LimitStore, params Params, now time.Time) ([]Decision, error) {
+	links := algorithm.Links(now)
+	decisions := make([]Decision, 0, len(links))
+
+	for _, decision := range breakers.Probe(now) {
+		if err := applyBreaker(store, params, &decision); err != nil {
+			return decisions, err
+		}
+		decisions = append(decisions, decision)
+	}
+
+	for _, link := range links {
+		if breakers.Tripped(link) {
+			continue
+		}
+		current, err := store.GetMax(link)
+		if err != nil {
+			return decisions, err
+		}
+		if current == 0 {
+			current = params.Limits.Initial(link)
+		}
+		decision := algorithm.Decide(link, current, now)
+		decision.NewMax = params.bound(link, decision.NewMax)
+
+		if params.MaxStreams > 0 {
+			if decision.PreviousStreams, err = store.GetStreams(link); err != nil {
+				return decisions, err
+			}
+			decision.NewStreams, decision.StreamsReason = algorithm.Streams(link, decision.PreviousStreams)
+		}
+
+		if decision.changed() {
+			if err := store.Save(&decision); err != nil {
+				return decisions, err
+			}
+		}
+		decisions = append(decisions, decision)
+	}
+	return decisions, nil
+}
+
+// applyBreaker stores a change of state of a circuit breaker.
+// The number of actives is filled only for the record, it is not modified.
+func applyBreaker(store LimitStore, params Params, decision *Decision) error {
+	current, err := store.GetMax(decision.Link)
+	if err != nil {
+		return err
+	}
+	if current == 0 {
+		current = params.Limits.Initial(decision.Link)
+	}
+	decision.PreviousMax, decision.NewMax = current, current
+	return store.Save(decision)
+}
@@ -0,0 +1,189 @@
+/*
+ * Copyright (c) CERN 2016
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"gitlab.cern.ch/flutter/fts/config"
+	"gitlab.cern.ch/flutter/fts/messages"
+	"sort"
+	"time"
+)
+
+type (
+	// breaker is the circuit breaker of a single link or storage
+	breaker struct {
+		state string
+		// Consecutive failures, reset by any success
+		failures  int
+		lastError *messages.TransferError
+		opened    time.Time
+		// links with failures counted by the breaker of a storage
+		links map[string]bool
+	}
+
+	// Breakers cuts the links that fail every transfer. After BreakerThreshold consecutive
+	// unrecoverable failures a link is opened, and nothing runs on it. Every BreakerProbe,
+	// a single transfer is let through; if it succeeds, the link is closed again.
+	// Storages have their own breakers, for the failures blamed on them as source or
+	// destination. They only trip when the failures come from more than one link, since
+	// the breaker of the link is enough otherwise.
+	Breakers struct {
+		params Params
+		links  map[string]*breaker
+	}
+)
+
+// NewBreakers creates the circuit breakers, all closed
+func NewBreakers(params Params) *Breakers {
+	return &Breakers{
+		params: params,
+		links:  make(map[string]*breaker),
+	}
+}
+
+// counts returns true if the failure says something about the health of the link.
+// Errors from the agent, or flagged as recoverable, are transient.
+func counts(transferError *messages.TransferError) bool {
+	return transferError.GetScope() != messages.TransferError_AGENT && !transferError.GetRecoverable()
+}
+
+// newBreakerDecision returns a decision that only changes the breaker state
+func newBreakerDecision(link, state, reason string, now time.Time) *Decision {
+	return &Decision{
+		Timestamp: now.UTC(),
+		Link:      link,
+		Breaker:   state,
+		Reason:    reason,
+	}
+}
+
+// Feed updates the breakers of the link and of its storages with the outcome of the batch.
+// The decisions of those changing state are returned.
+func (b *Breakers) Feed(batch *messages.Batch, now time.Time) []Decision {
+	link := linkKey(batch.SourceSe, batch.DestSe)
+	decisions := make([]Decision, 0)
+	for _, key := range []string{link, batch.SourceSe, batch.DestSe} {
+		if decision := b.feed(key, link, batch, now); decision != nil {
+			decisions = append(decisions, *decision)
+		}
+	}
+	return decisions
+}
+
+// blames returns true if the failure counts against the breaker of the key
+func blames(key string, batch *messages.Batch, transferError *messages.TransferError) bool {
+	switch key {
+	case batch.SourceSe:
+		return transferError.GetScope() == messages.TransferError_SOURCE
+	case batch.DestSe:
+		return transferError.GetScope() == messages.TransferError_DESTINATION
+	}
+	return true
+}
+
+// feed updates the breaker of the key, the link of the batch or one of its storages.
+// If the breaker changes state, the decision is returned.
+func (b *Breakers) feed(key, link string, batch *messages.Batch, now time.Time) *Decision {
+	isLink := key == link
+	br, ok := b.links[key]
+	// Tripped breakers restored from a previous run must still be closed when disabled
+	if !ok && b.params.BreakerThreshold == 0 {
+		return nil
+	} else if !ok {
+		br = &breaker{state: config.BreakerClosed, links: make(map[string]bool)}
+		b.links[key] = br
+	}
+
+	var succeeded, failed bool
+	for _, t := range batch.Ran() {
+		switch t.State {
+		case messages.Transfer_FINISHED:
+			succeeded = true
+			br.failures = 0
+			br.links = make(map[string]bool)
+		case messages.Transfer_FAILED:
+			transferError := t.GetInfo().GetError()
+			if counts(transferError) && blames(key, batch, transferError) {
+				failed = true
+				br.failures++
+				br.lastError = transferError
+				br.links[link] = true
+			}
+		}
+	}
+
+	switch br.state {
+	case config.BreakerProbe:
+		if failed {
+			br.state, br.opened = config.BreakerOpen, now
+			return newBreakerDecision(key, config.BreakerOpen, fmt.Sprintf(
+				"Probe failed (%s: %s)", br.lastError.GetScope(), br.lastError.GetDescription(),
+			), now)
+		} else if succeeded {
+			delete(b.links, key)
+			return newBreakerDecision(key, config.BreakerClosed, "Probe succeeded", now)
+		}
+	case config.BreakerClosed:
+		if br.failures >= b.params.BreakerThreshold && (isLink || len(br.links) > 1) {
+			br.state, br.opened = config.BreakerOpen, now
+			reason := fmt.Sprintf("%d consecutive unrecoverable failures", br.failures)
+			if !isLink {
+				reason = fmt.Sprintf("%s over %d links", reason, len(br.links))
+			}
+			return newBreakerDecision(key, config.BreakerOpen, fmt.Sprintf(
+				"%s (%s: %s)", reason, br.lastError.GetScope(), br.lastError.GetDescription(),
+			), now)
+		} else if br.failures == 0 {
+			// Nothing to remember for healthy links
+			delete(b.links, key)
+		}
+	}
+	return nil
+}
+
+// Probe lets a transfer through the links and storages that have been open for long enough
+func (b *Breakers) Probe(now time.Time) []Decision {
+	links := make([]string, 0)
+	for link, br := range b.links {
+		if br.state == config.BreakerOpen && now.Sub(br.opened) >= b.params.BreakerProbe {
+			links = append(links, link)
+		}
+	}
+	sort.Strings(links)
+
+	decisions := make([]Decision, 0, len(links))
+	for _, link := range links {
+		b.links[link].state = config.BreakerProbe
+		decisions = append(decisions, *newBreakerDecision(link, config.BreakerProbe, "Probing", now))
+	}
+	return decisions
+}
+
+// Tripped returns true if the breaker of the link, or storage, is open or probing
+func (b *Breakers) Tripped(link string) bool {
+	br, ok := b.links[link]
+	return ok && br.state != config.BreakerClosed
+}
+
+// Restore sets the state of the breakers persisted by a previous run. They are considered
+// opened now, so the probe happens after a full BreakerProbe.
+func (b *Breakers) Restore(states map[string]string, now time.Time) {
+	for link, state := range states {
+		b.links[link] = &breaker{state: state, opened: now, links: make(map[string]bool)}
+	}
+}
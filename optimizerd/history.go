@@ -0,0 +1,71 @@
+/*
+ * Copyright (c) CERN 2016
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/garyburd/redigo/redis"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+var historyCmd = &cobra.Command{
+	Use:   "history",
+	Short: "Show the decisions taken for a link",
+	Run: func(cmd *cobra.Command, args []string) {
+		link, _ := cmd.Flags().GetString("link")
+		limit, _ := cmd.Flags().GetInt("limit")
+		if link == "" {
+			log.Fatal("Missing --link")
+		}
+
+		conn, err := redis.Dial("tcp", viper.Get("optimizerd.redis").(string))
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer conn.Close()
+
+		decisions, err := getHistory(conn, link, limit)
+		if err != nil {
+			log.Fatal(err)
+		}
+		printHistory(os.Stdout, link, decisions)
+	},
+}
+
+// printHistory writes the decisions as a table
+func printHistory(out io.Writer, link string, decisions []Decision) {
+	if len(decisions) == 0 {
+		fmt.Fprintln(out, "No decisions recorded for", link)
+		return
+	}
+
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "TIMESTAMP\tPREVIOUS\tNEW\tSTREAMS\tTHROUGHPUT (MB/s)\tSUCCESS (%)\tSAMPLES\tREASON")
+	for _, d := range decisions {
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%.2f\t%.2f\t%d\t%s\n",
+			d.Timestamp.Format(time.RFC3339), d.PreviousMax, d.NewMax, d.NewStreams,
+			d.Throughput/(1024*1024), d.SuccessRate*100, d.Samples, d.Summary(),
+		)
+	}
+	w.Flush()
+}
@@ -0,0 +1,103 @@
+/*
+ * Copyright (c) CERN 2016
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"gitlab.cern.ch/flutter/fts/config"
+	"time"
+)
+
+const (
+	// JournalPrefix is prepended to the link key to build the journal key
+	JournalPrefix = "fts-optimizer-journal"
+	// BreakersKey is the set of links with a tripped circuit breaker
+	BreakersKey = "fts-optimizer-breakers"
+	// JournalLength is the number of decisions kept for each link, older ones are dropped
+	JournalLength = 1000
+)
+
+type (
+	// Decision records a change of the number of actives or streams of a link, and why it was taken.
+	// Breaker is only set when the circuit breaker of the link changes state. Storages only
+	// have breakers, and their decisions are journaled with the storage as Link.
+	Decision struct {
+		Timestamp       time.Time `json:"timestamp"`
+		Link            string    `json:"link"`
+		PreviousMax     int       `json:"previous_max"`
+		NewMax          int       `json:"new_max"`
+		PreviousStreams int       `json:"previous_streams,omitempty"`
+		NewStreams      int       `json:"new_streams,omitempty"`
+		Throughput      float64   `json:"throughput"`
+		SuccessRate     float64   `json:"success_rate"`
+		Samples         int       `json:"samples"`
+		Reason          string    `json:"reason"`
+		StreamsReason   string    `json:"streams_reason,omitempty"`
+		Breaker         string    `json:"breaker,omitempty"`
+	}
+)
+
+// Summary returns the reasons of the decision, including the streams if they changed
+func (d *Decision) Summary() string {
+	if d.Breaker != "" {
+		return fmt.Sprintf("Breaker %s: %s", d.Breaker, d.Reason)
+	}
+	if d.NewStreams != d.PreviousStreams {
+		return fmt.Sprintf("%s; %s", d.Reason, d.StreamsReason)
+	}
+	return d.Reason
+}
+
+// journalKey returns the key of the list holding the decisions of the given link
+func journalKey(link string) string {
+	return JournalPrefix + config.ScoreboardKeySeparator + link
+}
+
+// appendDecision adds the decision at the end of the journal of its link, and drops
+// the oldest ones beyond JournalLength. Entries are never modified once written.
+func appendDecision(conn redis.Conn, decision *Decision) error {
+	data, err := json.Marshal(decision)
+	if err != nil {
+		return err
+	}
+	key := journalKey(decision.Link)
+	conn.Send("MULTI")
+	conn.Send("RPUSH", key, data)
+	conn.Send("LTRIM", key, -JournalLength, -1)
+	_, err = conn.Do("EXEC")
+	return err
+}
+
+// getHistory returns the last decisions taken for the given link, oldest first.
+// If limit is 0, all the decisions are returned.
+func getHistory(conn redis.Conn, link string, limit int) ([]Decision, error) {
+	values, err := redis.ByteSlices(conn.Do("LRANGE", journalKey(link), -limit, -1))
+	if err != nil {
+		return nil, err
+	}
+	decisions := make([]Decision, 0, len(values))
+	for _, value := range values {
+		var decision Decision
+		if err := json.Unmarshal(value, &decision); err != nil {
+			return nil, err
+		}
+		decisions = append(decisions, decision)
+	}
+	return decisions, nil
+}
@@ -0,0 +1,74 @@
+/*
+ * Copyright (c) CERN 2016
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/garyburd/redigo/redis"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The journal must keep the last decisions of each link, oldest first, and drop
+// those beyond its length.
+func TestJournal(t *testing.T) {
+	server, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	conn, err := redis.Dial("tcp", server.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	link := "mock://source#mock://dest"
+	for i := 0; i < JournalLength+5; i++ {
+		decision := &Decision{Timestamp: time.Unix(int64(i), 0), Link: link, NewMax: i, Reason: "Testing"}
+		if err := appendDecision(conn, decision); err != nil {
+			t.Fatal(err)
+		}
+	}
+	appendDecision(conn, &Decision{Link: "mock://other#mock://dest", NewMax: 1})
+
+	all, err := getHistory(conn, link, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != JournalLength || all[0].NewMax != 5 {
+		t.Fatal("Expecting the oldest decisions to be dropped, got ", len(all), " starting by ", all[0].NewMax)
+	}
+	last, _ := getHistory(conn, link, 2)
+	if len(last) != 2 || last[0].NewMax != JournalLength+3 || last[1].NewMax != JournalLength+4 {
+		t.Fatal("Expecting the last two decisions, got ", last)
+	}
+
+	var out bytes.Buffer
+	printHistory(&out, link, last)
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 3 || !strings.Contains(lines[2], "Testing") {
+		t.Fatal("Expecting a header and two decisions, got ", out.String())
+	}
+	out.Reset()
+	printHistory(&out, "unknown", nil)
+	if !strings.HasPrefix(out.String(), "No decisions recorded") {
+		t.Fatal("Expecting no decisions, got ", out.String())
+	}
+}
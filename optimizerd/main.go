@@ -17,12 +17,11 @@
 package main
 
 import (
+	"fmt"
 	log "github.com/Sirupsen/logrus"
-	"github.com/satori/go.uuid"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 	"gitlab.cern.ch/flutter/fts/config"
-	"gitlab.cern.ch/flutter/fts/sink"
 	"gitlab.cern.ch/flutter/stomp"
 	"os"
 	"time"
@@ -59,15 +58,57 @@ var optimizerCmd = cobra.Command{
 			},
 		}
 
-		if err := sink.Purge(stompParams, "Consumer.optimizer.fts.transfer", "optimizer-"+uuid.NewV4().String()); err != nil {
+		params := getParams()
+		algorithm, err := NewAlgorithm(viper.Get("optimizerd.algorithm").(string), params)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		optimizer, err := NewOptimizer(stompParams, viper.Get("optimizerd.redis").(string), algorithm, params)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer optimizer.Close()
+
+		if recordFile := viper.Get("optimizerd.record").(string); recordFile != "" {
+			recorder, err := NewRecorder(recordFile)
+			if err != nil {
+				log.Fatal(err)
+			}
+			optimizer.Record(recorder)
+		}
+
+		if err := optimizer.Run(); err != nil {
 			log.Fatal(err)
 		}
 	},
 }
 
+// getParams builds the optimizer parameters from the configuration, aborts on error
+func getParams() Params {
+	limits, err := config.GetLimits()
+	if err != nil {
+		log.Fatal(err)
+	}
+	return Params{
+		Window:     time.Duration(viper.Get("optimizerd.window").(int)) * time.Second,
+		Interval:   time.Duration(viper.Get("optimizerd.interval").(int)) * time.Second,
+		MinSamples: viper.Get("optimizerd.samples").(int),
+		MinActive:  viper.Get("optimizerd.actives.min").(int),
+		MaxActive:  viper.Get("optimizerd.actives.max").(int),
+		MinStreams: viper.Get("optimizerd.streams.min").(int),
+		MaxStreams: viper.Get("optimizerd.streams.max").(int),
+		Limits:     limits,
+
+		BreakerThreshold: viper.Get("optimizerd.breaker.threshold").(int),
+		BreakerProbe:     time.Duration(viper.Get("optimizerd.breaker.probe").(int)) * time.Second,
+	}
+}
+
 func main() {
 	// Config file
-	configFile := optimizerCmd.Flags().String("Config", "", "Use configuration from this file")
+	configFile := optimizerCmd.PersistentFlags().String("Config", "", "Use configuration from this file")
+	optimizerCmd.PersistentFlags().String("Redis", "localhost:6379", "Redis host and port")
 
 	// Stomp flags
 	config.BindStompFlags(&optimizerCmd)
@@ -75,9 +116,41 @@ func main() {
 	// Specific flags
 	optimizerCmd.Flags().String("Log", "", "Log file")
 	optimizerCmd.Flags().Bool("Debug", true, "Enable debugging")
+	optimizerCmd.Flags().String("Record", "", "Append the terminated batches to this file, for replaying")
+
+	// Algorithm flags, shared with replay
+	optimizerCmd.PersistentFlags().String("Algorithm", "step", fmt.Sprintf("Optimizer algorithm %v", AlgorithmNames()))
+	optimizerCmd.PersistentFlags().Int("Window", 300, "Number of seconds of samples considered for each decision")
+	optimizerCmd.PersistentFlags().Int("Interval", 60, "Number of seconds between evaluations")
+	optimizerCmd.PersistentFlags().Int("MinSamples", 10, "Minimum number of samples required to change the actives")
+	optimizerCmd.PersistentFlags().Int("MinActive", config.ScoreboardDefaultSlots, "Minimum number of actives per link")
+	optimizerCmd.PersistentFlags().Int("MaxActive", 60, "Maximum number of actives per link")
+	optimizerCmd.PersistentFlags().Int("MinStreams", 1, "Minimum number of streams per transfer")
+	optimizerCmd.PersistentFlags().Int("MaxStreams", 8, "Maximum number of streams per transfer (0 disables the tuning)")
+	optimizerCmd.PersistentFlags().Int("BreakerThreshold", 10, "Consecutive failures that cut a link (0 disables the circuit breaker)")
+	optimizerCmd.PersistentFlags().Int("BreakerProbe", 300, "Number of seconds a cut link waits before letting a probe through")
 
 	viper.BindPFlag("optimizerd.log", optimizerCmd.Flags().Lookup("Log"))
 	viper.BindPFlag("optimizerd.debug", optimizerCmd.Flags().Lookup("Debug"))
+	viper.BindPFlag("optimizerd.redis", optimizerCmd.PersistentFlags().Lookup("Redis"))
+	viper.BindPFlag("optimizerd.record", optimizerCmd.Flags().Lookup("Record"))
+	viper.BindPFlag("optimizerd.algorithm", optimizerCmd.PersistentFlags().Lookup("Algorithm"))
+	viper.BindPFlag("optimizerd.window", optimizerCmd.PersistentFlags().Lookup("Window"))
+	viper.BindPFlag("optimizerd.interval", optimizerCmd.PersistentFlags().Lookup("Interval"))
+	viper.BindPFlag("optimizerd.samples", optimizerCmd.PersistentFlags().Lookup("MinSamples"))
+	viper.BindPFlag("optimizerd.actives.min", optimizerCmd.PersistentFlags().Lookup("MinActive"))
+	viper.BindPFlag("optimizerd.actives.max", optimizerCmd.PersistentFlags().Lookup("MaxActive"))
+	viper.BindPFlag("optimizerd.streams.min", optimizerCmd.PersistentFlags().Lookup("MinStreams"))
+	viper.BindPFlag("optimizerd.streams.max", optimizerCmd.PersistentFlags().Lookup("MaxStreams"))
+	viper.BindPFlag("optimizerd.breaker.threshold", optimizerCmd.PersistentFlags().Lookup("BreakerThreshold"))
+	viper.BindPFlag("optimizerd.breaker.probe", optimizerCmd.PersistentFlags().Lookup("BreakerProbe"))
+
+	// Subcommands
+	historyCmd.Flags().String("link", "", "Link, as SOURCE#DESTINATION")
+	historyCmd.Flags().Int("limit", 0, "Show only the last decisions (0 for all)")
+	optimizerCmd.AddCommand(historyCmd)
+	replayCmd.Flags().Bool("all", false, "Print also the evaluations that did not change the actives")
+	optimizerCmd.AddCommand(replayCmd)
 
 	cobra.OnInitialize(func() {
 		if *configFile != "" {
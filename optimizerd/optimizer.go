@@ -0,0 +1,284 @@
+/*
+ * Copyright (c) CERN 2016
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/garyburd/redigo/redis"
+	"github.com/golang/protobuf/proto"
+	"github.com/satori/go.uuid"
+	"gitlab.cern.ch/flutter/fts/config"
+	"gitlab.cern.ch/flutter/fts/messages"
+	"gitlab.cern.ch/flutter/stomp"
+	"sync"
+	"time"
+)
+
+type (
+	// Params configures the optimizer behaviour
+	Params struct {
+		// Window is how far back samples are considered
+		Window time.Duration
+		// Interval is how often links are evaluated
+		Interval time.Duration
+		// MinSamples is the minimum number of samples required to take a decision
+		MinSamples int
+		// MinActive and MaxActive bound the number of actives per link
+		MinActive, MaxActive int
+		// Limits are static limits per link, they take precedence over MinActive and MaxActive
+		Limits config.Limits
+		// MinStreams and MaxStreams bound the number of streams per transfer.
+		// If MaxStreams is 0, the streams are not tuned.
+		MinStreams, MaxStreams int
+		// BreakerThreshold is the number of consecutive failures that trip the circuit breaker
+		// of a link. If 0, there is no circuit breaker.
+		BreakerThreshold int
+		// BreakerProbe is how long a tripped link waits before letting a probe through
+		BreakerProbe time.Duration
+	}
+
+	// Optimizer decides how many transfers a link can sustain
+	Optimizer struct {
+		params         Params
+		consumer       *stomp.Consumer
+		markerConsumer *stomp.Consumer
+		pool           *redis.Pool
+		recorder       *Recorder
+
+		mutex     sync.Mutex
+		algorithm Algorithm
+		breakers  *Breakers
+		store     LimitStore
+	}
+)
+
+// NewOptimizer creates a new optimizer
+func NewOptimizer(stompParams stomp.ConnectionParameters, redisAddr string, algorithm Algorithm, params Params) (*Optimizer, error) {
+	var err error
+	optimizer := &Optimizer{
+		params:    params,
+		algorithm: algorithm,
+		breakers:  NewBreakers(params),
+	}
+
+	if optimizer.consumer, err = stomp.NewConsumer(stompParams); err != nil {
+		return nil, err
+	}
+	if optimizer.markerConsumer, err = stomp.NewConsumer(stompParams); err != nil {
+		optimizer.consumer.Close()
+		return nil, err
+	}
+	optimizer.pool = &redis.Pool{
+		Dial: func() (redis.Conn, error) {
+			log.Debug("Dial Redis connection")
+			return redis.Dial("tcp", redisAddr)
+		},
+		TestOnBorrow: func(c redis.Conn, t time.Time) error {
+			_, err := c.Do("PING")
+			return err
+		},
+		MaxIdle:     5,
+		MaxActive:   10,
+		IdleTimeout: 60 * time.Second,
+		Wait:        true,
+	}
+	optimizer.store = &redisStore{pool: optimizer.pool}
+
+	breakers, err := optimizer.store.Breakers()
+	if err != nil {
+		optimizer.Close()
+		return nil, err
+	}
+	optimizer.breakers.Restore(breakers, time.Now())
+	return optimizer, nil
+}
+
+// Record writes all the terminated batches into the recorder, so they can be replayed later
+func (o *Optimizer) Record(recorder *Recorder) {
+	o.recorder = recorder
+}
+
+// Close finishes the optimizer
+func (o *Optimizer) Close() {
+	o.consumer.Close()
+	o.markerConsumer.Close()
+	o.pool.Close()
+	if o.recorder != nil {
+		o.recorder.Close()
+	}
+}
+
+// Run spawns required subservices and waits for them
+func (o *Optimizer) Run() error {
+	errors := make(chan error, 10)
+
+	go func() {
+		errors <- o.RunConsumer()
+	}()
+	go func() {
+		errors <- o.RunMarkerConsumer()
+	}()
+	go func() {
+		errors <- o.RunEvaluator()
+	}()
+
+	return <-errors
+}
+
+// RunConsumer feeds the link windows with the terminal transfer states
+func (o *Optimizer) RunConsumer() error {
+	consumerID := fmt.Sprint("fts-optimizer-", uuid.NewV4().String())
+	batchChannel, errorChannel, err := o.consumer.Subscribe(
+		config.OptimizerQueue,
+		consumerID,
+		stomp.AckAuto,
+	)
+	if err != nil {
+		return err
+	}
+
+	log.Info("Consumer started")
+
+	for {
+		select {
+		case msg, ok := <-batchChannel:
+			if !ok {
+				return nil
+			}
+			batch := messages.Batch{}
+			if err = proto.Unmarshal(msg.Body, &batch); err != nil {
+				log.WithError(err).Error("Could not parse batch")
+				continue
+			}
+			// Only terminal states carry information about the link performance
+			if batch.State == messages.Batch_DONE {
+				o.feed(&batch, time.Now())
+			}
+		case error, ok := <-errorChannel:
+			if !ok {
+				return nil
+			}
+			log.WithError(error).Warn("Got an error from the subcription channel")
+		}
+	}
+}
+
+// RunMarkerConsumer feeds the link windows with the performance of the running transfers
+func (o *Optimizer) RunMarkerConsumer() error {
+	consumerID := fmt.Sprint("fts-optimizer-perf-", uuid.NewV4().String())
+	markerChannel, errorChannel, err := o.markerConsumer.Subscribe(
+		config.PerformanceTopic,
+		consumerID,
+		stomp.AckAuto,
+	)
+	if err != nil {
+		return err
+	}
+
+	log.Info("Performance marker consumer started")
+
+	for {
+		select {
+		case msg, ok := <-markerChannel:
+			if !ok {
+				return nil
+			}
+			marker := messages.PerformanceMarker{}
+			if err = proto.Unmarshal(msg.Body, &marker); err != nil {
+				log.WithError(err).Error("Could not parse performance marker")
+				continue
+			}
+			o.mutex.Lock()
+			o.algorithm.FeedMarker(&marker, time.Now())
+			o.mutex.Unlock()
+		case error, ok := <-errorChannel:
+			if !ok {
+				return nil
+			}
+			log.WithError(error).Warn("Got an error from the subcription channel")
+		}
+	}
+}
+
+// feed passes the terminated batch to the algorithm, and records it if configured
+func (o *Optimizer) feed(batch *messages.Batch, now time.Time) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	o.algorithm.Feed(batch, now)
+	decisions := o.breakers.Feed(batch, now)
+	for i := range decisions {
+		if err := applyBreaker(o.store, o.params, &decisions[i]); err != nil {
+			log.WithError(err).Error("Failed to store the circuit breaker state")
+		}
+		logDecision(&decisions[i])
+	}
+	if o.recorder != nil {
+		if err := o.recorder.Write(batch); err != nil {
+			log.WithError(err).Error("Failed to record the batch")
+		}
+	}
+}
+
+// RunEvaluator periodically evaluates all the known links
+func (o *Optimizer) RunEvaluator() error {
+	log.Info("Evaluator started")
+	for range time.Tick(o.params.Interval) {
+		if err := o.evaluate(time.Now()); err != nil {
+			log.WithError(err).Error("Failed to evaluate the links")
+		}
+	}
+	return nil
+}
+
+// evaluate decides the new number of actives for each link
+func (o *Optimizer) evaluate(now time.Time) error {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	decisions, err := evaluate(o.algorithm, o.breakers, o.store, o.params, now)
+	for i := range decisions {
+		logDecision(&decisions[i])
+	}
+	return err
+}
+
+// logDecision logs the outcome of an evaluation
+func logDecision(decision *Decision) {
+	l := log.WithFields(log.Fields{
+		"link":       decision.Link,
+		"samples":    decision.Samples,
+		"success":    decision.SuccessRate,
+		"throughput": decision.Throughput,
+		"reason":     decision.Reason,
+	})
+	if decision.Breaker != "" {
+		l.Warnf("Circuit breaker %s", decision.Breaker)
+		return
+	}
+	if decision.NewMax == decision.PreviousMax {
+		l.Debugf("Keep %d actives", decision.PreviousMax)
+	} else {
+		l.Infof("Change actives from %d to %d", decision.PreviousMax, decision.NewMax)
+	}
+	if decision.NewStreams != decision.PreviousStreams {
+		l.WithField("reason", decision.StreamsReason).Infof(
+			"Change streams from %d to %d", decision.PreviousStreams, decision.NewStreams,
+		)
+	}
+}
@@ -0,0 +1,413 @@
+/*
+ * Copyright (c) CERN 2016
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"gitlab.cern.ch/flutter/fts/config"
+	"gitlab.cern.ch/flutter/fts/messages"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+var testParams = Params{
+	Window:     5 * time.Minute,
+	Interval:   time.Minute,
+	MinSamples: 2,
+	MinActive:  2,
+	MaxActive:  10,
+}
+
+func newTestBatch(states ...messages.Transfer_State) *messages.Batch {
+	batch := &messages.Batch{
+		State:    messages.Batch_DONE,
+		SourceSe: "mock://source",
+		DestSe:   "mock://dest",
+	}
+	for _, state := range states {
+		batch.Transfers = append(batch.Transfers, &messages.Transfer{
+			State: state,
+			Info: &messages.TransferInfo{
+				Stats: &messages.TransferRunStatistics{Transferred: 1024},
+			},
+		})
+	}
+	return batch
+}
+
+// Samples older than the window must be discarded, and the throughput calculated
+// only with the successful transfers and the running ones.
+func TestWindow(t *testing.T) {
+	windows := newLinkWindows(testParams)
+	now := time.Now()
+
+	windows.Feed(newTestBatch(messages.Transfer_FINISHED), now.Add(-10*time.Minute))
+	windows.Feed(newTestBatch(messages.Transfer_FINISHED, messages.Transfer_FAILED), now.Add(-100*time.Second))
+	windows.Feed(newTestBatch(messages.Transfer_CANCELED), now)
+	windows.FeedMarker(&messages.PerformanceMarker{
+		TransferId: "running",
+		SourceSe:   "mock://source",
+		DestSe:     "mock://dest",
+		Throughput: 10,
+	}, now)
+
+	links := windows.Links(now)
+	if len(links) != 1 || links[0] != "mock://source#mock://dest" {
+		t.Fatal("Expecting one link, got ", links)
+	}
+	window := windows.links[links[0]]
+	if len(window.samples) != 2 {
+		t.Fatal("Expecting 2 samples, got ", len(window.samples))
+	}
+
+	stats := window.stats(now, testParams.Window)
+	if stats.SuccessRate != 0.5 {
+		t.Error("Expecting a success rate of 0.5, got ", stats.SuccessRate)
+	}
+	if expected := 1024.0/testParams.Window.Seconds() + 10; stats.Throughput != expected {
+		t.Error("Expecting a throughput of ", expected, " got ", stats.Throughput)
+	}
+
+	// Stale markers must be forgotten
+	windows.Links(now.Add(2 * staleMarker))
+	if len(window.markers) != 0 {
+		t.Error("Expecting the stale marker to be dropped")
+	}
+}
+
+// The step decision must go in the right direction, one by one.
+func TestStep(t *testing.T) {
+	step := newStepAlgorithm(testParams).(*stepAlgorithm)
+
+	if decision, _ := step.decide(5, linkStats{Samples: 1, SuccessRate: 1}, 0); decision != 5 {
+		t.Error("Not enough samples, expecting 5, got ", decision)
+	}
+	if decision, _ := step.decide(5, linkStats{Samples: 10, SuccessRate: 0.5}, 0); decision != 4 {
+		t.Error("Low success rate, expecting 4, got ", decision)
+	}
+	if decision, _ := step.decide(5, linkStats{Samples: 10, SuccessRate: 1, Throughput: 50}, 100); decision != 4 {
+		t.Error("Throughput decreased, expecting 4, got ", decision)
+	}
+	if decision, _ := step.decide(5, linkStats{Samples: 10, SuccessRate: 1, Throughput: 100}, 95); decision != 6 {
+		t.Error("Good link, expecting 6, got ", decision)
+	}
+}
+
+// AIMD must halve on failure, and increase one by one.
+func TestAIMD(t *testing.T) {
+	aimd := newAIMDAlgorithm(testParams).(*aimdAlgorithm)
+
+	if decision, _ := aimd.decide(8, linkStats{Samples: 10, SuccessRate: 0.5}, 0); decision != 4 {
+		t.Error("Low success rate, expecting 4, got ", decision)
+	}
+	if decision, _ := aimd.decide(8, linkStats{Samples: 10, SuccessRate: 1, Throughput: 50}, 100); decision != 4 {
+		t.Error("Throughput decreased, expecting 4, got ", decision)
+	}
+	if decision, _ := aimd.decide(8, linkStats{Samples: 10, SuccessRate: 1, Throughput: 100}, 95); decision != 9 {
+		t.Error("Good link, expecting 9, got ", decision)
+	}
+}
+
+// The evaluation must stay within the configured range, and only store changes.
+func TestEvaluate(t *testing.T) {
+	algorithm := newStepAlgorithm(testParams)
+	store := newMemoryStore()
+	now := time.Now()
+	link := "mock://source#mock://dest"
+
+	algorithm.Feed(newTestBatch(messages.Transfer_FAILED, messages.Transfer_FAILED), now)
+	decisions, err := evaluate(algorithm, NewBreakers(testParams), store, testParams, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(decisions) != 1 || decisions[0].NewMax != testParams.MinActive {
+		t.Fatal("Expecting the minimum to be respected, got ", decisions)
+	}
+	if _, ok := store.limits[link]; ok {
+		t.Error("Expecting nothing stored when the actives do not change")
+	}
+
+	algorithm = newStepAlgorithm(testParams)
+	store.limits[link] = testParams.MaxActive
+	algorithm.Feed(newTestBatch(messages.Transfer_FINISHED, messages.Transfer_FINISHED), now)
+	if decisions, _ = evaluate(algorithm, NewBreakers(testParams), store, testParams, now); decisions[0].NewMax != testParams.MaxActive {
+		t.Error("Expecting the maximum to be respected, got ", decisions[0].NewMax)
+	}
+}
+
+// Recorded batches must be replayed through the algorithm following their end time.
+func TestReplay(t *testing.T) {
+	file, err := ioutil.TempFile("", "fts-optimizer-replay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	file.Close()
+
+	recorder, err := NewRecorder(file.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Unix(1000000, 0)
+	for i := 0; i < 10; i++ {
+		batch := newTestBatch(messages.Transfer_FINISHED, messages.Transfer_FINISHED)
+		for _, transfer := range batch.Transfers {
+			transfer.Info.Stats.Intervals = &messages.TransferIntervals{Total: &messages.Interval{}}
+			transfer.Info.Stats.Intervals.Total.SetEnd(start.Add(time.Duration(i) * 30 * time.Second))
+		}
+		if err := recorder.Write(batch); err != nil {
+			t.Fatal(err)
+		}
+	}
+	recorder.Close()
+
+	file, err = os.Open(file.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	// The window covers the whole recording, so the throughput stays constant
+	params := testParams
+	params.Window = 10 * time.Minute
+	timeline, err := replay(NewBatchReader(file), newStepAlgorithm(params), params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Batches span four and a half minutes, so there must be five evaluations
+	if len(timeline) != 5 {
+		t.Fatal("Expecting 5 evaluations, got ", len(timeline))
+	}
+	if !timeline[0].Timestamp.Equal(start.Add(params.Interval)) {
+		t.Error("Expecting the first evaluation one interval after the first batch, got ", timeline[0].Timestamp)
+	}
+	last := timeline[len(timeline)-1]
+	if last.NewMax != params.MinActive+len(timeline) {
+		t.Error("Expecting the actives to increase on every evaluation, got ", last.NewMax)
+	}
+}
+
+func newStreamsBatch(streams uint32, throughput float32, count int) *messages.Batch {
+	batch := newTestBatch()
+	for i := 0; i < count; i++ {
+		batch.Transfers = append(batch.Transfers, &messages.Transfer{
+			State:      messages.Transfer_FINISHED,
+			Parameters: &messages.TransferParameters{Nstreams: streams},
+			Info: &messages.TransferInfo{
+				Stats: &messages.TransferRunStatistics{Transferred: 1024, Throughput: throughput},
+			},
+		})
+	}
+	return batch
+}
+
+// The number of streams must probe upwards, and move towards the best throughput.
+func TestStreams(t *testing.T) {
+	params := testParams
+	params.MinStreams, params.MaxStreams = 1, 4
+	windows := newLinkWindows(params)
+	link := "mock://source#mock://dest"
+	now := time.Now()
+
+	if streams, _ := windows.Streams(link, 0); streams != 1 {
+		t.Error("Expecting the minimum when there is nothing set, got ", streams)
+	}
+	if streams, _ := windows.Streams(link, 2); streams != 2 {
+		t.Error("Not enough samples, expecting 2, got ", streams)
+	}
+
+	windows.Feed(newStreamsBatch(2, 100, 2), now)
+	if streams, _ := windows.Streams(link, 2); streams != 3 {
+		t.Error("Expecting to probe 3 streams, got ", streams)
+	}
+
+	windows.Feed(newStreamsBatch(3, 50, 2), now)
+	if streams, _ := windows.Streams(link, 3); streams != 2 {
+		t.Error("Expecting to go back to 2 streams, got ", streams)
+	}
+	if streams, _ := windows.Streams(link, 2); streams != 2 {
+		t.Error("Expecting to stay with 2 streams, got ", streams)
+	}
+
+	windows.Feed(newStreamsBatch(1, 200, 2), now)
+	if streams, _ := windows.Streams(link, 2); streams != 1 {
+		t.Error("Expecting to go down to 1 stream, got ", streams)
+	}
+}
+
+// Static limits must take precedence over the optimizer decision.
+func TestStaticLimits(t *testing.T) {
+	params := testParams
+	link := "mock://source#mock://dest"
+	params.Limits = config.Limits{
+		link: config.Limit{Source: "mock://source", Destination: "mock://dest", Min: 4, Max: 5},
+	}
+	algorithm := newStepAlgorithm(params)
+	store := newMemoryStore()
+	now := time.Now()
+
+	algorithm.Feed(newTestBatch(messages.Transfer_FAILED, messages.Transfer_FAILED), now)
+	decisions, err := evaluate(algorithm, NewBreakers(params), store, params, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decisions[0].PreviousMax != 4 || decisions[0].NewMax != 4 {
+		t.Error("Expecting the link to start and stay at its static minimum, got ", decisions[0])
+	}
+
+	store.limits[link] = 5
+	algorithm = newStepAlgorithm(params)
+	algorithm.Feed(newTestBatch(messages.Transfer_FINISHED, messages.Transfer_FINISHED), now)
+	if decisions, _ = evaluate(algorithm, NewBreakers(params), store, params, now); decisions[0].NewMax != 5 {
+		t.Error("Expecting the static maximum to be respected, got ", decisions[0].NewMax)
+	}
+}
+
+func newFailedBatch(count int, scope messages.TransferError_Scope, recoverable bool) *messages.Batch {
+	batch := newTestBatch()
+	for i := 0; i < count; i++ {
+		batch.Transfers = append(batch.Transfers, &messages.Transfer{
+			State: messages.Transfer_FAILED,
+			Info: &messages.TransferInfo{
+				Error: &messages.TransferError{Scope: scope, Recoverable: recoverable, Description: "No space left"},
+			},
+		})
+	}
+	return batch
+}
+
+// The breaker must trip on consecutive unrecoverable failures, probe after a while,
+// and close once the probe succeeds.
+func TestBreaker(t *testing.T) {
+	params := testParams
+	params.BreakerThreshold = 3
+	params.BreakerProbe = 5 * time.Minute
+	algorithm := newStepAlgorithm(params)
+	breakers := NewBreakers(params)
+	store := newMemoryStore()
+	link := "mock://source#mock://dest"
+	now := time.Now()
+
+	if decisions := breakers.Feed(newFailedBatch(5, messages.TransferError_AGENT, false), now); len(decisions) != 0 {
+		t.Fatal("Agent errors must not trip the breaker")
+	}
+	if decisions := breakers.Feed(newFailedBatch(5, messages.TransferError_DESTINATION, true), now); len(decisions) != 0 {
+		t.Fatal("Recoverable errors must not trip the breaker")
+	}
+	breakers.Feed(newFailedBatch(2, messages.TransferError_DESTINATION, false), now)
+	breakers.Feed(newTestBatch(messages.Transfer_FINISHED), now)
+	if decisions := breakers.Feed(newFailedBatch(2, messages.TransferError_DESTINATION, false), now); len(decisions) != 0 {
+		t.Fatal("A success must reset the failure count")
+	}
+
+	decisions := breakers.Feed(newFailedBatch(1, messages.TransferError_DESTINATION, false), now)
+	if len(decisions) != 1 || decisions[0].Link != link || decisions[0].Breaker != config.BreakerOpen {
+		t.Fatal("Expecting only the breaker of the link to open, got ", decisions)
+	}
+	if err := applyBreaker(store, params, &decisions[0]); err != nil {
+		t.Fatal(err)
+	}
+	if store.breakers[link] != config.BreakerOpen {
+		t.Error("Expecting the open state stored")
+	}
+
+	// Tripped links are not evaluated until the probe is due
+	algorithm.Feed(newTestBatch(messages.Transfer_FINISHED, messages.Transfer_FINISHED), now)
+	decisions, _ = evaluate(algorithm, breakers, store, params, now.Add(time.Minute))
+	if len(decisions) != 0 {
+		t.Error("Expecting no decisions while open, got ", decisions)
+	}
+	decisions, _ = evaluate(algorithm, breakers, store, params, now.Add(params.BreakerProbe))
+	if len(decisions) != 1 || decisions[0].Breaker != config.BreakerProbe {
+		t.Fatal("Expecting the breaker to probe, got ", decisions)
+	}
+	if store.breakers[link] != config.BreakerProbe {
+		t.Error("Expecting the probe state stored")
+	}
+
+	// A failed probe opens again, a successful one closes
+	if decisions := breakers.Feed(newFailedBatch(1, messages.TransferError_DESTINATION, false), now); len(decisions) != 1 || decisions[0].Breaker != config.BreakerOpen {
+		t.Fatal("Expecting the breaker to open again, got ", decisions)
+	}
+	breakers.Probe(now.Add(params.BreakerProbe))
+	decisions = breakers.Feed(newTestBatch(messages.Transfer_FINISHED), now)
+	if len(decisions) != 1 || decisions[0].Breaker != config.BreakerClosed {
+		t.Fatal("Expecting the breaker to close, got ", decisions)
+	}
+	applyBreaker(store, params, &decisions[0])
+	if _, ok := store.breakers[link]; ok || breakers.Tripped(link) {
+		t.Error("Expecting the breaker to be removed")
+	}
+}
+
+// The breaker of a storage must only trip on the failures blamed on it, coming from
+// more than one link.
+func TestStorageBreaker(t *testing.T) {
+	params := testParams
+	params.BreakerThreshold = 3
+	params.BreakerProbe = 5 * time.Minute
+	breakers := NewBreakers(params)
+	now := time.Now()
+
+	if decisions := breakers.Feed(newFailedBatch(2, messages.TransferError_SOURCE, false), now); len(decisions) != 0 {
+		t.Fatal("Source errors must not trip the destination, got ", decisions)
+	}
+	breakers.Feed(newTestBatch(messages.Transfer_FINISHED), now)
+
+	other := newFailedBatch(2, messages.TransferError_DESTINATION, false)
+	other.SourceSe = "mock://other"
+	if decisions := breakers.Feed(other, now); len(decisions) != 0 {
+		t.Fatal("Not expecting any breaker to trip yet, got ", decisions)
+	}
+	decisions := breakers.Feed(newFailedBatch(1, messages.TransferError_DESTINATION, false), now)
+	if len(decisions) != 1 || decisions[0].Link != "mock://dest" || decisions[0].Breaker != config.BreakerOpen {
+		t.Fatal("Expecting the breaker of the destination to open, got ", decisions)
+	}
+	if !breakers.Tripped("mock://dest") || breakers.Tripped("mock://source") {
+		t.Fatal("Expecting only the destination to be tripped")
+	}
+
+	probes := breakers.Probe(now.Add(params.BreakerProbe))
+	if len(probes) != 1 || probes[0].Link != "mock://dest" {
+		t.Fatal("Expecting the destination to probe, got ", probes)
+	}
+	decisions = breakers.Feed(newTestBatch(messages.Transfer_FINISHED), now)
+	if len(decisions) != 1 || decisions[0].Breaker != config.BreakerClosed {
+		t.Fatal("Expecting the breaker of the destination to close, got ", decisions)
+	}
+}
+
+// Breakers restored from a previous run must keep counting failures.
+func TestRestoredBreaker(t *testing.T) {
+	params := testParams
+	params.BreakerThreshold = 3
+	params.BreakerProbe = 5 * time.Minute
+	breakers := NewBreakers(params)
+	now := time.Now()
+
+	breakers.Restore(map[string]string{
+		"mock://source#mock://dest": config.BreakerOpen,
+		"mock://dest":               config.BreakerOpen,
+	}, now)
+	if decisions := breakers.Feed(newFailedBatch(1, messages.TransferError_DESTINATION, false), now); len(decisions) != 0 {
+		t.Fatal("Not expecting an open breaker to change state, got ", decisions)
+	}
+	if !breakers.Tripped("mock://dest") {
+		t.Fatal("Expecting the restored breaker to stay open")
+	}
+}
@@ -0,0 +1,210 @@
+/*
+ * Copyright (c) CERN 2016
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/golang/protobuf/proto"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"gitlab.cern.ch/flutter/fts/messages"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+type (
+	// Recorder appends batches to a file, each one prefixed by its length as a varint
+	Recorder struct {
+		file *os.File
+	}
+
+	// BatchReader reads the batches written by a Recorder
+	BatchReader struct {
+		reader *bufio.Reader
+	}
+)
+
+// NewRecorder opens the file for appending, creating it if needed
+func NewRecorder(path string) (*Recorder, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &Recorder{file: file}, nil
+}
+
+// Write appends the batch to the file
+func (r *Recorder) Write(batch *messages.Batch) error {
+	data, err := proto.Marshal(batch)
+	if err != nil {
+		return err
+	}
+	buffer := make([]byte, binary.MaxVarintLen64, binary.MaxVarintLen64+len(data))
+	n := binary.PutUvarint(buffer, uint64(len(data)))
+	_, err = r.file.Write(append(buffer[:n], data...))
+	return err
+}
+
+// Close closes the underlying file
+func (r *Recorder) Close() error {
+	return r.file.Close()
+}
+
+// NewBatchReader creates a reader of recorded batches
+func NewBatchReader(r io.Reader) *BatchReader {
+	return &BatchReader{reader: bufio.NewReader(r)}
+}
+
+// Read returns the next batch, or io.EOF when there are no more
+func (r *BatchReader) Read() (*messages.Batch, error) {
+	size, err := binary.ReadUvarint(r.reader)
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, size)
+	if _, err = io.ReadFull(r.reader, data); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	batch := &messages.Batch{}
+	if err = proto.Unmarshal(data, batch); err != nil {
+		return nil, err
+	}
+	return batch, nil
+}
+
+// batchEnd returns when the last transfer of the batch finished, or zero if unknown
+func batchEnd(batch *messages.Batch) time.Time {
+	var end time.Time
+	for _, t := range batch.Transfers {
+		total := t.GetInfo().GetStats().GetIntervals().GetTotal()
+		if total == nil || total.End == nil {
+			continue
+		}
+		if tEnd := time.Unix(total.End.Seconds, int64(total.End.Nanos)); tEnd.After(end) {
+			end = tEnd
+		}
+	}
+	return end
+}
+
+// replay feeds the recorded batches into the algorithm, evaluating the links every
+// interval of a virtual clock driven by the end time of the transfers.
+// Limits are kept in memory, and all decisions are returned.
+func replay(reader *BatchReader, algorithm Algorithm, params Params) ([]Decision, error) {
+	store := newMemoryStore()
+	breakers := NewBreakers(params)
+	timeline := make([]Decision, 0)
+
+	var clock, nextEvaluation time.Time
+	for {
+		batch, err := reader.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return timeline, err
+		}
+		if batch.State != messages.Batch_DONE {
+			continue
+		}
+
+		// Batches without timing information, or out of order, happen "now"
+		if end := batchEnd(batch); end.After(clock) {
+			clock = end
+		}
+		if clock.IsZero() {
+			continue
+		}
+		if nextEvaluation.IsZero() {
+			nextEvaluation = clock.Add(params.Interval)
+		}
+		for !clock.Before(nextEvaluation) {
+			decisions, err := evaluate(algorithm, breakers, store, params, nextEvaluation)
+			timeline = append(timeline, decisions...)
+			if err != nil {
+				return timeline, err
+			}
+			nextEvaluation = nextEvaluation.Add(params.Interval)
+		}
+		algorithm.Feed(batch, clock)
+		for _, decision := range breakers.Feed(batch, clock) {
+			if err := applyBreaker(store, params, &decision); err != nil {
+				return timeline, err
+			}
+			timeline = append(timeline, decision)
+		}
+	}
+
+	// Last evaluation, with whatever was left
+	if !nextEvaluation.IsZero() {
+		decisions, err := evaluate(algorithm, breakers, store, params, nextEvaluation)
+		timeline = append(timeline, decisions...)
+		if err != nil {
+			return timeline, err
+		}
+	}
+	return timeline, nil
+}
+
+var replayCmd = &cobra.Command{
+	Use:   "replay FILE",
+	Short: "Run an algorithm over recorded batches, and print the decisions",
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) != 1 {
+			log.Fatal("Expecting the file with the recorded batches")
+		}
+		all, _ := cmd.Flags().GetBool("all")
+
+		params := getParams()
+		algorithm, err := NewAlgorithm(viper.Get("optimizerd.algorithm").(string), params)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		file, err := os.Open(args[0])
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer file.Close()
+
+		timeline, err := replay(NewBatchReader(file), algorithm, params)
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "TIMESTAMP\tLINK\tPREVIOUS\tNEW\tSTREAMS\tTHROUGHPUT (MB/s)\tSUCCESS (%)\tSAMPLES\tREASON")
+		for _, d := range timeline {
+			if !all && !d.changed() {
+				continue
+			}
+			fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%d\t%.2f\t%.2f\t%d\t%s\n",
+				d.Timestamp.Format(time.RFC3339), d.Link, d.PreviousMax, d.NewMax, d.NewStreams,
+				d.Throughput/(1024*1024), d.SuccessRate*100, d.Samples, d.Summary(),
+			)
+		}
+		w.Flush()
+
+		if err != nil {
+			log.Fatal(err)
+		}
+	},
+}
@@ -0,0 +1,55 @@
+/*
+ * Copyright (c) CERN 2016
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"time"
+)
+
+// stepAlgorithm is the classic FTS3 optimizer: one more active while the link behaves,
+// one less as soon as the success rate or the throughput drop.
+type stepAlgorithm struct {
+	linkWindows
+}
+
+func newStepAlgorithm(params Params) Algorithm {
+	return &stepAlgorithm{newLinkWindows(params)}
+}
+
+// Decide implements Algorithm.Decide
+func (s *stepAlgorithm) Decide(link string, current int, now time.Time) Decision {
+	stats, lastThroughput := s.evaluate(link, now)
+	decision := newDecision(link, current, stats, now)
+	decision.NewMax, decision.Reason = s.decide(current, stats, lastThroughput)
+	return decision
+}
+
+// decide returns the new number of actives for a link, and the reason for it
+func (s *stepAlgorithm) decide(current int, stats linkStats, lastThroughput float64) (int, string) {
+	switch {
+	case stats.Samples < s.params.MinSamples:
+		return current, "Not enough samples"
+	case stats.SuccessRate < lowSuccessRate:
+		return current - 1, "Low success rate"
+	case lastThroughput > 0 && stats.Throughput < lastThroughput*(1-throughputTolerance):
+		return current - 1, "Throughput decreased"
+	case stats.SuccessRate >= highSuccessRate:
+		return current + 1, "Good success rate and throughput did not decrease"
+	default:
+		return current, "Stable"
+	}
+}
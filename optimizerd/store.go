@@ -0,0 +1,171 @@
+/*
+ * Copyright (c) CERN 2016
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"github.com/garyburd/redigo/redis"
+	"gitlab.cern.ch/flutter/fts/config"
+)
+
+type (
+	// LimitStore keeps the number of actives decided for each link
+	LimitStore interface {
+		// GetMax returns the current number of actives for the link, or 0 if there is none yet
+		GetMax(link string) (int, error)
+		// GetStreams returns the current number of streams for the link, or 0 if there is none yet
+		GetStreams(link string) (int, error)
+		// Save stores the new number of actives and streams, or the new state of the
+		// circuit breaker, and records the decision
+		Save(decision *Decision) error
+		// Breakers returns the state of the tripped circuit breakers, by link
+		Breakers() (map[string]string, error)
+	}
+
+	// redisStore writes the limits into the scoreboard used by the scheduler
+	redisStore struct {
+		pool *redis.Pool
+	}
+
+	// memoryStore keeps the limits in memory, so algorithms can be run offline
+	memoryStore struct {
+		limits   map[string]int
+		streams  map[string]int
+		breakers map[string]string
+	}
+)
+
+// GetMax implements LimitStore.GetMax
+func (s *redisStore) GetMax(link string) (int, error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+	return getMax(conn, link)
+}
+
+// GetStreams implements LimitStore.GetStreams
+func (s *redisStore) GetStreams(link string) (int, error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+	streams, err := redis.Int(conn.Do("HGET", link, config.ScoreboardStreamsField))
+	if err == redis.ErrNil {
+		return 0, nil
+	}
+	return streams, err
+}
+
+// Save implements LimitStore.Save
+func (s *redisStore) Save(decision *Decision) error {
+	conn := s.pool.Get()
+	defer conn.Close()
+	if decision.Breaker != "" {
+		if err := saveBreaker(conn, decision.Link, decision.Breaker); err != nil {
+			return err
+		}
+		return appendDecision(conn, decision)
+	}
+	args := redis.Args{}.Add(decision.Link, config.ScoreboardMaxField, decision.NewMax)
+	if decision.NewStreams > 0 {
+		args = args.Add(config.ScoreboardStreamsField, decision.NewStreams)
+	}
+	if _, err := conn.Do("HMSET", args...); err != nil {
+		return err
+	}
+	return appendDecision(conn, decision)
+}
+
+// saveBreaker stores the state of the breaker in the link hash, so the scheduler knows about it
+func saveBreaker(conn redis.Conn, link, state string) error {
+	conn.Send("MULTI")
+	if state == config.BreakerClosed {
+		conn.Send("HDEL", link, config.ScoreboardBreakerField)
+		conn.Send("SREM", BreakersKey, link)
+	} else {
+		conn.Send("HSET", link, config.ScoreboardBreakerField, state)
+		conn.Send("SADD", BreakersKey, link)
+	}
+	_, err := conn.Do("EXEC")
+	return err
+}
+
+// Breakers implements LimitStore.Breakers
+func (s *redisStore) Breakers() (map[string]string, error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+	links, err := redis.Strings(conn.Do("SMEMBERS", BreakersKey))
+	if err != nil {
+		return nil, err
+	}
+	states := make(map[string]string, len(links))
+	for _, link := range links {
+		state, err := redis.String(conn.Do("HGET", link, config.ScoreboardBreakerField))
+		if err == redis.ErrNil {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		states[link] = state
+	}
+	return states, nil
+}
+
+// getMax returns the current number of actives for the link, or 0 if there is none yet
+func getMax(conn redis.Conn, key string) (int, error) {
+	max, err := redis.Int(conn.Do("HGET", key, config.ScoreboardMaxField))
+	if err == redis.ErrNil {
+		return 0, nil
+	}
+	return max, err
+}
+
+// newMemoryStore returns an empty memory store
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		limits:   make(map[string]int),
+		streams:  make(map[string]int),
+		breakers: make(map[string]string),
+	}
+}
+
+// GetMax implements LimitStore.GetMax
+func (s *memoryStore) GetMax(link string) (int, error) {
+	return s.limits[link], nil
+}
+
+// GetStreams implements LimitStore.GetStreams
+func (s *memoryStore) GetStreams(link string) (int, error) {
+	return s.streams[link], nil
+}
+
+// Save implements LimitStore.Save
+func (s *memoryStore) Save(decision *Decision) error {
+	if decision.Breaker == config.BreakerClosed {
+		delete(s.breakers, decision.Link)
+		return nil
+	} else if decision.Breaker != "" {
+		s.breakers[decision.Link] = decision.Breaker
+		return nil
+	}
+	s.limits[decision.Link] = decision.NewMax
+	if decision.NewStreams > 0 {
+		s.streams[decision.Link] = decision.NewStreams
+	}
+	return nil
+}
+
+// Breakers implements LimitStore.Breakers
+func (s *memoryStore) Breakers() (map[string]string, error) {
+	return s.breakers, nil
+}
@@ -0,0 +1,85 @@
+/*
+ * Copyright (c) CERN 2016
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+)
+
+// streamsStats is the average throughput per transfer achieved with a given number of streams
+type streamsStats struct {
+	samples    int
+	throughput float64
+}
+
+// streamsBreakdown groups the successful samples of the window by number of streams
+func (w *linkWindow) streamsBreakdown() map[int]*streamsStats {
+	breakdown := make(map[int]*streamsStats)
+	for _, s := range w.samples {
+		if !s.success || s.streams == 0 {
+			continue
+		}
+		stats, ok := breakdown[s.streams]
+		if !ok {
+			stats = &streamsStats{}
+			breakdown[s.streams] = stats
+		}
+		stats.throughput = (stats.throughput*float64(stats.samples) + s.throughput) / float64(stats.samples+1)
+		stats.samples++
+	}
+	return breakdown
+}
+
+// Streams climbs towards the number of streams giving the best throughput per transfer.
+// It moves to a neighbour when it has been observed to perform noticeably better, and probes
+// one stream more when that has not been observed recently, so the optimum is tracked as the
+// link conditions change.
+func (w *linkWindows) Streams(link string, current int) (int, string) {
+	if current < w.params.MinStreams {
+		return w.params.MinStreams, "Below the minimum number of streams"
+	} else if current > w.params.MaxStreams {
+		return w.params.MaxStreams, "Above the maximum number of streams"
+	}
+
+	breakdown := w.get(link).streamsBreakdown()
+	enough := func(streams int) bool {
+		stats, ok := breakdown[streams]
+		return ok && stats.samples >= w.params.MinSamples
+	}
+
+	if !enough(current) {
+		return current, fmt.Sprintf("Not enough samples with %d streams", current)
+	}
+
+	best := current
+	for _, neighbour := range []int{current - 1, current + 1} {
+		if neighbour < w.params.MinStreams || neighbour > w.params.MaxStreams || !enough(neighbour) {
+			continue
+		}
+		if breakdown[neighbour].throughput > breakdown[best].throughput*(1+throughputTolerance) {
+			best = neighbour
+		}
+	}
+	if best != current {
+		return best, fmt.Sprintf("Better throughput with %d streams", best)
+	}
+
+	if probe := current + 1; probe <= w.params.MaxStreams && !enough(probe) {
+		return probe, fmt.Sprintf("Probing %d streams", probe)
+	}
+	return current, "Stable"
+}
@@ -0,0 +1,224 @@
+/*
+ * Copyright (c) CERN 2016
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"gitlab.cern.ch/flutter/fts/config"
+	"gitlab.cern.ch/flutter/fts/messages"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Performance markers older than this are considered to belong to a transfer that is gone
+const staleMarker = time.Minute
+
+type (
+	// sample is the outcome of a single transfer
+	sample struct {
+		when        time.Time
+		success     bool
+		transferred uint64
+		// Number of streams used, and throughput achieved by the transfer
+		streams    int
+		throughput float64
+	}
+
+	// marker is the last performance marker seen for a running transfer
+	marker struct {
+		when       time.Time
+		throughput float64
+	}
+
+	// linkWindow keeps the samples of a link received during the last window
+	linkWindow struct {
+		firstSeen time.Time
+		samples   []sample
+		markers   map[string]marker
+		// Throughput seen during the previous evaluation
+		lastThroughput float64
+	}
+
+	// linkStats summarizes the samples of a window
+	linkStats struct {
+		// Number of samples
+		Samples int
+		// Ratio of successful transfers, between 0 and 1
+		SuccessRate float64
+		// Aggregated throughput of the link, in bytes per second
+		Throughput float64
+	}
+
+	// linkWindows keeps one window per link. It implements the feeding part of an Algorithm,
+	// so the implementations only need to provide the decision.
+	linkWindows struct {
+		params Params
+		links  map[string]*linkWindow
+	}
+)
+
+// add appends a new sample to the window
+func (w *linkWindow) add(s sample) {
+	if w.firstSeen.IsZero() || s.when.Before(w.firstSeen) {
+		w.firstSeen = s.when
+	}
+	w.samples = append(w.samples, s)
+}
+
+// trim drops the samples older than the window, and the stale markers
+func (w *linkWindow) trim(now time.Time, window time.Duration) {
+	limit := now.Add(-window)
+	kept := w.samples[:0]
+	for _, s := range w.samples {
+		if s.when.After(limit) {
+			kept = append(kept, s)
+		}
+	}
+	w.samples = kept
+
+	for id, m := range w.markers {
+		if now.Sub(m.when) > staleMarker {
+			delete(w.markers, id)
+		}
+	}
+}
+
+// stats calculates the success rate and aggregated throughput over the window.
+// The throughput is the number of bytes moved by successful transfers divided by
+// the window length, or by the time since the first sample if that is shorter, plus
+// the throughput reported by the transfers still running.
+func (w *linkWindow) stats(now time.Time, window time.Duration) linkStats {
+	stats := linkStats{Samples: len(w.samples)}
+
+	var successes int
+	var transferred uint64
+	for _, s := range w.samples {
+		if s.success {
+			successes++
+			transferred += s.transferred
+		}
+	}
+	if stats.Samples > 0 {
+		stats.SuccessRate = float64(successes) / float64(stats.Samples)
+	}
+
+	elapsed := now.Sub(w.firstSeen)
+	if elapsed > window {
+		elapsed = window
+	}
+	if elapsed > 0 {
+		stats.Throughput = float64(transferred) / elapsed.Seconds()
+	}
+	for _, m := range w.markers {
+		stats.Throughput += m.throughput
+	}
+	return stats
+}
+
+// newLinkWindows creates an empty set of windows
+func newLinkWindows(params Params) linkWindows {
+	return linkWindows{
+		params: params,
+		links:  make(map[string]*linkWindow),
+	}
+}
+
+// linkKey returns the scoreboard key for the given link
+func linkKey(source, destination string) string {
+	return strings.Join([]string{source, destination}, config.ScoreboardKeySeparator)
+}
+
+// get returns the window for the link, creating it if needed
+func (w *linkWindows) get(key string) *linkWindow {
+	window, ok := w.links[key]
+	if !ok {
+		window = &linkWindow{markers: make(map[string]marker)}
+		w.links[key] = window
+	}
+	return window
+}
+
+// Feed adds the outcome of the transfers of a terminated batch to the link window
+func (w *linkWindows) Feed(batch *messages.Batch, now time.Time) {
+	window := w.get(linkKey(batch.SourceSe, batch.DestSe))
+
+	for _, t := range batch.Ran() {
+		delete(window.markers, t.TransferId)
+
+		s := sample{when: now}
+		switch t.State {
+		case messages.Transfer_FINISHED:
+			s.success = true
+			if stats := t.GetInfo().GetStats(); stats != nil {
+				s.transferred = stats.Transferred
+				s.throughput = float64(stats.Throughput)
+			}
+			if t.Parameters != nil {
+				s.streams = int(t.Parameters.Nstreams)
+			}
+		case messages.Transfer_FAILED:
+			// Errors caused by the agent say nothing about the link
+			if t.GetInfo().GetError().GetScope() == messages.TransferError_AGENT {
+				continue
+			}
+		default:
+			continue
+		}
+		window.add(s)
+	}
+}
+
+// FeedMarker keeps the throughput of a running transfer. Markers without any data
+// transferred are sent when the transfer starts, and say nothing about the throughput.
+func (w *linkWindows) FeedMarker(perf *messages.PerformanceMarker, now time.Time) {
+	if perf.Transferred == 0 && perf.Throughput == 0 {
+		return
+	}
+	window := w.get(linkKey(perf.SourceSe, perf.DestSe))
+	window.markers[perf.TransferId] = marker{
+		when:       now,
+		throughput: float64(perf.Throughput),
+	}
+}
+
+// Links returns, sorted, the links with information within the window.
+// Links without any are forgotten.
+func (w *linkWindows) Links(now time.Time) []string {
+	links := make([]string, 0, len(w.links))
+	for key, window := range w.links {
+		window.trim(now, w.params.Window)
+		if len(window.samples) == 0 && len(window.markers) == 0 {
+			delete(w.links, key)
+		} else {
+			links = append(links, key)
+		}
+	}
+	sort.Strings(links)
+	return links
+}
+
+// evaluate returns the stats for the given link, and the throughput of the previous
+// evaluation. The current throughput is remembered for the next one if there are enough samples.
+func (w *linkWindows) evaluate(key string, now time.Time) (linkStats, float64) {
+	window := w.get(key)
+	stats := window.stats(now, w.params.Window)
+	lastThroughput := window.lastThroughput
+	if stats.Samples >= w.params.MinSamples {
+		window.lastThroughput = stats.Throughput
+	}
+	return stats, lastThroughput
+}
@@ -0,0 +1,334 @@
+/*
+ * Copyright (c) CERN 2016
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	log "github.com/Sirupsen/logrus"
+	"github.com/garyburd/redigo/redis"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Kinds of scoreboard entry
+const (
+	EntryStorage  = "storage"
+	EntryLink     = "link"
+	EntryVo       = "vo"
+	EntryActivity = "activity"
+)
+
+// ErrUnknownKey is returned when setting the maximum of a key that is not in the scoreboard
+var ErrUnknownKey = errors.New("Not a storage, link, VO or activity of the scoreboard")
+
+type (
+	// ScoreboardEntry is the number of running transfers, and the maximum if set, of a
+	// storage, link, VO or activity. Storages share a single entry as source and destination.
+	ScoreboardEntry struct {
+		Key     string `json:"key"`
+		Kind    string `json:"kind"`
+		Counter int    `json:"counter"`
+		Max     *int   `json:"max"`
+	}
+
+	// maxRequest is the body of a request to set the maximum of a scoreboard key
+	maxRequest struct {
+		Key string `json:"key"`
+		Max *int   `json:"max"`
+	}
+
+	// pathRequest is the body of a request to pause or resume a queue
+	pathRequest struct {
+		Path []string `json:"path"`
+	}
+)
+
+// entryKind tells what a scoreboard key accounts for. A link and a VO within a destination
+// both have two parts, but VOs are not urls.
+func entryKind(key string) string {
+	parts := strings.Split(key, KeySeparator)
+	switch len(parts) {
+	case 1:
+		return EntryStorage
+	case 2:
+		if strings.Contains(parts[1], "://") {
+			return EntryLink
+		}
+		return EntryVo
+	default:
+		return EntryActivity
+	}
+}
+
+// GetEntries returns the entries of the scoreboard of the given kind, or all of them
+// if empty, sorted by key
+func (info *RedisScoreboard) GetEntries(kind string) ([]ScoreboardEntry, error) {
+	conn := info.pool.Get()
+	defer conn.Close()
+
+	keys, err := scoreboardKeys(conn)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(keys)
+
+	entries := make([]ScoreboardEntry, 0, len(keys))
+	for _, key := range keys {
+		if kind != "" && entryKind(key) != kind {
+			continue
+		}
+		values, err := redis.Values(conn.Do("HMGET", key, fieldCounter, fieldMax))
+		if err != nil {
+			return nil, err
+		}
+		var counter, max int
+		if _, err = redis.Scan(values, &counter, &max); err != nil {
+			return nil, err
+		}
+		entry := ScoreboardEntry{Key: key, Kind: entryKind(key), Counter: counter}
+		if values[1] != nil {
+			entry.Max = &max
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// setMaxScript sets the field ARGV[2] of the hash KEYS[1] to ARGV[3], only if it has the
+// counter field ARGV[1], so only scoreboard keys are changed. It returns 1 if set.
+var setMaxScript = redis.NewScript(1, `
+if redis.call("HEXISTS", KEYS[1], ARGV[1]) == 0 then
+	return 0
+end
+redis.call("HSET", KEYS[1], ARGV[2], ARGV[3])
+return 1
+`)
+
+// SetMax sets the maximum number of running transfers for a scoreboard key, and returns
+// ErrUnknownKey if the key is not in the scoreboard
+func (info *RedisScoreboard) SetMax(key string, max int) error {
+	conn := info.pool.Get()
+	defer conn.Close()
+	set, err := redis.Bool(setMaxScript.Do(conn, key, fieldCounter, fieldMax, max))
+	if err == nil && !set {
+		return ErrUnknownKey
+	}
+	return err
+}
+
+// writeJSON sends the value encoded as JSON
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		log.WithError(err).Warn("Failed to write the admin response")
+	}
+}
+
+// writeError sends the error as a JSON object
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// allowMethod rejects the request, and returns false, unless it uses the method
+func allowMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method != method {
+		w.Header().Set("Allow", method)
+		writeError(w, http.StatusMethodNotAllowed, errors.New("Expecting "+method))
+		return false
+	}
+	return true
+}
+
+// allowChange rejects the request, and returns false, unless it may change the state of
+// the scheduler: it must carry the admin token if there is one, or come from this host
+func (s *Scheduler) allowChange(w http.ResponseWriter, r *http.Request) bool {
+	if s.params.AdminToken != "" {
+		given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(given), []byte(s.params.AdminToken)) != 1 {
+			writeError(w, http.StatusUnauthorized, errors.New("Expecting the admin token"))
+			return false
+		}
+		return true
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if ip := net.ParseIP(host); err != nil || ip == nil || !ip.IsLoopback() {
+		writeError(w, http.StatusForbidden, errors.New("Changes are only allowed from this host without an admin token"))
+		return false
+	}
+	return true
+}
+
+// adminHandler returns the handler of the admin API
+func (s *Scheduler) adminHandler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/queues", func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethod(w, r, "GET") {
+			return
+		}
+		if depths, err := s.store.QueueDepths(); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+		} else {
+			writeJSON(w, http.StatusOK, depths)
+		}
+	})
+
+	mux.HandleFunc("/queues/paused", func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethod(w, r, "GET") {
+			return
+		}
+		if paused, err := s.scoreboard.ListPaused(); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+		} else {
+			writeJSON(w, http.StatusOK, paused)
+		}
+	})
+
+	pauseHandler := func(pause bool) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if !allowMethod(w, r, "POST") || !s.allowChange(w, r) {
+				return
+			}
+			request := pathRequest{}
+			if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+				writeError(w, http.StatusBadRequest, err)
+				return
+			} else if !validQueuePath(request.Path) {
+				writeError(w, http.StatusBadRequest, errors.New("Expecting a path of destination, vo, activity and source"))
+				return
+			}
+
+			var changed bool
+			var err error
+			if pause {
+				changed, err = s.scoreboard.PauseQueue(request.Path)
+			} else {
+				changed, err = s.scoreboard.ResumeQueue(request.Path)
+			}
+			if err != nil {
+				writeError(w, http.StatusInternalServerError, err)
+				return
+			}
+			if pause {
+				log.WithField("path", request.Path).Info("Paused queue")
+			} else {
+				log.WithField("path", request.Path).Info("Resumed queue")
+				s.wake()
+			}
+			writeJSON(w, http.StatusOK, map[string]interface{}{"path": request.Path, "paused": pause, "changed": changed})
+		}
+	}
+	mux.HandleFunc("/queues/pause", pauseHandler(true))
+	mux.HandleFunc("/queues/resume", pauseHandler(false))
+
+	mux.HandleFunc("/scoreboard", func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethod(w, r, "GET") {
+			return
+		}
+		if entries, err := s.scoreboard.GetEntries(r.URL.Query().Get("kind")); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+		} else {
+			writeJSON(w, http.StatusOK, entries)
+		}
+	})
+
+	mux.HandleFunc("/scoreboard/max", func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethod(w, r, "POST") || !s.allowChange(w, r) {
+			return
+		}
+		request := maxRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		} else if request.Key == "" || request.Max == nil || *request.Max < 0 {
+			writeError(w, http.StatusBadRequest, errors.New("Expecting a key and a non negative max"))
+			return
+		}
+
+		if err := s.scoreboard.SetMax(request.Key, *request.Max); err == ErrUnknownKey {
+			writeError(w, http.StatusNotFound, err)
+			return
+		} else if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		log.WithField("key", request.Key).Info("Max set to ", *request.Max)
+		s.wake()
+		writeJSON(w, http.StatusOK, request)
+	})
+
+	mux.HandleFunc("/explain", func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethod(w, r, "GET") {
+			return
+		}
+		batchID, jobID := r.URL.Query().Get("batch"), r.URL.Query().Get("job")
+		if batchID == "" && jobID == "" {
+			writeError(w, http.StatusBadRequest, errors.New("Expecting a batch or a job id"))
+			return
+		}
+		explanations, err := s.Explain(batchID, jobID)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+		} else if len(explanations) == 0 {
+			writeError(w, http.StatusNotFound, errors.New("Not queued, it may be running, done, waiting for a retry or being packed"))
+		} else {
+			writeJSON(w, http.StatusOK, explanations)
+		}
+	})
+
+	mux.HandleFunc("/leader", func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethod(w, r, "GET") {
+			return
+		}
+		leader, err := s.store.Leader()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"leader": leader, "id": s.id, "leading": s.leadership() != "",
+		})
+	})
+
+	mux.HandleFunc("/reconcile", func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethod(w, r, "POST") || !s.allowChange(w, r) {
+			return
+		}
+		live, err := s.scoreboard.Reconcile(time.Now())
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		log.Info("Counters rebuilt from ", live, " live leases")
+		s.wake()
+		writeJSON(w, http.StatusOK, map[string]int{"leases": live})
+	})
+
+	return mux
+}
+
+// RunAdmin serves the admin API
+func (s *Scheduler) RunAdmin() error {
+	log.Info("Admin API listening on ", s.params.Admin)
+	return http.ListenAndServe(s.params.Admin, s.adminHandler())
+}
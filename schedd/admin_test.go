@@ -0,0 +1,107 @@
+/*
+ * Copyright (c) CERN 2016
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"gitlab.cern.ch/flutter/fts/config"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// adminRequest sends a request to the admin API from the given address, with the token
+// if not empty, and returns the status
+func adminRequest(s *Scheduler, method, path, body, remote, token string) int {
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	r.RemoteAddr = remote
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	s.adminHandler().ServeHTTP(w, r)
+	return w.Code
+}
+
+// Only the max of keys already in the scoreboard can be set, never that of other hashes.
+func TestScoreboardSetMax(t *testing.T) {
+	limits := config.Limits{testLink: config.Limit{Source: testSource, Destination: testDest, Fixed: 10}}
+	for _, backend := range newTestBackends(t, limits) {
+		if err := backend.scoreboard.SetMax(testLink, 5); err != ErrUnknownKey {
+			t.Fatal(backend.name, ": Expecting an unknown key, got ", err)
+		}
+		if err := backend.scoreboard.ConsumeSlot(newTestBatch("atlas", "a"), ""); err != nil {
+			t.Fatal(backend.name, ": ", err)
+		}
+		if err := backend.scoreboard.SetMax(testLink, 5); err != nil {
+			t.Fatal(backend.name, ": ", err)
+		}
+		backend.scoreboard.SetBan(&Ban{Kind: BanVo, Name: "dteam"})
+		if err := backend.scoreboard.SetMax(BansKey, 5); err != ErrUnknownKey {
+			t.Fatal(backend.name, ": Expecting the bans to be left alone, got ", err)
+		}
+
+		entries, _ := backend.scoreboard.GetEntries(EntryLink)
+		if len(entries) != 1 || entries[0].Max == nil || *entries[0].Max != 5 {
+			t.Fatal(backend.name, ": Expecting the link to be capped, got ", entries)
+		}
+		if bans, _ := backend.scoreboard.ListBans(); len(bans) != 1 {
+			t.Fatal(backend.name, ": Expecting the ban to be kept, got ", bans)
+		}
+	}
+}
+
+// Without a token, changes must only be accepted from this host, and with one, only
+// along it. Reading stays open.
+func TestAdminChanges(t *testing.T) {
+	s, _, _, _ := newTestScheduler(t)
+	pause := `{"path": ["` + testDest + `", "atlas"]}`
+
+	if status := adminRequest(s, "GET", "/queues", "", "192.0.2.1:4321", ""); status != http.StatusOK {
+		t.Fatal("Expecting to read from anywhere, got ", status)
+	}
+	if status := adminRequest(s, "POST", "/queues/pause", pause, "192.0.2.1:4321", ""); status != http.StatusForbidden {
+		t.Fatal("Expecting changes from elsewhere to be refused, got ", status)
+	}
+	if paused, _ := s.scoreboard.ListPaused(); len(paused) != 0 {
+		t.Fatal("Not expecting the queue to be paused, got ", paused)
+	}
+	if status := adminRequest(s, "POST", "/queues/pause", pause, "127.0.0.1:4321", ""); status != http.StatusOK {
+		t.Fatal("Expecting changes from this host, got ", status)
+	}
+	if paused, _ := s.scoreboard.ListPaused(); len(paused) != 1 {
+		t.Fatal("Expecting the queue to be paused, got ", paused)
+	}
+
+	s.params.AdminToken = "secret"
+	if status := adminRequest(s, "POST", "/reconcile", "", "127.0.0.1:4321", ""); status != http.StatusUnauthorized {
+		t.Fatal("Expecting the token to be required, got ", status)
+	}
+	if status := adminRequest(s, "POST", "/reconcile", "", "192.0.2.1:4321", "wrong"); status != http.StatusUnauthorized {
+		t.Fatal("Expecting a wrong token to be refused, got ", status)
+	}
+	if status := adminRequest(s, "POST", "/reconcile", "", "192.0.2.1:4321", "secret"); status != http.StatusOK {
+		t.Fatal("Expecting changes along the token, got ", status)
+	}
+
+	if status := adminRequest(s, "POST", "/scoreboard/max", `{"key": "`+BansKey+`", "max": 1}`, "192.0.2.1:4321", "secret"); status != http.StatusNotFound {
+		t.Fatal("Expecting only scoreboard keys, got ", status)
+	}
+	if status := adminRequest(s, "POST", "/scoreboard/max", `{"key": "`+testDest+`"}`, "192.0.2.1:4321", "secret"); status != http.StatusBadRequest {
+		t.Fatal("Expecting a max, got ", status)
+	}
+}
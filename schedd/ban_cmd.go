@@ -0,0 +1,184 @@
+/*
+ * Copyright (c) CERN 2016
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/garyburd/redigo/redis"
+	"github.com/golang/protobuf/proto"
+	"github.com/satori/go.uuid"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"gitlab.cern.ch/flutter/fts/config"
+	"gitlab.cern.ch/flutter/fts/messages"
+	"gitlab.cern.ch/flutter/stomp"
+	"os"
+	"os/user"
+	"strings"
+	"time"
+)
+
+var banKindsUsage = strings.Join(BanKinds, "|")
+
+// banKills returns the kills stopping the transfers running under the ban
+func banKills(ban *Ban, requester string) []*messages.Kill {
+	selectors := make([]messages.Kill, 0, 2)
+	switch ban.Kind {
+	case BanSource:
+		selectors = append(selectors, messages.Kill{SourceSe: ban.Name})
+	case BanDestination:
+		selectors = append(selectors, messages.Kill{DestSe: ban.Name})
+	case BanStorage:
+		selectors = append(selectors, messages.Kill{SourceSe: ban.Name}, messages.Kill{DestSe: ban.Name})
+	case BanVo:
+		selectors = append(selectors, messages.Kill{Vo: ban.Name})
+	case BanUser:
+		selectors = append(selectors, messages.Kill{CredId: ban.Name})
+	}
+
+	kills := make([]*messages.Kill, 0, len(selectors))
+	for i := range selectors {
+		kill := &selectors[i]
+		kill.Id = uuid.NewV4().String()
+		kill.Requester = requester
+		kill.Requested = messages.Now()
+		kills = append(kills, kill)
+	}
+	return kills
+}
+
+// sendKills broadcasts the kills, so the schedulers cancel the queued transfers, and the
+// workers those running
+func sendKills(kills []*messages.Kill) error {
+	hostname, _ := os.Hostname()
+	producer, err := stomp.NewProducer(stomp.ConnectionParameters{
+		ClientID: "fts-schedd-ban-" + hostname,
+		Address:  viper.Get("stomp").(string),
+		Login:    viper.Get("stomp.login").(string),
+		Passcode: viper.Get("stomp.passcode").(string),
+	})
+	if err != nil {
+		return err
+	}
+	defer producer.Close()
+
+	for _, kill := range kills {
+		data, err := proto.Marshal(kill)
+		if err != nil {
+			return err
+		}
+		if err = producer.Send(config.KillTopic, string(data), stomp.SendParams{Persistent: true}); err != nil {
+			return err
+		}
+		fmt.Println("Sent kill", kill.Id)
+	}
+	return nil
+}
+
+// dialRedis connects to the Redis used by the scheduler
+func dialRedis() redis.Conn {
+	conn, err := redis.Dial("tcp", viper.Get("schedd.redis").(string))
+	if err != nil {
+		log.Fatal(err)
+	}
+	return conn
+}
+
+// checkBanArgs aborts unless the arguments are a valid kind of ban and a name
+func checkBanArgs(args []string) {
+	if len(args) != 2 || !validBanKind(args[0]) {
+		log.Fatalf("Expecting %s and a name", banKindsUsage)
+	}
+}
+
+var banCmd = &cobra.Command{
+	Use:   "ban " + banKindsUsage + " NAME",
+	Short: "Ban a storage, as source, destination or both, a VO or a user credentials id",
+	Long: `Ban a storage, as source, destination or both, a VO or a user.
+Users are banned by the id of their delegated credentials, not by their DN, since
+batches do not carry it.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		checkBanArgs(args)
+		cancel, _ := cmd.Flags().GetBool("Cancel")
+		reason, _ := cmd.Flags().GetString("Reason")
+
+		requester := "unknown"
+		if current, err := user.Current(); err == nil {
+			requester = current.Username
+		}
+		ban := &Ban{
+			Kind:      args[0],
+			Name:      args[1],
+			Cancel:    cancel,
+			Reason:    reason,
+			Requester: requester,
+			Since:     time.Now().UTC(),
+		}
+
+		conn := dialRedis()
+		defer conn.Close()
+		if err := SetBan(conn, ban); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println("Banned", ban.Kind, ban.Name)
+
+		if ban.Cancel {
+			if err := sendKills(banKills(ban, requester)); err != nil {
+				log.Fatal("Banned, but failed to send the kills: ", err)
+			}
+		}
+	},
+}
+
+var unbanCmd = &cobra.Command{
+	Use:   "unban " + banKindsUsage + " NAME",
+	Short: "Lift a ban",
+	Run: func(cmd *cobra.Command, args []string) {
+		checkBanArgs(args)
+
+		conn := dialRedis()
+		defer conn.Close()
+		if removed, err := RemoveBan(conn, args[0], args[1]); err != nil {
+			log.Fatal(err)
+		} else if !removed {
+			log.Fatal("No ban for ", args[0], " ", args[1])
+		}
+		fmt.Println("Lifted the ban on", args[0], args[1])
+	},
+}
+
+var bansCmd = &cobra.Command{
+	Use:   "bans",
+	Short: "List the bans in place",
+	Run: func(cmd *cobra.Command, args []string) {
+		conn := dialRedis()
+		defer conn.Close()
+		bans, err := ListBans(conn)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, ban := range bans {
+			mode := "wait"
+			if ban.Cancel {
+				mode = "cancel"
+			}
+			fmt.Printf("%s\t%s\t%s\tsince %s by %s\t%s\n",
+				ban.Kind, ban.Name, mode, ban.Since.Format(time.RFC3339), ban.Requester, ban.Reason)
+		}
+	},
+}
@@ -0,0 +1,370 @@
+/*
+ * Copyright (c) CERN 2016
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/garyburd/redigo/redis"
+	"github.com/golang/protobuf/proto"
+	"gitlab.cern.ch/flutter/fts/messages"
+	"time"
+)
+
+// Redis keys holding the bans
+const (
+	// BansKey is a hash with the bans, by kind and name
+	BansKey = "fts-schedd-bans"
+	// ParkedKey is a hash with the serialized batches of banned users, by id
+	ParkedKey = "fts-schedd-parked"
+)
+
+// Kinds of ban
+const (
+	BanSource      = "source"
+	BanDestination = "destination"
+	BanStorage     = "storage"
+	BanVo          = "vo"
+	BanUser        = "user"
+)
+
+// BanKinds lists the valid kinds of ban
+var BanKinds = []string{BanSource, BanDestination, BanStorage, BanVo, BanUser}
+
+// Ban stops the transfers of a storage, as source, destination or both, of a VO, or of
+// a user. Users are identified by their credentials id, since batches do not carry the DN.
+type Ban struct {
+	Kind string `json:"kind"`
+	Name string `json:"name"`
+	// Cancel makes the scheduler cancel the transfers, instead of keeping them queued
+	Cancel    bool      `json:"cancel"`
+	Reason    string    `json:"reason"`
+	Requester string    `json:"requester"`
+	Since     time.Time `json:"since"`
+}
+
+// banField returns the field of the ban in BansKey
+func banField(kind, name string) string {
+	return kind + KeySeparator + name
+}
+
+// validBanKind returns true if the kind of ban is known
+func validBanKind(kind string) bool {
+	for _, k := range BanKinds {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// routeBans returns the fields of the bans that stop the given route
+func routeBans(route []string) []string {
+	switch len(route) {
+	// Destination storage
+	case 1:
+		return []string{banField(BanDestination, route[0]), banField(BanStorage, route[0])}
+	// Destination/Vo
+	case 2:
+		return []string{banField(BanVo, route[1])}
+	// Destination/Vo/Activity/Source
+	case 4:
+		return []string{banField(BanSource, route[3]), banField(BanStorage, route[3])}
+	}
+	return nil
+}
+
+// batchBans returns the fields of the bans that stop the batch
+func batchBans(batch *messages.Batch) []string {
+	return []string{
+		banField(BanSource, batch.SourceSe),
+		banField(BanStorage, batch.SourceSe),
+		banField(BanDestination, batch.DestSe),
+		banField(BanStorage, batch.DestSe),
+		banField(BanVo, batch.Vo),
+		banField(BanUser, batch.CredId),
+	}
+}
+
+// summaryBans returns the fields of the bans that stop a queued batch, from its summary
+func summaryBans(summary *QueuedBatch) []string {
+	fields := make([]string, 0, 6)
+	for i := range summary.Path {
+		fields = append(fields, routeBans(summary.Path[:i+1])...)
+	}
+	return append(fields, banField(BanUser, summary.CredID))
+}
+
+// getBan returns the first of the given bans in place, or nil if there is none
+func getBan(conn redis.Conn, fields []string) (*Ban, error) {
+	if len(fields) == 0 {
+		return nil, nil
+	}
+	args := make([]interface{}, 0, len(fields)+1)
+	args = append(args, BansKey)
+	for _, field := range fields {
+		args = append(args, field)
+	}
+	values, err := redis.ByteSlices(conn.Do("HMGET", args...))
+	if err != nil {
+		return nil, err
+	}
+	for _, value := range values {
+		if value != nil {
+			ban := &Ban{}
+			if err = json.Unmarshal(value, ban); err != nil {
+				return nil, err
+			}
+			return ban, nil
+		}
+	}
+	return nil, nil
+}
+
+// SetBan adds, or replaces, a ban
+func SetBan(conn redis.Conn, ban *Ban) error {
+	if !validBanKind(ban.Kind) {
+		return fmt.Errorf("Unknown kind of ban %s", ban.Kind)
+	}
+	data, err := json.Marshal(ban)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Do("HSET", BansKey, banField(ban.Kind, ban.Name), data)
+	return err
+}
+
+// RemoveBan lifts a ban, and returns false if there was none
+func RemoveBan(conn redis.Conn, kind, name string) (bool, error) {
+	return redis.Bool(conn.Do("HDEL", BansKey, banField(kind, name)))
+}
+
+// ListBans returns all the bans in place
+func ListBans(conn redis.Conn) ([]Ban, error) {
+	values, err := redis.ByteSlices(conn.Do("HVALS", BansKey))
+	if err != nil {
+		return nil, err
+	}
+	bans := make([]Ban, 0, len(values))
+	for _, value := range values {
+		ban := Ban{}
+		if err = json.Unmarshal(value, &ban); err != nil {
+			return nil, err
+		}
+		bans = append(bans, ban)
+	}
+	return bans, nil
+}
+
+// GetBatchBan returns the ban stopping the batch, or nil if there is none
+func (info *RedisScoreboard) GetBatchBan(batch *messages.Batch) (*Ban, error) {
+	conn := info.pool.Get()
+	defer conn.Close()
+	return getBan(conn, batchBans(batch))
+}
+
+// SetBan adds, or replaces, a ban
+func (info *RedisScoreboard) SetBan(ban *Ban) error {
+	conn := info.pool.Get()
+	defer conn.Close()
+	return SetBan(conn, ban)
+}
+
+// RemoveBan lifts a ban, and returns false if there was none
+func (info *RedisScoreboard) RemoveBan(kind, name string) (bool, error) {
+	conn := info.pool.Get()
+	defer conn.Close()
+	return RemoveBan(conn, kind, name)
+}
+
+// ListBans returns all the bans in place
+func (info *RedisScoreboard) ListBans() ([]Ban, error) {
+	conn := info.pool.Get()
+	defer conn.Close()
+	return ListBans(conn)
+}
+
+// Park keeps aside the batch of a banned user
+func (store *RedisStore) Park(id string, data []byte) error {
+	conn := store.pool.Get()
+	defer conn.Close()
+	_, err := conn.Do("HSET", ParkedKey, id, data)
+	return err
+}
+
+// ParkedBatch returns a parked batch, or nil if not parked
+func (store *RedisStore) ParkedBatch(id string) ([]byte, error) {
+	conn := store.pool.Get()
+	defer conn.Close()
+
+	data, err := redis.Bytes(conn.Do("HGET", ParkedKey, id))
+	if err == redis.ErrNil {
+		return nil, nil
+	}
+	return data, err
+}
+
+// Parked returns all the parked batches, by id
+func (store *RedisStore) Parked() (map[string][]byte, error) {
+	conn := store.pool.Get()
+	defer conn.Close()
+	return hashMap(conn, ParkedKey)
+}
+
+// Unpark hands a parked batch back over to the leader. Another scheduler may be
+// unparking the same batch, whoever removes it owns it.
+func (store *RedisStore) Unpark(id string, data []byte) (bool, error) {
+	conn := store.pool.Get()
+	defer conn.Close()
+
+	if removed, err := redis.Int(conn.Do("HDEL", ParkedKey, id)); err != nil || removed == 0 {
+		return false, err
+	}
+	// Not enqueued again, it is still tracked from the first time
+	_, err := conn.Do("RPUSH", InboxKey, data)
+	return err == nil, err
+}
+
+// rejectBanned cancels the batch if it is stopped by a ban that cancels, and returns true
+// if so. Batches stopped by any other ban are queued as usual, and stay there.
+func (s *Scheduler) rejectBanned(batch *messages.Batch) (bool, error) {
+	ban, err := s.scoreboard.GetBatchBan(batch)
+	if err != nil || ban == nil || !ban.Cancel {
+		return false, err
+	}
+	return true, s.reportCanceled(batch, fmt.Sprintf("Transfer canceled, %s %s is banned", ban.Kind, ban.Name))
+}
+
+// cancelBanned reports as canceled the transfers of a queued batch stopped by the ban,
+// unless they have expired or been canceled meanwhile
+func (s *Scheduler) cancelBanned(batch *messages.Batch, ban *Ban, now time.Time) error {
+	if ok, err := s.claimDeadline(batch, now); err != nil || !ok {
+		return err
+	}
+	if ok, err := s.claimQueued(batch); err != nil || !ok {
+		return err
+	}
+	return s.reportCanceled(batch, fmt.Sprintf("Transfer canceled, %s %s is banned", ban.Kind, ban.Name))
+}
+
+// holdBanned handles a batch leaving the queue that is stopped by a ban. Only those of
+// banned users get that far, since the queues of banned storages and VOs are skipped.
+// The batch is canceled if the ban says so, otherwise it is parked until the ban is lifted.
+// It returns false if the batch is not stopped by any ban.
+func (s *Scheduler) holdBanned(batch *messages.Batch, now time.Time) (bool, error) {
+	ban, err := s.scoreboard.GetBatchBan(batch)
+	if err != nil || ban == nil {
+		return false, err
+	}
+
+	if ban.Cancel {
+		return true, s.cancelBanned(batch, ban, now)
+	}
+
+	// Its deadline and transfers are still tracked, so it can expire or be canceled meanwhile
+	data, err := proto.Marshal(batch)
+	if err != nil {
+		return true, err
+	}
+	return true, s.store.Park(batch.GetID(), data)
+}
+
+// unparkBatches puts back into the queue the parked batches no longer banned, or banned
+// with cancellation, so they are canceled when they leave it. It returns how many.
+func (s *Scheduler) unparkBatches() (int, error) {
+	parked, err := s.store.Parked()
+	if err != nil {
+		return 0, err
+	}
+	unparked := 0
+	for id, data := range parked {
+		batch := &messages.Batch{}
+		if err = proto.Unmarshal(data, batch); err != nil {
+			log.WithError(err).WithField("batch", id).Error("Could not parse parked batch")
+			continue
+		}
+		if ban, err := s.scoreboard.GetBatchBan(batch); err != nil {
+			return unparked, err
+		} else if ban != nil && !ban.Cancel {
+			continue
+		}
+		if ok, err := s.store.Unpark(id, data); err != nil {
+			return unparked, err
+		} else if ok {
+			unparked++
+		}
+	}
+	return unparked, nil
+}
+
+// purgeBanned cancels the queued batches stopped by a ban that cancels, and asks the leader
+// to take them out of the queue, since the queues of banned storages and VOs are skipped.
+// The kills broadcast along the ban only get those already queued when they arrive.
+// It returns how many batches.
+func (s *Scheduler) purgeBanned(now time.Time) (int, error) {
+	bans, err := s.scoreboard.ListBans()
+	if err != nil {
+		return 0, err
+	}
+	canceling := make(map[string]Ban)
+	for _, ban := range bans {
+		if ban.Cancel {
+			canceling[banField(ban.Kind, ban.Name)] = ban
+		}
+	}
+	if len(canceling) == 0 {
+		return 0, nil
+	}
+
+	summaries, err := s.store.QueuedSummaries()
+	if err != nil {
+		return 0, err
+	}
+	db := s.store.QueueDb()
+	purged := 0
+	for id, data := range summaries {
+		summary := QueuedBatch{}
+		if err = json.Unmarshal(data, &summary); err != nil {
+			log.WithError(err).WithField("batch", id).Error("Could not parse the summary of the queued batch")
+			continue
+		}
+		var ban *Ban
+		for _, field := range summaryBans(&summary) {
+			if b, ok := canceling[field]; ok {
+				ban = &b
+				break
+			}
+		}
+		if ban == nil {
+			continue
+		}
+		batch := &messages.Batch{}
+		if err = db.Get(id, batch); err != nil {
+			// Left the queue meanwhile
+			continue
+		}
+		if err = s.cancelBanned(batch, ban, now); err != nil {
+			return purged, err
+		}
+		if err = s.store.Unqueue(id); err != nil {
+			return purged, err
+		}
+		purged++
+	}
+	return purged, nil
+}
@@ -0,0 +1,207 @@
+/*
+ * Copyright (c) CERN 2016
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"gitlab.cern.ch/flutter/fts/config"
+	"gitlab.cern.ch/flutter/fts/messages"
+	"strings"
+	"sync"
+	"time"
+)
+
+type (
+	// CoalesceParams configures the packing of small batches into bigger ones, so the
+	// workers can reuse the session for all their transfers
+	CoalesceParams struct {
+		// Files is the maximum number of transfers of a packed batch, 1 or less disables packing
+		Files int
+		// Bytes is the maximum size of a packed batch, 0 meaning no limit
+		Bytes uint64
+		// Wait is how long a batch waits for others to be packed with
+		Wait time.Duration
+	}
+
+	// acker is a received message, acknowledged once processed
+	acker interface {
+		Ack() error
+	}
+
+	// packed is a batch being packed, with the messages it comes from. They are
+	// acknowledged only once the batch is queued, so nothing is lost on a restart.
+	packed struct {
+		batch    *messages.Batch
+		messages []acker
+		bytes    uint64
+		since    time.Time
+	}
+
+	// coalescer holds the batches being packed, by link, VO, activity, credentials and priority
+	coalescer struct {
+		params  CoalesceParams
+		lock    sync.Mutex
+		pending map[string]*packed
+	}
+)
+
+// newCoalescer creates an empty coalescer
+func newCoalescer(params CoalesceParams) *coalescer {
+	return &coalescer{
+		params:  params,
+		pending: make(map[string]*packed),
+	}
+}
+
+// batchBytes returns the sum of the sizes of the transfers of the batch
+func batchBytes(batch *messages.Batch) uint64 {
+	var bytes uint64
+	for _, t := range batch.Transfers {
+		bytes += t.Filesize
+	}
+	return bytes
+}
+
+// coalesceKey returns the key of the batches that can be packed together
+func coalesceKey(batch *messages.Batch) string {
+	path := append(batch.GetPath(), batch.CredId, fmt.Sprint(batch.Priority))
+	return strings.Join(path, config.ScoreboardKeySeparator)
+}
+
+// enabled returns true if batches are packed at all, which needs a positive wait
+func (c *coalescer) enabled() bool {
+	return c.params.Files > 1 && c.params.Wait > 0
+}
+
+// full returns true if nothing else fits into the packed batch
+func (c *coalescer) full(p *packed) bool {
+	return len(p.batch.Transfers) >= c.params.Files || (c.params.Bytes > 0 && p.bytes >= c.params.Bytes)
+}
+
+// fits returns true if the batch can be added to the packed one without going over the limits
+func (c *coalescer) fits(p *packed, batch *messages.Batch) bool {
+	return len(p.batch.Transfers)+len(batch.Transfers) <= c.params.Files &&
+		(c.params.Bytes == 0 || p.bytes+batchBytes(batch) <= c.params.Bytes)
+}
+
+// Packable returns true if the batch is a small submission that can be packed with others
+func (c *coalescer) Packable(batch *messages.Batch) bool {
+	return c.enabled() && batch.State == messages.Batch_SUBMITTED &&
+		batch.Type == messages.Batch_SIMPLE && len(batch.Transfers) == 1 &&
+		(c.params.Bytes == 0 || batchBytes(batch) < c.params.Bytes)
+}
+
+// Add packs the batch with the pending one of its kind. It returns the packed batches
+// ready to be queued: the pending one, if the batch could not be added to it, and the
+// one holding the batch, if it is full.
+func (c *coalescer) Add(batch *messages.Batch, msg acker, now time.Time) []*packed {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	ready := make([]*packed, 0, 2)
+	key := coalesceKey(batch)
+
+	p, ok := c.pending[key]
+	if ok && (!c.fits(p, batch) || p.batch.Merge(batch) != nil) {
+		ready = append(ready, p)
+		ok = false
+	}
+	if ok {
+		p.messages = append(p.messages, msg)
+		p.bytes += batchBytes(batch)
+	} else {
+		p = &packed{
+			batch:    batch,
+			messages: []acker{msg},
+			bytes:    batchBytes(batch),
+			since:    now,
+		}
+		c.pending[key] = p
+	}
+
+	if c.full(p) {
+		ready = append(ready, p)
+		delete(c.pending, key)
+	}
+	return ready
+}
+
+// Expired removes and returns the packed batches that waited for long enough
+func (c *coalescer) Expired(now time.Time) []*packed {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	ready := make([]*packed, 0)
+	for key, p := range c.pending {
+		if now.Sub(p.since) >= c.params.Wait {
+			ready = append(ready, p)
+			delete(c.pending, key)
+		}
+	}
+	return ready
+}
+
+// Cancel removes the transfers matched by the kill from the pending batches, and returns
+// them with their messages, packed by the batch they come from
+func (c *coalescer) Cancel(kill *messages.Kill) []*packed {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	canceled := make([]*packed, 0)
+	for key, p := range c.pending {
+		selected := make(map[string]bool)
+		for _, id := range kill.Select(p.batch) {
+			selected[id] = true
+		}
+		if len(selected) == 0 {
+			continue
+		}
+		// Each message holds one of the transfers, in the same order
+		batch := *p.batch
+		matched := &packed{batch: &batch, messages: make([]acker, 0, len(selected)), since: p.since}
+		batch.Transfers = make([]*messages.Transfer, 0, len(selected))
+		transfers, msgs := p.batch.Transfers[:0], p.messages[:0]
+		for i, t := range p.batch.Transfers {
+			if selected[t.TransferId] {
+				batch.Transfers = append(batch.Transfers, t)
+				matched.messages = append(matched.messages, p.messages[i])
+				matched.bytes += t.Filesize
+			} else {
+				transfers = append(transfers, t)
+				msgs = append(msgs, p.messages[i])
+			}
+		}
+		p.batch.Transfers, p.messages = transfers, msgs
+		p.bytes -= matched.bytes
+		if len(transfers) == 0 {
+			delete(c.pending, key)
+		}
+		canceled = append(canceled, matched)
+	}
+	return canceled
+}
+
+// enqueuePacked queues the packed batch and acknowledges the messages it comes from
+func (s *Scheduler) enqueuePacked(p *packed) error {
+	if err := s.enqueue(p.batch); err != nil {
+		return err
+	}
+	for _, msg := range p.messages {
+		msg.Ack()
+	}
+	log.WithField("batch", p.batch.GetID()).Infof("Enqueued batch job packing %d transfers", len(p.batch.Transfers))
+	s.wake()
+	return nil
+}
@@ -24,8 +24,64 @@ import (
 	"gitlab.cern.ch/flutter/fts/config"
 	"gitlab.cern.ch/flutter/fts/messages"
 	"gitlab.cern.ch/flutter/stomp"
+	"time"
 )
 
+// handle processes a batch received by the consumer, unless packed with others: new
+// submissions are queued, and done batches release their slots, and are followed by the
+// next hop, the next source or a retry
+func (s *Scheduler) handle(batch *messages.Batch) error {
+	l := log.WithField("batch", batch.GetID())
+
+	switch batch.State {
+	case messages.Batch_SUBMITTED:
+		if rejected, err := s.rejectBanned(batch); err != nil {
+			return err
+		} else if rejected {
+			l.Info("Canceled batch job, banned")
+		} else {
+			if err = s.enqueue(batch); err != nil {
+				return err
+			}
+			l.Info("Enqueued batch job")
+			s.wake()
+		}
+	case messages.Batch_RUNNING:
+		// Sent by the worker when it starts the batch
+		if renewed, err := s.scoreboard.RenewBatch(batch); err != nil {
+			l.WithError(err).Warn("Failed to renew the lease")
+		} else if !renewed {
+			l.Warn("Running batch without a lease")
+		}
+	case messages.Batch_DONE:
+		if err := s.scoreboard.ReleaseSlot(batch); err != nil {
+			return err
+		}
+		l.Info("Batch job done, released slots")
+		s.wake()
+
+		if next := failoverBatch(batch); next != nil {
+			if err := s.submit(next); err != nil {
+				return err
+			}
+			l.WithField("next", next.GetID()).Info("Failing over to the source ", next.SourceSe)
+		} else if next := nextHopBatch(batch); next != nil {
+			if err := s.submit(next); err != nil {
+				return err
+			}
+			l.Infof("Hop done, next from %s to %s", next.SourceSe, next.DestSe)
+		} else if retry, delay := retryBatch(batch); retry != nil {
+			if err := s.scheduleRetry(retry, time.Now().Add(delay)); err != nil {
+				return err
+			}
+			l.WithField("retry", retry.GetID()).Infof("Retrying %d transfers in %v", len(retry.Transfers), delay)
+		}
+	default:
+		l.Debug("Ignoring batch with state ", batch.State)
+	}
+	return nil
+}
+
 // RunConsumer runs the scheduler consumer
 func (s *Scheduler) RunConsumer() error {
 	consumerID := fmt.Sprint("fts-scheduler-", uuid.NewV4().String())
@@ -40,6 +96,15 @@ func (s *Scheduler) RunConsumer() error {
 
 	log.Info("Consumer started")
 
+	// Packed batches are flushed when they have waited for long enough
+	packer := s.packer
+	var flush <-chan time.Time
+	if packer.enabled() {
+		ticker := time.NewTicker(s.params.Coalesce.Wait)
+		defer ticker.Stop()
+		flush = ticker.C
+	}
+
 	for {
 		select {
 		case msg, ok := <-taskChannel:
@@ -58,23 +123,66 @@ func (s *Scheduler) RunConsumer() error {
 				l.Debugf("Transfer %s", t.TransferId)
 			}
 
-			// We are only interested on SUBMITTED batches
-			switch batch.State {
-			case messages.Batch_SUBMITTED:
-				err = s.echelon.Enqueue(&batch)
-				if err != nil {
+			if packer.Packable(&batch) {
+				// Acknowledged once the packed batch is queued
+				if rejected, err := s.rejectBanned(&batch); err != nil {
 					return err
+				} else if !rejected {
+					for _, p := range packer.Add(&batch, &msg, time.Now()) {
+						if err = s.enqueuePacked(p); err != nil {
+							return err
+						}
+					}
+					continue
 				}
-				l.Info("Enqueued batch job")
-			case messages.Batch_DONE:
-				if err = s.scoreboard.ReleaseSlot(&batch); err != nil {
+				l.Info("Canceled batch job, banned")
+			} else if err = s.handle(&batch); err != nil {
+				return err
+			}
+			msg.Ack()
+		case now := <-flush:
+			for _, p := range packer.Expired(now) {
+				if err = s.enqueuePacked(p); err != nil {
 					return err
 				}
-				l.Info("Batch job done, released slots")
-			default:
-				l.Debug("Ignoring batch with state ", batch.State)
 			}
-			msg.Ack()
+		case error, ok := <-errorChannel:
+			if !ok {
+				return nil
+			}
+			log.WithError(error).Warn("Got an error from the subcription channel")
+		}
+	}
+}
+
+// RunMarkerConsumer renews the leases of the batches with transfers sending performance markers
+func (s *Scheduler) RunMarkerConsumer() error {
+	consumerID := fmt.Sprint("fts-scheduler-markers-", uuid.NewV4().String())
+	markerChannel, errorChannel, err := s.markerConsumer.Subscribe(
+		config.PerformanceTopic,
+		consumerID,
+		stomp.AckAuto,
+	)
+	if err != nil {
+		return err
+	}
+
+	log.Info("Marker consumer started")
+
+	for {
+		select {
+		case msg, ok := <-markerChannel:
+			if !ok {
+				return nil
+			}
+			marker := messages.PerformanceMarker{}
+			if err = proto.Unmarshal(msg.Body, &marker); err != nil {
+				log.WithError(err).Error("Could not parse performance marker")
+				continue
+			}
+			if _, err = s.scoreboard.RenewTransfer(marker.TransferId); err != nil {
+				log.WithError(err).WithField("transfer", marker.TransferId).Warn("Failed to renew the lease")
+			}
 		case error, ok := <-errorChannel:
 			if !ok {
 				return nil
@@ -0,0 +1,217 @@
+/*
+ * Copyright (c) CERN 2016
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"github.com/garyburd/redigo/redis"
+	"github.com/golang/protobuf/proto"
+	"gitlab.cern.ch/flutter/fts/config"
+	"gitlab.cern.ch/flutter/fts/messages"
+	"gitlab.cern.ch/flutter/stomp"
+	"syscall"
+	"time"
+)
+
+// Redis keys tracking the queued batches with a deadline
+const (
+	// DeadlinesKey is a sorted set with the id of the queued batches, scored by their deadline
+	DeadlinesKey = "fts-schedd-deadlines"
+	// DeadlineDataKey is a hash with the serialized queued batches, by id
+	DeadlineDataKey = "fts-schedd-deadline-data"
+)
+
+// Enqueue hands the batch over to the leader, through the inbox, tracking its transfers
+// and its deadline in the same transaction
+func (store *RedisStore) Enqueue(batch *messages.Batch) error {
+	queued, err := queuedFields(batch)
+	if err != nil {
+		return err
+	}
+	data, err := proto.Marshal(batch)
+	if err != nil {
+		return err
+	}
+	conn := store.pool.Get()
+	defer conn.Close()
+
+	conn.Send("MULTI")
+	if len(queued) > 0 {
+		args := make([]interface{}, 0, len(queued)*2+1)
+		args = append(args, QueuedKey)
+		queuedIn := make([]interface{}, 0, len(queued)*2+1)
+		queuedIn = append(queuedIn, QueuedInKey)
+		for id, data := range queued {
+			args = append(args, id, data)
+			queuedIn = append(queuedIn, id, batch.GetID())
+		}
+		conn.Send("HMSET", args...)
+		conn.Send("HMSET", queuedIn...)
+	}
+	if deadline := batch.GetDeadline(); !deadline.IsZero() {
+		conn.Send("ZADD", DeadlinesKey, deadline.Unix(), batch.GetID())
+		conn.Send("HSET", DeadlineDataKey, batch.GetID(), data)
+	}
+	conn.Send("RPUSH", InboxKey, data)
+	_, err = conn.Do("EXEC")
+	return err
+}
+
+// enqueue hands the batch over to the leader, to be put into the queue, tracking its
+// transfers, so they can be canceled, and its deadline if it has one
+func (s *Scheduler) enqueue(batch *messages.Batch) error {
+	return s.store.Enqueue(batch)
+}
+
+// ClaimDeadline stops tracking the deadline of the batch. Whoever removes the batch
+// from the set owns it.
+func (store *RedisStore) ClaimDeadline(id string) (bool, error) {
+	conn := store.pool.Get()
+	defer conn.Close()
+
+	removed, err := redis.Int(conn.Do("ZREM", DeadlinesKey, id))
+	if err != nil || removed == 0 {
+		return false, err
+	}
+	if _, err = conn.Do("HDEL", DeadlineDataKey, id); err != nil {
+		log.WithError(err).WithField("batch", id).Warn("Failed to forget the queued batch")
+	}
+	return true, nil
+}
+
+// claimDeadline stops tracking the deadline of a batch leaving the queue. It returns
+// false if the batch has expired, and must not run, even along an error.
+// A batch expired by the sweep is already reported, otherwise it is reported here.
+func (s *Scheduler) claimDeadline(batch *messages.Batch, now time.Time) (bool, error) {
+	deadline := batch.GetDeadline()
+	if deadline.IsZero() {
+		return true, nil
+	}
+
+	claimed, err := s.store.ClaimDeadline(batch.GetID())
+	if err != nil {
+		return !now.After(deadline), err
+	} else if !claimed {
+		return false, nil
+	}
+	if now.After(deadline) {
+		return false, s.expire(batch)
+	}
+	return true, nil
+}
+
+// expire reports the transfers of the batch as failed, because they did not leave
+// the queue on time. Those canceled meanwhile are left out.
+func (s *Scheduler) expire(batch *messages.Batch) error {
+	if ok, err := s.claimQueued(batch); err != nil || !ok {
+		return err
+	}
+	batch.State = messages.Batch_DONE
+	for _, t := range batch.Transfers {
+		t.State = messages.Transfer_FAILED
+		t.Info = &messages.TransferInfo{
+			Error: &messages.TransferError{
+				Scope:       messages.TransferError_AGENT,
+				Code:        int32(syscall.ETIMEDOUT),
+				Description: "Transfer expired while queued",
+				Recoverable: false,
+			},
+		}
+	}
+	data, err := proto.Marshal(batch)
+	if err != nil {
+		return err
+	}
+	log.WithField("batch", batch.GetID()).Warn("Batch expired while queued")
+	return s.producer.Send(config.TransferTopic, string(data), stomp.SendParams{Persistent: true})
+}
+
+// ClaimExpired stops tracking the batches past their deadline by now, and returns them
+func (store *RedisStore) ClaimExpired(now time.Time) ([][]byte, error) {
+	conn := store.pool.Get()
+	defer conn.Close()
+
+	ids, err := redis.Strings(conn.Do("ZRANGEBYSCORE", DeadlinesKey, "-inf", now.Unix()))
+	if err != nil {
+		return nil, err
+	}
+	expired := make([][]byte, 0, len(ids))
+	for _, id := range ids {
+		if removed, err := redis.Int(conn.Do("ZREM", DeadlinesKey, id)); err != nil {
+			return expired, err
+		} else if removed == 0 {
+			// Left the queue meanwhile
+			continue
+		}
+		data, err := redis.Bytes(conn.Do("HGET", DeadlineDataKey, id))
+		if err == redis.ErrNil {
+			continue
+		} else if err != nil {
+			return expired, err
+		}
+		if _, err = conn.Do("HDEL", DeadlineDataKey, id); err != nil {
+			return expired, err
+		}
+		expired = append(expired, data)
+	}
+	return expired, nil
+}
+
+// sweepDeadlines reports the queued batches past their deadline, and asks the leader to
+// take them out of the queue. Until then, they are discarded if they leave it.
+func (s *Scheduler) sweepDeadlines(now time.Time) error {
+	expired, err := s.store.ClaimExpired(now)
+	for _, data := range expired {
+		batch := &messages.Batch{}
+		if err := proto.Unmarshal(data, batch); err != nil {
+			log.WithError(err).Error("Could not parse expired batch")
+			continue
+		}
+		if err := s.expire(batch); err != nil {
+			return err
+		}
+		if err := s.store.Unqueue(batch.GetID()); err != nil {
+			return err
+		}
+	}
+	return err
+}
+
+// RunSweeper periodically reports the queued batches past their deadline, cancels those
+// stopped by a ban that cancels, and puts back into the queue those parked by a ban
+// since lifted
+func (s *Scheduler) RunSweeper() error {
+	log.Info("Queue sweeper started")
+	for {
+		time.Sleep(s.params.Sweep)
+		if err := s.sweepDeadlines(time.Now()); err != nil {
+			log.WithError(err).Error("Failed to sweep the expired batches")
+		}
+		if purged, err := s.purgeBanned(time.Now()); err != nil {
+			log.WithError(err).Error("Failed to cancel the banned batches")
+		} else if purged > 0 {
+			log.Infof("Canceled %d banned batches", purged)
+			s.wake()
+		}
+		if unparked, err := s.unparkBatches(); err != nil {
+			log.WithError(err).Error("Failed to unpark the batches")
+		} else if unparked > 0 {
+			log.Infof("Unparked %d batches", unparked)
+			s.wake()
+		}
+	}
+}
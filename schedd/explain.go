@@ -0,0 +1,286 @@
+/*
+ * Copyright (c) CERN 2016
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"github.com/golang/protobuf/proto"
+	"gitlab.cern.ch/flutter/fts/config"
+	"gitlab.cern.ch/flutter/fts/messages"
+	"strings"
+)
+
+// States of an explained batch
+const (
+	ExplainQueued = "queued"
+	ExplainParked = "parked"
+)
+
+type (
+	// SlotCheck is the state of a scoreboard key limiting a level of the route
+	SlotCheck struct {
+		Key     string `json:"key"`
+		Kind    string `json:"kind"`
+		Counter int    `json:"counter"`
+		// Max is the maximum set in Redis, if any
+		Max *int `json:"max"`
+		// Limit is the maximum in effect, after the static limits, 0 meaning none
+		Limit   int    `json:"limit"`
+		Breaker string `json:"breaker,omitempty"`
+		Full    bool   `json:"full"`
+	}
+
+	// LevelCheck tells if a level of the route can schedule, and why not
+	LevelCheck struct {
+		Level   string      `json:"level"`
+		Route   []string    `json:"route"`
+		Ban     *Ban        `json:"ban,omitempty"`
+		Paused  bool        `json:"paused"`
+		Slots   []SlotCheck `json:"slots"`
+		Blocked bool        `json:"blocked"`
+	}
+
+	// Explanation tells where a batch is, and what stops it from being scheduled
+	Explanation struct {
+		BatchID string   `json:"batch_id"`
+		JobIds  []string `json:"job_ids"`
+		Path    []string `json:"path"`
+		CredID  string   `json:"cred_id"`
+		State   string   `json:"state"`
+		// Position is the place of the batch within its own queue, starting by 1.
+		// Queues with the same parent take turns according to their shares.
+		Position    int `json:"position,omitempty"`
+		QueueLength int `json:"queue_length,omitempty"`
+		// Ban is a ban on the user, the VO or a storage of the batch
+		Ban    *Ban         `json:"ban,omitempty"`
+		Levels []LevelCheck `json:"levels"`
+		Reason string       `json:"reason"`
+	}
+)
+
+// checkSlot returns the state of a scoreboard key. The limit, and whether it is full,
+// are left to the slot script, as when scheduling.
+func (info *RedisScoreboard) checkSlot(conn redis.Conn, k slotKey) (SlotCheck, error) {
+	check := SlotCheck{Key: k.key, Kind: entryKind(k.key)}
+	values, err := redis.Values(conn.Do("HMGET", k.key, fieldCounter, fieldMax, fieldBreaker))
+	if err != nil {
+		return check, err
+	}
+	var max int
+	if _, err = redis.Scan(values, &check.Counter, &max, &check.Breaker); err != nil {
+		return check, err
+	}
+	if values[1] != nil {
+		check.Max = &max
+	}
+	check.Limit, check.Full, err = info.slotLimit(conn, k)
+	return check, err
+}
+
+// ExplainRoute goes through each level of the path, from the destination down to the
+// source, as IsThereAvailableSlots does when scheduling
+func (info *RedisScoreboard) ExplainRoute(path []string) ([]LevelCheck, error) {
+	conn := info.pool.Get()
+	defer conn.Close()
+
+	levels := make([]LevelCheck, 0, len(path))
+	for i := range path {
+		route := path[:i+1]
+		level := LevelCheck{Level: QueueLevels[i], Route: route, Slots: make([]SlotCheck, 0, 2)}
+		var err error
+		if level.Ban, err = getBan(conn, routeBans(route)); err != nil {
+			return nil, err
+		}
+		if level.Paused, err = isPaused(conn, route); err != nil {
+			return nil, err
+		}
+		level.Blocked = level.Ban != nil || level.Paused
+		for _, k := range routeKeys(route) {
+			check, err := info.checkSlot(conn, k)
+			if err != nil {
+				return nil, err
+			}
+			level.Slots = append(level.Slots, check)
+			level.Blocked = level.Blocked || check.Full
+		}
+		levels = append(levels, level)
+	}
+	return levels, nil
+}
+
+// describeSlot tells why a scoreboard key is full
+func describeSlot(check SlotCheck) string {
+	switch check.Breaker {
+	case config.BreakerOpen:
+		return fmt.Sprintf("the circuit breaker of %s %s is open", check.Kind, check.Key)
+	case config.BreakerProbe:
+		return fmt.Sprintf("the circuit breaker of %s %s only lets one transfer through", check.Kind, check.Key)
+	}
+	return fmt.Sprintf("%s %s is full, with %d running out of %d", check.Kind, check.Key, check.Counter, check.Limit)
+}
+
+// reason summarizes the explanation, with what blocks the batch first
+func (e *Explanation) reason() string {
+	if e.State == ExplainParked {
+		if e.Ban == nil {
+			return "Parked, the ban has been lifted and it is queued again by the next sweep"
+		}
+		return fmt.Sprintf("Parked while %s %s is banned", e.Ban.Kind, e.Ban.Name)
+	}
+	for _, level := range e.Levels {
+		if !level.Blocked {
+			continue
+		}
+		if level.Ban != nil {
+			return fmt.Sprintf("Blocked at the %s level, %s %s is banned", level.Level, level.Ban.Kind, level.Ban.Name)
+		}
+		if level.Paused {
+			return fmt.Sprintf("Blocked at the %s level, the queue %s is paused", level.Level, strings.Join(level.Route, KeySeparator))
+		}
+		for _, check := range level.Slots {
+			if check.Full {
+				return fmt.Sprintf("Blocked at the %s level, %s", level.Level, describeSlot(check))
+			}
+		}
+	}
+	if e.Ban != nil {
+		return fmt.Sprintf("Will be held when leaving the queue, %s %s is banned", e.Ban.Kind, e.Ban.Name)
+	}
+	if e.Position > 1 {
+		return fmt.Sprintf("Not blocked, %d batches ahead in its queue", e.Position-1)
+	}
+	return "Not blocked, next in its queue"
+}
+
+// explain fills in the explanation of a batch found in the queue or parked
+func (s *Scheduler) explain(e *Explanation) error {
+	var err error
+	e.Ban, err = s.scoreboard.GetBatchBan(&messages.Batch{
+		DestSe: e.Path[0], Vo: e.Path[1], SourceSe: e.Path[3], CredId: e.CredID,
+	})
+	if err != nil {
+		return err
+	}
+	if e.State == ExplainQueued {
+		if e.Position, e.QueueLength, err = s.store.QueuePosition(e.Path, e.BatchID); err != nil {
+			return err
+		}
+	}
+	if e.Levels, err = s.scoreboard.ExplainRoute(e.Path); err != nil {
+		return err
+	}
+	e.Reason = e.reason()
+	return nil
+}
+
+// queuedExplanation starts the explanation of a queued batch from its summary
+func queuedExplanation(id string, data []byte) (*Explanation, error) {
+	summary := QueuedBatch{}
+	if err := json.Unmarshal(data, &summary); err != nil {
+		return nil, err
+	}
+	if len(summary.Path) != len(QueueLevels) {
+		return nil, fmt.Errorf("Malformed summary of the queued batch %s", id)
+	}
+	return &Explanation{
+		BatchID: id, JobIds: summary.JobIds, Path: summary.Path, CredID: summary.CredID, State: ExplainQueued,
+	}, nil
+}
+
+// parkedExplanation starts the explanation of a parked batch
+func parkedExplanation(data []byte) (*Explanation, error) {
+	batch := &messages.Batch{}
+	if err := proto.Unmarshal(data, batch); err != nil {
+		return nil, err
+	}
+	return &Explanation{
+		BatchID: batch.GetID(), JobIds: batchJobs(batch), Path: batch.GetPath(), CredID: batch.CredId, State: ExplainParked,
+	}, nil
+}
+
+// containsJob returns true if the job is in the list
+func containsJob(jobs []string, job string) bool {
+	for _, j := range jobs {
+		if j == job {
+			return true
+		}
+	}
+	return false
+}
+
+// Explain tells why the batch with the given id, or the batches with transfers of the
+// given job, are not running yet. Only queued and parked batches are found.
+func (s *Scheduler) Explain(batchID, jobID string) ([]*Explanation, error) {
+	explanations := make([]*Explanation, 0, 1)
+
+	if batchID != "" {
+		if data, err := s.store.QueuedSummary(batchID); err != nil {
+			return nil, err
+		} else if data != nil {
+			e, err := queuedExplanation(batchID, data)
+			if err != nil {
+				return nil, err
+			}
+			explanations = append(explanations, e)
+		}
+		if data, err := s.store.ParkedBatch(batchID); err != nil {
+			return nil, err
+		} else if data != nil {
+			e, err := parkedExplanation(data)
+			if err != nil {
+				return nil, err
+			}
+			explanations = append(explanations, e)
+		}
+	} else if jobID != "" {
+		summaries, err := s.store.QueuedSummaries()
+		if err != nil {
+			return nil, err
+		}
+		for id, data := range summaries {
+			e, err := queuedExplanation(id, data)
+			if err != nil {
+				return nil, err
+			}
+			if containsJob(e.JobIds, jobID) {
+				explanations = append(explanations, e)
+			}
+		}
+		parked, err := s.store.Parked()
+		if err != nil {
+			return nil, err
+		}
+		for _, data := range parked {
+			e, err := parkedExplanation(data)
+			if err != nil {
+				return nil, err
+			}
+			if containsJob(e.JobIds, jobID) {
+				explanations = append(explanations, e)
+			}
+		}
+	}
+
+	for _, e := range explanations {
+		if err := s.explain(e); err != nil {
+			return nil, err
+		}
+	}
+	return explanations, nil
+}
@@ -0,0 +1,148 @@
+/*
+ * Copyright (c) CERN 2016
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"github.com/alicebob/miniredis/v2"
+	"gitlab.cern.ch/flutter/fts/config"
+	"strings"
+	"testing"
+)
+
+// findSlotCheck returns the state of the key among the levels, or nil if not there
+func findSlotCheck(levels []LevelCheck, key string) *SlotCheck {
+	for _, level := range levels {
+		for i := range level.Slots {
+			if level.Slots[i].Key == key {
+				return &level.Slots[i]
+			}
+		}
+	}
+	return nil
+}
+
+// Queued batches must be found by batch or job, with their place in the queue, and the
+// limit in effect of a full key, bound by the static limits.
+func TestExplain(t *testing.T) {
+	limits := config.Limits{
+		testSource: config.Limit{Storage: testSource, Fixed: 10},
+		testDest:   config.Limit{Storage: testDest, Fixed: 10},
+		testLink:   config.Limit{Source: testSource, Destination: testDest, Min: 1, Max: 3},
+	}
+	for _, backend := range newTestBackends(t, limits) {
+		s := newScheduler(backend.store, backend.scoreboard, &testSender{}, Params{Limits: limits, Leases: testLeases})
+		first, second := newTestBatch("atlas", "a"), newTestBatch("atlas", "b")
+		backend.store.TrackQueued(first, true)
+		backend.store.TrackQueued(second, true)
+
+		explanations, err := s.Explain(second.GetID(), "")
+		if err != nil || len(explanations) != 1 {
+			t.Fatal(backend.name, ": Expecting the batch to be explained, got ", explanations, err)
+		}
+		if e := explanations[0]; e.State != ExplainQueued || e.Position != 2 || e.QueueLength != 2 || len(e.Levels) != 4 {
+			t.Fatal(backend.name, ": Expecting the second batch of the queue, got ", e)
+		} else if e.Reason != "Not blocked, 1 batches ahead in its queue" {
+			t.Fatal(backend.name, ": Expecting the batch not to be blocked, got ", e.Reason)
+		}
+
+		// The link starts with the default slots, raised by the maximum up to the static limits
+		for i, id := range []string{"c", "d", "e"} {
+			if err := backend.scoreboard.ConsumeSlot(newTestBatch("atlas", id), ""); err != nil {
+				t.Fatal(backend.name, ": ", err)
+			}
+			if i == 0 {
+				backend.scoreboard.SetMax(testLink, 5)
+			}
+		}
+		if explanations, err = s.Explain("", "job-a"); err != nil || len(explanations) != 1 {
+			t.Fatal(backend.name, ": Expecting the batch of the job, got ", explanations, err)
+		}
+		e := explanations[0]
+		check := findSlotCheck(e.Levels, testLink)
+		if check == nil || check.Max == nil || *check.Max != 5 || check.Limit != 3 || !check.Full {
+			t.Fatal(backend.name, ": Expecting the link to be full, bound by the static limits, got ", check)
+		}
+		if !strings.HasPrefix(e.Reason, "Blocked at the source level, link ") || !strings.HasSuffix(e.Reason, "with 3 running out of 3") {
+			t.Fatal(backend.name, ": Expecting the link to block the batch, got ", e.Reason)
+		}
+
+		if explanations, err = s.Explain("unknown", ""); err != nil || len(explanations) != 0 {
+			t.Fatal(backend.name, ": Not expecting any explanation, got ", explanations, err)
+		}
+	}
+}
+
+// The limit explained must be the one the slot script enforces, even for circuit breakers.
+func TestRedisExplainBreakers(t *testing.T) {
+	server := miniredis.RunT(t)
+	_, scoreboard := NewRedisBackend(server.Addr(), Params{
+		Limits: config.Limits{testDest: config.Limit{Storage: testDest, Fixed: 10}},
+		Leases: testLeases,
+	})
+
+	server.HSet(testDest, fieldBreaker, config.BreakerProbe)
+	levels, err := scoreboard.ExplainRoute([]string{testDest})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if check := findSlotCheck(levels, testDest); check == nil || check.Limit != 1 || check.Full {
+		t.Fatal("Expecting a single probe, got ", check)
+	}
+
+	server.HSet(testDest, fieldBreaker, config.BreakerOpen)
+	if levels, err = scoreboard.ExplainRoute([]string{testDest}); err != nil {
+		t.Fatal(err)
+	}
+	if check := findSlotCheck(levels, testDest); check == nil || check.Limit != 10 || !check.Full || !levels[0].Blocked {
+		t.Fatal("Expecting the breaker to block the destination, got ", check)
+	}
+}
+
+// The reason must be what blocks the batch first, from the destination down.
+func TestExplanationReason(t *testing.T) {
+	ban := &Ban{Kind: BanVo, Name: "dteam"}
+	full := SlotCheck{Key: testLink, Kind: EntryLink, Counter: 3, Limit: 3, Full: true}
+	open := SlotCheck{Key: testDest, Kind: EntryStorage, Breaker: config.BreakerOpen, Full: true}
+	cases := []struct {
+		explanation Explanation
+		reason      string
+	}{
+		{Explanation{State: ExplainParked, Ban: &Ban{Kind: BanUser, Name: "credentials"}}, "Parked while user credentials is banned"},
+		{Explanation{State: ExplainParked}, "Parked, the ban has been lifted and it is queued again by the next sweep"},
+		{Explanation{State: ExplainQueued, Levels: []LevelCheck{
+			{Level: "destination", Slots: []SlotCheck{open}, Blocked: true},
+			{Level: "vo", Ban: ban, Blocked: true},
+		}}, "Blocked at the destination level, the circuit breaker of storage " + testDest + " is open"},
+		{Explanation{State: ExplainQueued, Levels: []LevelCheck{
+			{Level: "destination"},
+			{Level: "vo", Ban: ban, Blocked: true},
+		}}, "Blocked at the vo level, vo dteam is banned"},
+		{Explanation{State: ExplainQueued, Levels: []LevelCheck{
+			{Level: "activity", Route: []string{testDest, "atlas", "default"}, Paused: true, Blocked: true},
+		}}, "Blocked at the activity level, the queue " + testDest + "#atlas#default is paused"},
+		{Explanation{State: ExplainQueued, Levels: []LevelCheck{
+			{Level: "source", Slots: []SlotCheck{full}, Blocked: true},
+		}}, "Blocked at the source level, link " + testLink + " is full, with 3 running out of 3"},
+		{Explanation{State: ExplainQueued, Ban: &Ban{Kind: BanUser, Name: "credentials"}}, "Will be held when leaving the queue, user credentials is banned"},
+		{Explanation{State: ExplainQueued, Position: 1}, "Not blocked, next in its queue"},
+	}
+	for _, c := range cases {
+		if reason := c.explanation.reason(); reason != c.reason {
+			t.Fatal("Expecting ", c.reason, ", got ", reason)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+/*
+ * Copyright (c) CERN 2016
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"github.com/golang/protobuf/proto"
+	"gitlab.cern.ch/flutter/fts/messages"
+)
+
+// failsOver returns true if another source may succeed where the transfer failed: the
+// error is recoverable, or blamed on the source
+func failsOver(transferError *messages.TransferError) bool {
+	return transferError.GetRecoverable() || transferError.GetScope() == messages.TransferError_SOURCE
+}
+
+// failoverBatch returns a new submitted batch with the alternatives left on hold by a
+// multisource batch that failed, or nil if there is none, one of them succeeded, or the
+// failure would happen from any source.
+// It goes into the queue of the source of the first alternative.
+func failoverBatch(batch *messages.Batch) *messages.Batch {
+	if batch.Type != messages.Batch_MULTISOURCE {
+		return nil
+	}
+	alternatives := make([]*messages.Transfer, 0, len(batch.Transfers))
+	for _, t := range batch.Transfers {
+		switch t.State {
+		case messages.Transfer_FINISHED:
+			return nil
+		case messages.Transfer_FAILED:
+			if !failsOver(t.GetInfo().GetError()) {
+				return nil
+			}
+		case messages.Transfer_ON_HOLD:
+			alternative := proto.Clone(t).(*messages.Transfer)
+			alternative.State = messages.Transfer_SUBMITTED
+			alternative.Info = nil
+			alternatives = append(alternatives, alternative)
+		}
+	}
+	if len(alternatives) == 0 {
+		return nil
+	}
+
+	sourceSe := messages.GetStorage(alternatives[0].Source)
+	if sourceSe == "" {
+		sourceSe = batch.SourceSe
+	}
+	return &messages.Batch{
+		Submitted: batch.Submitted,
+		State:     messages.Batch_SUBMITTED,
+		Transfers: alternatives,
+		CredId:    batch.CredId,
+		SourceSe:  sourceSe,
+		DestSe:    batch.DestSe,
+		Vo:        batch.Vo,
+		Activity:  batch.Activity,
+		Priority:  batch.Priority,
+		Type:      batch.Type,
+	}
+}
@@ -0,0 +1,389 @@
+/*
+ * Copyright (c) CERN 2016
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/garyburd/redigo/redis"
+	"github.com/golang/protobuf/proto"
+	"github.com/satori/go.uuid"
+	"gitlab.cern.ch/flutter/fts/config"
+	"gitlab.cern.ch/flutter/fts/messages"
+	"gitlab.cern.ch/flutter/stomp"
+	"os"
+	"syscall"
+)
+
+// Redis keys tracking the queued transfers
+const (
+	// QueuedKey is a hash with the queued transfers, by id. Each one holds the batch to
+	// report when the transfer is canceled: the transfer alone for simple batches, or the
+	// whole batch otherwise, since all the transfers are alternatives or hops of the same file.
+	QueuedKey = "fts-schedd-queued"
+	// QueuedInKey is a hash with the id of the queued batch of each queued transfer
+	QueuedInKey = "fts-schedd-queued-in"
+)
+
+// queuedFields returns the fields and values to set into QueuedKey for the batch
+func queuedFields(batch *messages.Batch) (map[string][]byte, error) {
+	fields := make(map[string][]byte, len(batch.Transfers))
+	var whole []byte
+	for _, t := range batch.Transfers {
+		var data []byte
+		var err error
+		if batch.Type != messages.Batch_SIMPLE {
+			if whole == nil {
+				if whole, err = proto.Marshal(batch); err != nil {
+					return nil, err
+				}
+			}
+			data = whole
+		} else {
+			single := *batch
+			single.Transfers = []*messages.Transfer{t}
+			if data, err = proto.Marshal(&single); err != nil {
+				return nil, err
+			}
+		}
+		fields[t.TransferId] = data
+	}
+	return fields, nil
+}
+
+// ClaimTransfers stops tracking the transfers. Whoever removes a transfer from the hash owns it.
+func (store *RedisStore) ClaimTransfers(ids []string) ([]bool, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	conn := store.pool.Get()
+	defer conn.Close()
+
+	conn.Send("MULTI")
+	for _, id := range ids {
+		conn.Send("HDEL", QueuedKey, id)
+	}
+	conn.Send("HDEL", redis.Args{}.Add(QueuedInKey).AddFlat(ids)...)
+	removed, err := redis.Ints(conn.Do("EXEC"))
+	if err != nil {
+		return nil, err
+	}
+	claimed := make([]bool, len(ids))
+	for i := range ids {
+		claimed[i] = removed[i] > 0
+	}
+	return claimed, nil
+}
+
+// QueuedIn returns the id of the queued batch of each transfer, or an empty string for
+// those no longer queued
+func (store *RedisStore) QueuedIn(ids []string) ([]string, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	conn := store.pool.Get()
+	defer conn.Close()
+
+	values, err := redis.Values(conn.Do("HMGET", redis.Args{}.Add(QueuedInKey).AddFlat(ids)...))
+	if err != nil {
+		return nil, err
+	}
+	batches := make([]string, len(values))
+	for i, value := range values {
+		if value != nil {
+			batches[i], _ = redis.String(value, nil)
+		}
+	}
+	return batches, nil
+}
+
+// claimTransfers stops tracking the transfers of a batch leaving the queue, and removes
+// from the batch those claimed by someone else, because they have been canceled
+func (s *Scheduler) claimTransfers(batch *messages.Batch) error {
+	if len(batch.Transfers) == 0 {
+		return nil
+	}
+	ids := make([]string, 0, len(batch.Transfers))
+	for _, t := range batch.Transfers {
+		ids = append(ids, t.TransferId)
+	}
+	removed, err := s.store.ClaimTransfers(ids)
+	if err != nil {
+		return err
+	}
+	claimed := make([]*messages.Transfer, 0, len(batch.Transfers))
+	for i, t := range batch.Transfers {
+		if removed[i] {
+			claimed = append(claimed, t)
+		}
+	}
+	batch.Transfers = claimed
+	return nil
+}
+
+// claimQueued claims the transfers of a batch leaving the queue. It returns false if
+// all of them have been canceled meanwhile.
+func (s *Scheduler) claimQueued(batch *messages.Batch) (bool, error) {
+	if err := s.claimTransfers(batch); err != nil {
+		return true, err
+	}
+	return len(batch.Transfers) > 0, nil
+}
+
+// reportCanceled reports all the transfers of the batch as canceled
+func (s *Scheduler) reportCanceled(batch *messages.Batch, reason string) error {
+	batch.State = messages.Batch_DONE
+	for _, t := range batch.Transfers {
+		t.State = messages.Transfer_CANCELED
+		t.Info = &messages.TransferInfo{
+			Error: &messages.TransferError{
+				Scope:       messages.TransferError_AGENT,
+				Code:        int32(syscall.ECANCELED),
+				Description: reason,
+				Recoverable: false,
+			},
+		}
+	}
+	data, err := proto.Marshal(batch)
+	if err != nil {
+		return err
+	}
+	return s.producer.Send(config.TransferTopic, string(data), stomp.SendParams{Persistent: true})
+}
+
+// hashEntries goes through a hash without blocking Redis, and returns its fields and
+// values, alternating
+func hashEntries(conn redis.Conn, key string) ([][]byte, error) {
+	all := make([][]byte, 0)
+	cursor := 0
+	for {
+		reply, err := redis.Values(conn.Do("HSCAN", key, cursor, "COUNT", 1000))
+		if err != nil {
+			return nil, err
+		}
+		var entries [][]byte
+		if _, err = redis.Scan(reply, &cursor, &entries); err != nil {
+			return nil, err
+		}
+		all = append(all, entries...)
+		if cursor == 0 {
+			return all, nil
+		}
+	}
+}
+
+// hashMap goes through a hash without blocking Redis, and returns its values by field
+func hashMap(conn redis.Conn, key string) (map[string][]byte, error) {
+	entries, err := hashEntries(conn, key)
+	if err != nil {
+		return nil, err
+	}
+	values := make(map[string][]byte, len(entries)/2)
+	for i := 1; i < len(entries); i += 2 {
+		values[string(entries[i-1])] = entries[i]
+	}
+	return values, nil
+}
+
+// QueuedTransfers returns the batch tracked for the transfer, or those of all the
+// transfers if the id is empty
+func (store *RedisStore) QueuedTransfers(id string) ([][]byte, error) {
+	conn := store.pool.Get()
+	defer conn.Close()
+
+	if id != "" {
+		data, err := redis.Bytes(conn.Do("HGET", QueuedKey, id))
+		if err == redis.ErrNil {
+			return nil, nil
+		} else if err != nil {
+			return nil, err
+		}
+		return [][]byte{data}, nil
+	}
+
+	entries, err := hashEntries(conn, QueuedKey)
+	if err != nil {
+		return nil, err
+	}
+	batches := make([][]byte, 0, len(entries)/2)
+	for i := 1; i < len(entries); i += 2 {
+		batches = append(batches, entries[i])
+	}
+	return batches, nil
+}
+
+// batchIds returns the distinct ids of batches, leaving out the empty ones
+func batchIds(ids []string) []string {
+	distinct := make([]string, 0, 1)
+	seen := make(map[string]bool)
+	for _, id := range ids {
+		if id != "" && !seen[id] {
+			seen[id] = true
+			distinct = append(distinct, id)
+		}
+	}
+	return distinct
+}
+
+// cancel reports as canceled the transfers matched by the kill, waiting to be packed or
+// queued. The leader is asked to take the queued ones out of the queue; until then, they
+// are discarded if they leave it.
+// It returns the ids of the transfers canceled, even along an error.
+func (s *Scheduler) cancel(kill *messages.Kill) ([]string, error) {
+	canceled := make([]string, 0)
+	if kill.IsEmpty() {
+		return canceled, nil
+	}
+	for _, p := range s.packer.Cancel(kill) {
+		if err := s.reportCanceled(p.batch, "Transfer canceled while queued"); err != nil {
+			return canceled, err
+		}
+		for i, msg := range p.messages {
+			msg.Ack()
+			canceled = append(canceled, p.batch.Transfers[i].TransferId)
+		}
+	}
+
+	// Only a kill for a given transfer avoids going through all of them
+	candidates, err := s.store.QueuedTransfers(kill.TransferId)
+	if err != nil {
+		return canceled, err
+	}
+
+	for _, data := range candidates {
+		batch := &messages.Batch{}
+		if err = proto.Unmarshal(data, batch); err != nil {
+			log.WithError(err).Error("Could not parse queued transfer")
+			continue
+		}
+		selected := make(map[string]bool)
+		for _, id := range kill.Select(batch) {
+			selected[id] = true
+		}
+		matched := make([]*messages.Transfer, 0, len(selected))
+		for _, t := range batch.Transfers {
+			if selected[t.TransferId] {
+				matched = append(matched, t)
+			}
+		}
+		// Batches tracked once per transfer are only claimed the first time
+		batch.Transfers = matched
+		ids := make([]string, 0, len(matched))
+		for _, t := range matched {
+			ids = append(ids, t.TransferId)
+		}
+		queuedIn, err := s.store.QueuedIn(ids)
+		if err != nil {
+			return canceled, err
+		}
+		if err = s.claimTransfers(batch); err != nil {
+			return canceled, err
+		} else if len(batch.Transfers) == 0 {
+			continue
+		}
+		if err = s.store.Unqueue(batchIds(queuedIn)...); err != nil {
+			return canceled, err
+		}
+
+		if err = s.reportCanceled(batch, "Transfer canceled while queued"); err != nil {
+			return canceled, err
+		}
+		for _, t := range batch.Transfers {
+			canceled = append(canceled, t.TransferId)
+		}
+	}
+	return canceled, nil
+}
+
+// kill cancels the queued transfers matched by the kill, and returns what has been done
+func (s *Scheduler) kill(kill *messages.Kill) *messages.KillResult {
+	hostname, _ := os.Hostname()
+	l := log.WithField("kill", kill.String())
+	result := &messages.KillResult{
+		Kill:     kill,
+		Agent:    "fts-schedd",
+		Host:     hostname,
+		Received: messages.Now(),
+		Targets:  make([]*messages.KillResult_Target, 0),
+	}
+	canceled, err := s.cancel(kill)
+	if err != nil {
+		l.WithError(err).Error("Failed to cancel the queued transfers")
+	} else if len(canceled) > 0 {
+		l.Infof("Canceled %d queued transfers", len(canceled))
+	} else {
+		l.Debug("No queued transfer to cancel")
+	}
+	if len(canceled) > 0 || err != nil {
+		target := &messages.KillResult_Target{TransferIds: canceled}
+		if err != nil {
+			target.Error = err.Error()
+		}
+		result.Targets = append(result.Targets, target)
+	}
+	result.Finished = messages.Now()
+	return result
+}
+
+// sendKillResult reports what the scheduler did for a kill
+func (s *Scheduler) sendKillResult(result *messages.KillResult) error {
+	data, err := proto.Marshal(result)
+	if err != nil {
+		return err
+	}
+	return s.producer.Send(config.KillResultTopic, string(data), stomp.SendParams{Persistent: true})
+}
+
+// RunKillConsumer cancels the queued transfers on kill requests. Those already sent
+// to the workers are killed by them.
+func (s *Scheduler) RunKillConsumer() error {
+	consumerID := fmt.Sprint("fts-scheduler-kill-", uuid.NewV4().String())
+	killChannel, errorChannel, err := s.killConsumer.Subscribe(
+		config.KillTopic,
+		consumerID,
+		stomp.AckAuto,
+	)
+	if err != nil {
+		return err
+	}
+
+	log.Info("Kill consumer started")
+
+	for {
+		select {
+		case msg, ok := <-killChannel:
+			if !ok {
+				return nil
+			}
+			kill := messages.Kill{}
+			if err = proto.Unmarshal(msg.Body, &kill); err != nil {
+				log.WithError(err).Error("Malformed kill message")
+				continue
+			}
+			kill.EnsureID()
+			result := s.kill(&kill)
+			if err = s.sendKillResult(result); err != nil {
+				log.WithField("kill", kill.String()).WithError(err).Error("Failed to send the kill result")
+			}
+		case error, ok := <-errorChannel:
+			if !ok {
+				return nil
+			}
+			log.WithError(error).Warn("Got an error from the subcription channel")
+		}
+	}
+}
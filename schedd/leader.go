@@ -0,0 +1,231 @@
+/*
+ * Copyright (c) CERN 2016
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"errors"
+	log "github.com/Sirupsen/logrus"
+	"github.com/garyburd/redigo/redis"
+	"github.com/golang/protobuf/proto"
+	"gitlab.cern.ch/flutter/echelon"
+	"gitlab.cern.ch/flutter/fts/messages"
+	"time"
+)
+
+// Redis keys of the leader election
+const (
+	// LeaderKey holds the token of the scheduler running the producer, and expires
+	// unless renewed
+	LeaderKey = "fts-schedd-leader"
+	// EpochKey counts the leaderships, so every token is new
+	EpochKey = "fts-schedd-epoch"
+	// InboxKey is a list with the serialized batches waiting for the leader to queue them
+	InboxKey = "fts-schedd-inbox"
+)
+
+// ErrFenced is returned when a scheduler that is no longer the leader tries to consume slots
+var ErrFenced = errors.New("Not the leader anymore")
+
+// ElectionParams configures the leader election
+type ElectionParams struct {
+	// TTL is how long the leadership lasts unless renewed
+	TTL time.Duration
+	// Interval between renewals, and attempts to take over for the standbys
+	Interval time.Duration
+}
+
+// electScript renews the leadership of the holder of the token in ARGV[1], or takes it
+// if there is no leader, for ARGV[3] milliseconds. The token is made of a new epoch
+// and the id of the scheduler in ARGV[2]. It returns the token, or an empty string if
+// someone else is the leader.
+var electScript = redis.NewScript(2, `
+local leaderKey, epochKey = KEYS[1], KEYS[2]
+local token, id, ttl = ARGV[1], ARGV[2], ARGV[3]
+local current = redis.call("GET", leaderKey)
+if current then
+	if current ~= token then
+		return ""
+	end
+	redis.call("PEXPIRE", leaderKey, ttl)
+	return token
+end
+token = redis.call("INCR", epochKey) .. "#" .. id
+redis.call("SET", leaderKey, token, "PX", ttl)
+return token
+`)
+
+// resignScript gives up the leadership, if still held by the token in ARGV[1]
+var resignScript = redis.NewScript(1, `
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+// Elect renews or takes the leadership, and returns the token, empty if not the leader
+func (store *RedisStore) Elect(token, id string, ttl time.Duration) (string, error) {
+	conn := store.pool.Get()
+	defer conn.Close()
+	return redis.String(electScript.Do(conn, LeaderKey, EpochKey, token, id, int64(ttl/time.Millisecond)))
+}
+
+// Resign gives up the leadership held with the token
+func (store *RedisStore) Resign(token string) error {
+	conn := store.pool.Get()
+	defer conn.Close()
+	_, err := resignScript.Do(conn, LeaderKey, token)
+	return err
+}
+
+// Leader returns the token of the current leader, or an empty string if there is none
+func (store *RedisStore) Leader() (string, error) {
+	conn := store.pool.Get()
+	defer conn.Close()
+
+	token, err := redis.String(conn.Do("GET", LeaderKey))
+	if err == redis.ErrNil {
+		return "", nil
+	}
+	return token, err
+}
+
+// NextInbox returns the first batch handed over to the leader, or nil if there is none
+func (store *RedisStore) NextInbox() ([]byte, error) {
+	conn := store.pool.Get()
+	defer conn.Close()
+
+	data, err := redis.Bytes(conn.Do("LINDEX", InboxKey, 0))
+	if err == redis.ErrNil {
+		return nil, nil
+	}
+	return data, err
+}
+
+// RemoveInbox removes the batch from the inbox, once queued
+func (store *RedisStore) RemoveInbox(data []byte) error {
+	conn := store.pool.Get()
+	defer conn.Close()
+	_, err := conn.Do("LREM", InboxKey, 1, data)
+	return err
+}
+
+// leadership returns the token while this scheduler is the leader. The leadership is
+// considered lost once it could have expired, even if Redis can not be reached.
+func (s *Scheduler) leadership() string {
+	s.leaderLock.Lock()
+	defer s.leaderLock.Unlock()
+	if s.token != "" && time.Now().After(s.tokenExpires) {
+		log.Warn("The leadership may have expired")
+		s.token = ""
+	}
+	return s.token
+}
+
+// setLeadership keeps the token, valid until the given time, and wakes the producer
+// if the leadership changed
+func (s *Scheduler) setLeadership(token string, expires time.Time) {
+	s.leaderLock.Lock()
+	changed := token != s.token
+	s.token = token
+	s.tokenExpires = expires
+	s.leaderLock.Unlock()
+
+	if changed {
+		if token != "" {
+			log.WithField("token", token).Info("Became the leader")
+		} else {
+			log.Warn("Lost the leadership")
+		}
+		s.wake()
+	}
+}
+
+// loseLeadership forgets the token, once fenced
+func (s *Scheduler) loseLeadership(token string) {
+	s.leaderLock.Lock()
+	defer s.leaderLock.Unlock()
+	if s.token == token {
+		s.token = ""
+	}
+}
+
+// RunElection renews the leadership, or takes over when the leader did not renew it
+// on time
+func (s *Scheduler) RunElection() error {
+	log.WithField("id", s.id).Info("Leader election started")
+	for {
+		start := time.Now()
+		token, err := s.store.Elect(s.leadership(), s.id, s.params.Election.TTL)
+		if err != nil {
+			log.WithError(err).Error("Failed to run the leader election")
+		} else {
+			s.setLeadership(token, start.Add(s.params.Election.TTL))
+		}
+		time.Sleep(s.params.Election.Interval)
+	}
+}
+
+// Resign gives up the leadership, so a standby takes over without waiting for it to expire
+func (s *Scheduler) Resign() {
+	token := s.leadership()
+	if token == "" {
+		return
+	}
+	s.loseLeadership(token)
+	if err := s.store.Resign(token); err != nil {
+		log.WithError(err).Warn("Failed to give up the leadership")
+	}
+}
+
+// lead loads the queue from the store for a new leadership, or drops it when not the leader.
+// The queue of a previous leadership may be stale, since others may have run the producer.
+func (s *Scheduler) lead(token string) error {
+	if s.echelon != nil {
+		s.echelon.Close()
+		s.echelon = nil
+	}
+	if token == "" {
+		return nil
+	}
+
+	var err error
+	if s.echelon, err = echelon.New(&messages.Batch{}, s.store.QueueDb(), s.scoreboard); err != nil {
+		return err
+	}
+	return s.echelon.Restore()
+}
+
+// drainInbox puts into the queue the batches handed over to the leader. Each one is only
+// removed from the inbox once queued, so a batch may be queued twice after a crash, or by
+// a stalled leader, but then only the first copy to leave the queue claims its transfers.
+func (s *Scheduler) drainInbox() error {
+	for {
+		data, err := s.store.NextInbox()
+		if err != nil || data == nil {
+			return err
+		}
+		batch := &messages.Batch{}
+		if err = proto.Unmarshal(data, batch); err != nil {
+			log.WithError(err).Error("Could not parse the batch from the inbox")
+		} else if err = s.push(batch); err != nil {
+			return err
+		}
+		if err = s.store.RemoveInbox(data); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,273 @@
+/*
+ * Copyright (c) CERN 2016
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	log "github.com/Sirupsen/logrus"
+	"github.com/garyburd/redigo/redis"
+	"gitlab.cern.ch/flutter/fts/messages"
+	"time"
+)
+
+// Redis keys holding the leases
+const (
+	// LeasesKey is a sorted set with the batch id of every lease, scored by its expiration
+	LeasesKey = "fts-schedd-leases"
+	// LeaseDataKey is a hash with the lease of every batch id
+	LeaseDataKey = "fts-schedd-lease-data"
+	// LeaseTransfersKey is a hash with the batch id of every transfer holding a lease
+	LeaseTransfersKey = "fts-schedd-lease-transfers"
+)
+
+type (
+	// LeaseParams configures the expiration of the leases
+	LeaseParams struct {
+		// Timeout is used for transfers without one of their own
+		Timeout time.Duration
+		// Grace is added to the timeout, to cover the time in the queue and the reporting
+		Grace time.Duration
+		// Interval between sweeps of the expired leases
+		Interval time.Duration
+	}
+
+	// lease is held by a batch for as long as it runs, and accounts its slots
+	lease struct {
+		id        string
+		Keys      []string `json:"keys"`
+		Transfers []string `json:"transfers"`
+		// fence is the token of the leader consuming the lease, if any
+		fence string
+		// Seconds the lease lasts when taken, or renewed by the batch
+		TTL int64 `json:"ttl"`
+		// Seconds the lease lasts when renewed by each transfer, if different from TTL
+		TransferTTL map[string]int64 `json:"transfer_ttl,omitempty"`
+	}
+)
+
+// newLease returns the lease for the batch. It lasts for the longest timeout of its
+// transfers, plus the grace period. The transfers run one after the other, and each
+// one renews the lease for its own timeout when it starts, and with its markers.
+func (p *LeaseParams) newLease(batch *messages.Batch, keys []slotKey) *lease {
+	l := &lease{
+		id:        batch.GetID(),
+		Keys:      make([]string, 0, len(keys)),
+		Transfers: make([]string, 0, len(batch.Transfers)),
+	}
+	for _, k := range keys {
+		l.Keys = append(l.Keys, k.key)
+	}
+	ttls := make(map[string]int64, len(batch.Transfers))
+	for _, t := range batch.Transfers {
+		l.Transfers = append(l.Transfers, t.TransferId)
+		timeout := p.Timeout
+		if seconds := t.GetParameters().GetTimeout().GetSeconds(); seconds > 0 {
+			timeout = time.Duration(seconds) * time.Second
+		}
+		ttls[t.TransferId] = int64((timeout + p.Grace) / time.Second)
+		if ttls[t.TransferId] > l.TTL {
+			l.TTL = ttls[t.TransferId]
+		}
+	}
+	for transfer, ttl := range ttls {
+		if ttl != l.TTL {
+			if l.TransferTTL == nil {
+				l.TransferTTL = make(map[string]int64)
+			}
+			l.TransferTTL[transfer] = ttl
+		}
+	}
+	return l
+}
+
+// expiration returns when the lease expires if renewed now by the transfer, or by the
+// batch if the transfer is empty
+func (l *lease) expiration(now time.Time, transfer string) int64 {
+	if ttl, ok := l.TransferTTL[transfer]; ok {
+		return now.Unix() + ttl
+	}
+	return now.Unix() + l.TTL
+}
+
+// encode serializes the lease for storing it in Redis
+func (l *lease) encode() (string, error) {
+	data, err := json.Marshal(l)
+	return string(data), err
+}
+
+// getLease returns the lease of the batch id, or nil if there is none
+func getLease(conn redis.Conn, id string) (*lease, error) {
+	data, err := redis.Bytes(conn.Do("HGET", LeaseDataKey, id))
+	if err == redis.ErrNil {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	l := &lease{id: id}
+	if err = json.Unmarshal(data, l); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// releaseLease frees the slots held by the lease of the batch id, if still there
+func (info *RedisScoreboard) releaseLease(conn redis.Conn, id string) error {
+	l, err := getLease(conn, id)
+	if err != nil || l == nil {
+		return err
+	}
+	keys := make([]slotKey, 0, len(l.Keys))
+	for _, key := range l.Keys {
+		keys = append(keys, slotKey{key: key})
+	}
+	_, err = info.runSlotScript(conn, slotRelease, l, keys)
+	return err
+}
+
+// renewLease pushes the expiration of the lease of the batch id, by the transfer if not
+// empty. It returns false if there is no such lease.
+func renewLease(conn redis.Conn, id, transfer string, now time.Time) (bool, error) {
+	l, err := getLease(conn, id)
+	if err != nil || l == nil {
+		return false, err
+	}
+	// XX so a lease released meanwhile is not brought back
+	_, err = conn.Do("ZADD", LeasesKey, "XX", l.expiration(now, transfer), id)
+	return err == nil, err
+}
+
+// RenewBatch renews the lease of a running batch
+func (info *RedisScoreboard) RenewBatch(batch *messages.Batch) (bool, error) {
+	conn := info.pool.Get()
+	defer conn.Close()
+	return renewLease(conn, batch.GetID(), "", time.Now())
+}
+
+// RenewTransfer renews the lease of the batch the transfer belongs to, for the timeout
+// of the transfer
+func (info *RedisScoreboard) RenewTransfer(transferID string) (bool, error) {
+	conn := info.pool.Get()
+	defer conn.Close()
+
+	id, err := redis.String(conn.Do("HGET", LeaseTransfersKey, transferID))
+	if err == redis.ErrNil {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return renewLease(conn, id, transferID, time.Now())
+}
+
+// ReapLeases releases the slots of the leases expired by now, and returns their batch ids
+func (info *RedisScoreboard) ReapLeases(now time.Time) ([]string, error) {
+	conn := info.pool.Get()
+	defer conn.Close()
+
+	expired, err := redis.Strings(conn.Do("ZRANGEBYSCORE", LeasesKey, "-inf", now.Unix()))
+	if err != nil {
+		return nil, err
+	}
+	for i, id := range expired {
+		if err = info.releaseLease(conn, id); err != nil {
+			return expired[:i], err
+		}
+	}
+	return expired, nil
+}
+
+// RunReaper periodically releases the slots of the expired leases, left behind by
+// batches that never reported back
+func (s *Scheduler) RunReaper() error {
+	log.Info("Lease reaper started")
+	for {
+		time.Sleep(s.params.Leases.Interval)
+		expired, err := s.scoreboard.ReapLeases(time.Now())
+		for _, id := range expired {
+			log.WithField("batch", id).Warn("Lease expired, released slots")
+		}
+		if len(expired) > 0 {
+			s.wake()
+		}
+		if err != nil {
+			log.WithError(err).Error("Failed to reap the expired leases")
+		}
+	}
+}
+
+// reconcileScript sets the counters of the given scoreboard hashes to the number
+// of live leases holding a slot on them
+var reconcileScript = redis.NewScript(-1, `
+local counterField, leaseDataKey = ARGV[1], ARGV[2]
+for _, key in ipairs(KEYS) do
+	redis.call("HSET", key, counterField, 0)
+end
+local leases = redis.call("HVALS", leaseDataKey)
+for _, data in ipairs(leases) do
+	for _, key in ipairs(cjson.decode(data).keys) do
+		redis.call("HINCRBY", key, counterField, 1)
+	end
+end
+return #leases
+`)
+
+// scoreboardKeys returns the keys of the scoreboard, which are every hash with a counter
+func scoreboardKeys(conn redis.Conn) ([]string, error) {
+	counters := make([]string, 0)
+	cursor := 0
+	for {
+		reply, err := redis.Values(conn.Do("SCAN", cursor, "COUNT", 1000))
+		if err != nil {
+			return nil, err
+		}
+		var keys []string
+		if _, err = redis.Scan(reply, &cursor, &keys); err != nil {
+			return nil, err
+		}
+		for _, key := range keys {
+			if hasCounter, err := redis.Bool(conn.Do("HEXISTS", key, fieldCounter)); err == nil && hasCounter {
+				counters = append(counters, key)
+			}
+		}
+		if cursor == 0 {
+			return counters, nil
+		}
+	}
+}
+
+// Reconcile rebuilds the counters of the scoreboard from the live leases, after
+// releasing the expired ones. It returns the number of live leases.
+func (info *RedisScoreboard) Reconcile(now time.Time) (int, error) {
+	if _, err := info.ReapLeases(now); err != nil {
+		return 0, err
+	}
+
+	conn := info.pool.Get()
+	defer conn.Close()
+
+	keys, err := scoreboardKeys(conn)
+	if err != nil {
+		return 0, err
+	}
+	counters := make([]interface{}, 0, len(keys))
+	for _, key := range keys {
+		counters = append(counters, key)
+	}
+
+	args := append([]interface{}{len(counters)}, counters...)
+	args = append(args, fieldCounter, LeaseDataKey)
+	return redis.Int(reconcileScript.Do(conn, args...))
+}
@@ -36,6 +36,58 @@ var scheddCmd = &cobra.Command{
 
 		hostname, _ := os.Hostname()
 
+		limits, err := config.GetLimits()
+		if err != nil {
+			log.Fatal(err)
+		}
+		shares, err := config.GetShares()
+		if err != nil {
+			log.Fatal(err)
+		}
+		election := ElectionParams{
+			TTL:      time.Duration(viper.Get("schedd.leader.ttl").(int)) * time.Second,
+			Interval: time.Duration(viper.Get("schedd.leader.interval").(int)) * time.Second,
+		}
+		if election.Interval <= 0 || election.Interval >= election.TTL {
+			log.Fatal("The leader interval must be positive, and shorter than the leader TTL")
+		}
+
+		params := Params{
+			Limits: limits,
+			Shares: shares,
+			Leases: LeaseParams{
+				Timeout:  time.Duration(viper.Get("schedd.lease.timeout").(int)) * time.Second,
+				Grace:    time.Duration(viper.Get("schedd.lease.grace").(int)) * time.Second,
+				Interval: time.Duration(viper.Get("schedd.lease.interval").(int)) * time.Second,
+			},
+			Coalesce: CoalesceParams{
+				Files: viper.Get("schedd.coalesce.files").(int),
+				Bytes: uint64(viper.Get("schedd.coalesce.bytes").(int)) * 1024 * 1024,
+				Wait:  time.Duration(viper.Get("schedd.coalesce.wait").(int)) * time.Millisecond,
+			},
+			MaxIdle: time.Duration(viper.Get("schedd.idle").(int)) * time.Second,
+			Backoff: time.Duration(viper.Get("schedd.backoff").(int)) * time.Millisecond,
+			Sweep:   time.Duration(viper.Get("schedd.sweep").(int)) * time.Second,
+
+			RetryInterval: time.Duration(viper.Get("schedd.retry.interval").(int)) * time.Second,
+			PriorityAging: time.Duration(viper.Get("schedd.priority.aging").(int)) * time.Second,
+			Admin:         viper.Get("schedd.admin").(string),
+			AdminToken:    viper.Get("schedd.admintoken").(string),
+			Election:      election,
+		}
+
+		var store Store
+		var scoreboard Scoreboard
+		switch backend := viper.Get("schedd.backend").(string); backend {
+		case BackendRedis:
+			store, scoreboard = NewRedisBackend(viper.Get("schedd.redis").(string), params)
+		case BackendMemory:
+			log.Warn("Keeping the state in memory, it is lost on exit, and can not be shared")
+			store, scoreboard = NewMemoryBackend(params)
+		default:
+			log.Fatal("Unknown backend ", backend)
+		}
+
 		sched, err := NewScheduler(stomp.ConnectionParameters{
 			ClientID: "fts-schedd-" + hostname,
 			Address:  viper.Get("stomp").(string),
@@ -55,7 +107,7 @@ var scheddCmd = &cobra.Command{
 					reconnectRetries = 0
 				}
 			},
-		}, viper.Get("schedd.redis").(string))
+		}, store, scoreboard, params)
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -70,8 +122,8 @@ var scheddCmd = &cobra.Command{
 // Entry point
 func main() {
 	// Config file
-	configFile := scheddCmd.Flags().String("Config", "", "Use configuration from this file")
-	scheddCmd.Flags().String("Redis", "localhost:6379", "Redis host and port")
+	configFile := scheddCmd.PersistentFlags().String("Config", "", "Use configuration from this file")
+	scheddCmd.PersistentFlags().String("Redis", "localhost:6379", "Redis host and port")
 
 	// Stomp flags
 	config.BindStompFlags(scheddCmd)
@@ -79,9 +131,49 @@ func main() {
 	// Specific flags
 	scheddCmd.Flags().String("Log", "", "Log file")
 	scheddCmd.Flags().Bool("Debug", true, "Enable debugging")
+	scheddCmd.Flags().Int("MaxIdle", 15, "Maximum number of seconds the producer waits without new batches or released slots")
+	scheddCmd.Flags().Int("Backoff", 500, "Milliseconds the producer waits when it runs out of slots")
+	scheddCmd.Flags().Int("SweepInterval", 60, "Number of seconds between sweeps of the expired batches")
+	scheddCmd.Flags().Int("RetryInterval", 5, "Number of seconds between checks for batches due for a retry")
+	scheddCmd.Flags().Int("PriorityAging", 600, "Number of seconds of waiting worth one level of priority")
+	scheddCmd.Flags().Int("LeaseTimeout", 3600, "Number of seconds a slot is held for transfers without a timeout")
+	scheddCmd.Flags().Int("LeaseGrace", 600, "Number of seconds added to the transfer timeout before a slot is reclaimed")
+	scheddCmd.Flags().Int("LeaseInterval", 60, "Number of seconds between sweeps of the expired slots")
+	scheddCmd.Flags().Int("CoalesceFiles", 1, "Maximum number of small transfers packed into one batch, 1 to disable")
+	scheddCmd.Flags().Int("CoalesceBytes", 100, "Maximum size in MB of a packed batch, 0 for no limit")
+	scheddCmd.Flags().Int("CoalesceWait", 2000, "Milliseconds a small transfer waits for others to be packed with")
+	scheddCmd.Flags().Int("LeaderTTL", 10, "Number of seconds the leader can go without renewing before a standby takes over")
+	scheddCmd.Flags().Int("LeaderInterval", 2, "Number of seconds between renewals of the leadership, or attempts to take over")
+	scheddCmd.Flags().String("Admin", "", "Address, as host:port, of the admin HTTP API, disabled if empty")
+	scheddCmd.Flags().String("AdminToken", "", "Bearer token required by the admin API to change anything, only allowed from localhost if empty")
+	scheddCmd.Flags().String("Backend", BackendRedis, "Where to keep the state of the scheduler, redis or memory")
 	viper.BindPFlag("schedd.log", scheddCmd.Flags().Lookup("Log"))
 	viper.BindPFlag("schedd.debug", scheddCmd.Flags().Lookup("Debug"))
-	viper.BindPFlag("schedd.redis", scheddCmd.Flags().Lookup("Redis"))
+	viper.BindPFlag("schedd.redis", scheddCmd.PersistentFlags().Lookup("Redis"))
+	viper.BindPFlag("schedd.idle", scheddCmd.Flags().Lookup("MaxIdle"))
+	viper.BindPFlag("schedd.backoff", scheddCmd.Flags().Lookup("Backoff"))
+	viper.BindPFlag("schedd.sweep", scheddCmd.Flags().Lookup("SweepInterval"))
+	viper.BindPFlag("schedd.retry.interval", scheddCmd.Flags().Lookup("RetryInterval"))
+	viper.BindPFlag("schedd.priority.aging", scheddCmd.Flags().Lookup("PriorityAging"))
+	viper.BindPFlag("schedd.lease.timeout", scheddCmd.Flags().Lookup("LeaseTimeout"))
+	viper.BindPFlag("schedd.lease.grace", scheddCmd.Flags().Lookup("LeaseGrace"))
+	viper.BindPFlag("schedd.lease.interval", scheddCmd.Flags().Lookup("LeaseInterval"))
+	viper.BindPFlag("schedd.coalesce.files", scheddCmd.Flags().Lookup("CoalesceFiles"))
+	viper.BindPFlag("schedd.coalesce.bytes", scheddCmd.Flags().Lookup("CoalesceBytes"))
+	viper.BindPFlag("schedd.coalesce.wait", scheddCmd.Flags().Lookup("CoalesceWait"))
+	viper.BindPFlag("schedd.leader.ttl", scheddCmd.Flags().Lookup("LeaderTTL"))
+	viper.BindPFlag("schedd.leader.interval", scheddCmd.Flags().Lookup("LeaderInterval"))
+	viper.BindPFlag("schedd.admin", scheddCmd.Flags().Lookup("Admin"))
+	viper.BindPFlag("schedd.admintoken", scheddCmd.Flags().Lookup("AdminToken"))
+	viper.BindPFlag("schedd.backend", scheddCmd.Flags().Lookup("Backend"))
+
+	// Subcommands
+	scheddCmd.AddCommand(reconcileCmd)
+	banCmd.Flags().Bool("Cancel", false, "Cancel the queued transfers, and kill those running, instead of keeping them")
+	banCmd.Flags().String("Reason", "", "Why the ban is in place")
+	scheddCmd.AddCommand(banCmd)
+	scheddCmd.AddCommand(unbanCmd)
+	scheddCmd.AddCommand(bansCmd)
 
 	cobra.OnInitialize(func() {
 		if *configFile != "" {
@@ -0,0 +1,529 @@
+/*
+ * Copyright (c) CERN 2016
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/golang/protobuf/proto"
+	"gitlab.cern.ch/flutter/echelon"
+	"gitlab.cern.ch/flutter/fts/messages"
+	"sync"
+	"time"
+)
+
+type (
+	// MemoryDb keeps the queue in memory. Only protocol buffers can be stored.
+	MemoryDb struct {
+		lock  sync.Mutex
+		items map[string][]byte
+	}
+
+	// MemoryStore keeps the state in memory, so it is lost on exit, and can not be shared
+	// with other schedulers
+	MemoryStore struct {
+		lock sync.Mutex
+		db   *MemoryDb
+
+		inbox        [][]byte
+		queued       map[string][]byte
+		queuedIn     map[string]string
+		deadlines    map[string]time.Time
+		deadlineData map[string][]byte
+		depths       map[string]int
+		summaries    map[string][]byte
+		queues       map[string]map[string]float64
+		unqueued     map[string]bool
+		parked       map[string][]byte
+		retries      map[string]time.Time
+		retryData    map[string][]byte
+
+		epoch         int
+		leader        string
+		leaderExpires time.Time
+	}
+)
+
+// NewMemoryDb creates an empty queue storage
+func NewMemoryDb() *MemoryDb {
+	return &MemoryDb{items: make(map[string][]byte)}
+}
+
+// Close does nothing, the items are kept for as long as the storage is referenced
+func (db *MemoryDb) Close() {
+}
+
+// Put stores the item under the key
+func (db *MemoryDb) Put(key string, item interface{}) error {
+	msg, ok := item.(proto.Message)
+	if !ok {
+		return fmt.Errorf("Can not store %T in memory", item)
+	}
+	data, err := proto.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	db.items[key] = data
+	return nil
+}
+
+// Get retrieves the item stored under the key
+func (db *MemoryDb) Get(key string, item interface{}) error {
+	msg, ok := item.(proto.Message)
+	if !ok {
+		return fmt.Errorf("Can not retrieve %T from memory", item)
+	}
+	db.lock.Lock()
+	data, ok := db.items[key]
+	db.lock.Unlock()
+	if !ok {
+		return fmt.Errorf("No item %s", key)
+	}
+	return proto.Unmarshal(data, msg)
+}
+
+// Delete removes the item stored under the key
+func (db *MemoryDb) Delete(key string) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	delete(db.items, key)
+	return nil
+}
+
+// Keys returns the keys of all the stored items
+func (db *MemoryDb) Keys() ([]string, error) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	keys := make([]string, 0, len(db.items))
+	for key := range db.items {
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// NewMemoryBackend returns an empty store and scoreboard kept in memory. The scheduler
+// is then alone, and always the leader.
+func NewMemoryBackend(params Params) (*MemoryStore, *MemoryScoreboard) {
+	store := &MemoryStore{
+		db:           NewMemoryDb(),
+		inbox:        make([][]byte, 0),
+		queued:       make(map[string][]byte),
+		queuedIn:     make(map[string]string),
+		deadlines:    make(map[string]time.Time),
+		deadlineData: make(map[string][]byte),
+		depths:       make(map[string]int),
+		summaries:    make(map[string][]byte),
+		queues:       make(map[string]map[string]float64),
+		unqueued:     make(map[string]bool),
+		parked:       make(map[string][]byte),
+		retries:      make(map[string]time.Time),
+		retryData:    make(map[string][]byte),
+	}
+	scoreboard := &MemoryScoreboard{
+		limits:    params.Limits,
+		shares:    params.Shares,
+		leases:    params.Leases,
+		store:     store,
+		counters:  make(map[string]int),
+		maxes:     make(map[string]int),
+		held:      make(map[string]*lease),
+		expires:   make(map[string]int64),
+		transfers: make(map[string]string),
+		bans:      make(map[string]Ban),
+		paused:    make(map[string]bool),
+	}
+	return store, scoreboard
+}
+
+// copyValues returns a copy of the map, so it can be used without holding the lock
+func copyValues(values map[string][]byte) map[string][]byte {
+	copied := make(map[string][]byte, len(values))
+	for key, value := range values {
+		copied[key] = value
+	}
+	return copied
+}
+
+// QueueDb returns the storage of the queue, the same for every leadership
+func (store *MemoryStore) QueueDb() echelon.StorageBackend {
+	return store.db
+}
+
+// Enqueue hands the batch over to the leader, tracking its transfers and its deadline
+func (store *MemoryStore) Enqueue(batch *messages.Batch) error {
+	queued, err := queuedFields(batch)
+	if err != nil {
+		return err
+	}
+	data, err := proto.Marshal(batch)
+	if err != nil {
+		return err
+	}
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	for id, transfer := range queued {
+		store.queued[id] = transfer
+		store.queuedIn[id] = batch.GetID()
+	}
+	if deadline := batch.GetDeadline(); !deadline.IsZero() {
+		store.deadlines[batch.GetID()] = deadline
+		store.deadlineData[batch.GetID()] = data
+	}
+	store.inbox = append(store.inbox, data)
+	return nil
+}
+
+// NextInbox returns the first batch handed over to the leader, or nil if there is none
+func (store *MemoryStore) NextInbox() ([]byte, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	if len(store.inbox) == 0 {
+		return nil, nil
+	}
+	return store.inbox[0], nil
+}
+
+// RemoveInbox removes the batch from the inbox, once queued
+func (store *MemoryStore) RemoveInbox(data []byte) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	for i := range store.inbox {
+		if bytes.Equal(store.inbox[i], data) {
+			store.inbox = append(store.inbox[:i], store.inbox[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+// TrackQueued counts the batch into the depth of its queue, and of the parents, and keeps
+// its place in the queue, or undoes all that if the batch is leaving it
+func (store *MemoryStore) TrackQueued(batch *messages.Batch, queued bool) error {
+	delta := -1
+	var summary []byte
+	if queued {
+		var err error
+		delta = 1
+		if summary, err = queuedSummary(batch); err != nil {
+			return err
+		}
+	}
+
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	for _, prefix := range pathPrefixes(batch) {
+		store.depths[prefix] += delta
+	}
+	key := queueKey(batch.GetPath())
+	if queued {
+		if store.queues[key] == nil {
+			store.queues[key] = make(map[string]float64)
+		}
+		store.queues[key][batch.GetID()] = queueScore(batch)
+		store.summaries[batch.GetID()] = summary
+	} else {
+		delete(store.queues[key], batch.GetID())
+		if len(store.queues[key]) == 0 {
+			delete(store.queues, key)
+		}
+		delete(store.summaries, batch.GetID())
+	}
+	return nil
+}
+
+// QueueDepths returns the number of queued batches for every non empty path prefix,
+// sorted by path
+func (store *MemoryStore) QueueDepths() ([]QueueDepth, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	return queueDepths(store.depths), nil
+}
+
+// QueuedSummary returns the summary of a queued batch, or nil if not queued
+func (store *MemoryStore) QueuedSummary(id string) ([]byte, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	return store.summaries[id], nil
+}
+
+// QueuedSummaries returns the summaries of all the queued batches, by id
+func (store *MemoryStore) QueuedSummaries() (map[string][]byte, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	return copyValues(store.summaries), nil
+}
+
+// QueuePosition returns the place of the batch in its queue, starting by 1, or 0 if not
+// there, and the length of the queue. Batches with the same score are sorted by id.
+func (store *MemoryStore) QueuePosition(path []string, id string) (int, int, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	scores := store.queues[queueKey(path)]
+	score, ok := scores[id]
+	if !ok {
+		return 0, len(scores), nil
+	}
+	position := 1
+	for other, otherScore := range scores {
+		if otherScore < score || (otherScore == score && other < id) {
+			position++
+		}
+	}
+	return position, len(scores), nil
+}
+
+// Unqueue asks the leader to take the batches out of the queue
+func (store *MemoryStore) Unqueue(ids ...string) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	for _, id := range ids {
+		store.unqueued[id] = true
+	}
+	return nil
+}
+
+// Unqueued returns the ids of the batches to take out of the queue
+func (store *MemoryStore) Unqueued() ([]string, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	ids := make([]string, 0, len(store.unqueued))
+	for id := range store.unqueued {
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// ForgetUnqueued drops the ids of batches taken out of the queue
+func (store *MemoryStore) ForgetUnqueued(ids []string) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	for _, id := range ids {
+		delete(store.unqueued, id)
+	}
+	return nil
+}
+
+// ClaimDeadline stops tracking the deadline of the batch
+func (store *MemoryStore) ClaimDeadline(id string) (bool, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	if _, ok := store.deadlines[id]; !ok {
+		return false, nil
+	}
+	delete(store.deadlines, id)
+	delete(store.deadlineData, id)
+	return true, nil
+}
+
+// ClaimExpired stops tracking the batches past their deadline by now, and returns them
+func (store *MemoryStore) ClaimExpired(now time.Time) ([][]byte, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	expired := make([][]byte, 0)
+	for id, deadline := range store.deadlines {
+		if deadline.Unix() > now.Unix() {
+			continue
+		}
+		if data, ok := store.deadlineData[id]; ok {
+			expired = append(expired, data)
+		}
+		delete(store.deadlines, id)
+		delete(store.deadlineData, id)
+	}
+	return expired, nil
+}
+
+// ClaimTransfers stops tracking the transfers, and tells which ones were claimed
+func (store *MemoryStore) ClaimTransfers(ids []string) ([]bool, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	claimed := make([]bool, len(ids))
+	for i, id := range ids {
+		_, claimed[i] = store.queued[id]
+		delete(store.queued, id)
+		delete(store.queuedIn, id)
+	}
+	return claimed, nil
+}
+
+// QueuedIn returns the id of the queued batch of each transfer, or an empty string for
+// those no longer queued
+func (store *MemoryStore) QueuedIn(ids []string) ([]string, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	batches := make([]string, len(ids))
+	for i, id := range ids {
+		batches[i] = store.queuedIn[id]
+	}
+	return batches, nil
+}
+
+// QueuedTransfers returns the batch tracked for the transfer, or those of all the
+// transfers if the id is empty
+func (store *MemoryStore) QueuedTransfers(id string) ([][]byte, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	if id != "" {
+		if data, ok := store.queued[id]; ok {
+			return [][]byte{data}, nil
+		}
+		return nil, nil
+	}
+	batches := make([][]byte, 0, len(store.queued))
+	for _, data := range store.queued {
+		batches = append(batches, data)
+	}
+	return batches, nil
+}
+
+// Park keeps aside the batch of a banned user
+func (store *MemoryStore) Park(id string, data []byte) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	store.parked[id] = data
+	return nil
+}
+
+// ParkedBatch returns a parked batch, or nil if not parked
+func (store *MemoryStore) ParkedBatch(id string) ([]byte, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	return store.parked[id], nil
+}
+
+// Parked returns all the parked batches, by id
+func (store *MemoryStore) Parked() (map[string][]byte, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	return copyValues(store.parked), nil
+}
+
+// Unpark hands a parked batch back over to the leader
+func (store *MemoryStore) Unpark(id string, data []byte) (bool, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	if _, ok := store.parked[id]; !ok {
+		return false, nil
+	}
+	delete(store.parked, id)
+	store.inbox = append(store.inbox, data)
+	return true, nil
+}
+
+// ScheduleRetry keeps the batch until it is due for a retry
+func (store *MemoryStore) ScheduleRetry(id string, data []byte, due time.Time) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	store.retries[id] = due
+	store.retryData[id] = data
+	return nil
+}
+
+// ClaimRetries claims the batches due for a retry by now, due again at until, and returns them by id
+func (store *MemoryStore) ClaimRetries(now, until time.Time) (map[string][]byte, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	due := make(map[string][]byte)
+	for id, when := range store.retries {
+		if when.Unix() > now.Unix() {
+			continue
+		}
+		if data, ok := store.retryData[id]; ok {
+			store.retries[id] = until
+			due[id] = data
+		} else {
+			delete(store.retries, id)
+		}
+	}
+	return due, nil
+}
+
+// RetryLater puts back a claimed batch, due again at the given time
+func (store *MemoryStore) RetryLater(id string, due time.Time) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	store.retries[id] = due
+	return nil
+}
+
+// ForgetRetry drops a claimed batch, once resubmitted
+func (store *MemoryStore) ForgetRetry(id string) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	delete(store.retries, id)
+	delete(store.retryData, id)
+	return nil
+}
+
+// currentLeader returns the token of the leader, unless expired. The lock must be held.
+func (store *MemoryStore) currentLeader(now time.Time) string {
+	if store.leader != "" && !now.Before(store.leaderExpires) {
+		store.leader = ""
+	}
+	return store.leader
+}
+
+// Elect renews or takes the leadership, and returns the token, empty if not the leader
+func (store *MemoryStore) Elect(token, id string, ttl time.Duration) (string, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	now := time.Now()
+	if current := store.currentLeader(now); current != "" {
+		if current != token {
+			return "", nil
+		}
+		store.leaderExpires = now.Add(ttl)
+		return token, nil
+	}
+	store.epoch++
+	store.leader = fmt.Sprintf("%d#%s", store.epoch, id)
+	store.leaderExpires = now.Add(ttl)
+	return store.leader, nil
+}
+
+// Resign gives up the leadership held with the token
+func (store *MemoryStore) Resign(token string) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	if store.leader == token {
+		store.leader = ""
+	}
+	return nil
+}
+
+// Leader returns the token of the current leader, or an empty string if there is none
+func (store *MemoryStore) Leader() (string, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	return store.currentLeader(time.Now()), nil
+}
+
+// Close does nothing, the state is kept until exit
+func (store *MemoryStore) Close() error {
+	return nil
+}
@@ -0,0 +1,399 @@
+/*
+ * Copyright (c) CERN 2016
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"gitlab.cern.ch/flutter/fts/config"
+	"gitlab.cern.ch/flutter/fts/messages"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryScoreboard keeps the scoreboard in memory, following the same rules as the slot
+// script. There is no optimizer, so no streams nor circuit breakers, and the share tables
+// only come from the configuration.
+type MemoryScoreboard struct {
+	lock   sync.Mutex
+	limits config.Limits
+	shares config.Shares
+	leases LeaseParams
+	// store holds the leader, fencing the consumption of slots
+	store *MemoryStore
+
+	counters  map[string]int
+	maxes     map[string]int
+	held      map[string]*lease
+	expires   map[string]int64
+	transfers map[string]string
+	bans      map[string]Ban
+	paused    map[string]bool
+}
+
+// GetWeight returns the weight of the given route within its parent
+func (info *MemoryScoreboard) GetWeight(route []string) float32 {
+	kind, owner, ok := shareOwner(route)
+	if !ok {
+		return 1.0
+	}
+	for _, candidate := range []string{strings.ToLower(owner), config.ShareWildcard} {
+		if table, ok := info.shares[kind][candidate]; ok {
+			return table.Weight(route[len(route)-1])
+		}
+	}
+	return 1.0
+}
+
+// slotLimit returns the maximum in effect for the key, 0 meaning none, as the slot script
+// computes it for Redis. There are no breakers without the optimizer.
+func (info *MemoryScoreboard) slotLimit(k slotKey, max int) int {
+	if max == 0 {
+		if k.optional {
+			max = info.limits.Cap(k.key)
+		} else {
+			max = info.limits.Initial(k.key)
+		}
+	}
+	lower, upper := info.limits.Range(k.key)
+	if lower > 0 && max < lower {
+		max = lower
+	}
+	if upper > 0 && max > upper {
+		max = upper
+	}
+	return max
+}
+
+// checkSlot returns the state of a scoreboard key. The lock must be held.
+func (info *MemoryScoreboard) checkSlot(k slotKey) SlotCheck {
+	check := SlotCheck{Key: k.key, Kind: entryKind(k.key), Counter: info.counters[k.key]}
+	max, ok := info.maxes[k.key]
+	if ok {
+		check.Max = &max
+	}
+	check.Limit = info.slotLimit(k, max)
+	check.Full = check.Limit > 0 && check.Counter >= check.Limit
+	return check
+}
+
+// firstFull returns the first key without slots, or an empty string. The lock must be held.
+func (info *MemoryScoreboard) firstFull(keys []slotKey) string {
+	for _, k := range keys {
+		if info.checkSlot(k).Full {
+			return k.key
+		}
+	}
+	return ""
+}
+
+// firstBan returns the first of the given bans in place, or nil. The lock must be held.
+func (info *MemoryScoreboard) firstBan(fields []string) *Ban {
+	for _, field := range fields {
+		if ban, ok := info.bans[field]; ok {
+			return &ban
+		}
+	}
+	return nil
+}
+
+// IsThereAvailableSlots returns true if there can be a new transfer for the given route,
+// which must not be banned nor paused
+func (info *MemoryScoreboard) IsThereAvailableSlots(route []string) (bool, error) {
+	keys := routeKeys(route)
+	if len(keys) == 0 {
+		return true, nil
+	}
+
+	info.lock.Lock()
+	defer info.lock.Unlock()
+	if info.firstBan(routeBans(route)) != nil || info.paused[strings.Join(route, KeySeparator)] {
+		return false, nil
+	}
+	return info.firstFull(keys) == "", nil
+}
+
+// GetStreams always returns 0, there is no optimizer deciding them
+func (info *MemoryScoreboard) GetStreams(source, destination string) (uint32, error) {
+	return 0, nil
+}
+
+// ConsumeSlot takes the slots of the batch, unless any of its keys is full, or it already
+// holds a lease. Unless empty, the token must be that of the current leader.
+func (info *MemoryScoreboard) ConsumeSlot(batch *messages.Batch, token string) error {
+	if token != "" {
+		if leader, err := info.store.Leader(); err != nil {
+			return err
+		} else if leader != token {
+			return ErrFenced
+		}
+	}
+
+	info.lock.Lock()
+	defer info.lock.Unlock()
+
+	keys := batchKeys(batch)
+	if full := info.firstFull(keys); full != "" {
+		return &ErrNoSlots{Key: full}
+	}
+	if _, ok := info.held[batch.GetID()]; ok {
+		return nil
+	}
+	l := info.leases.newLease(batch, keys)
+	for _, key := range l.Keys {
+		info.counters[key]++
+	}
+	info.held[l.id] = l
+	info.expires[l.id] = l.expiration(time.Now(), "")
+	for _, transfer := range l.Transfers {
+		info.transfers[transfer] = l.id
+	}
+	return nil
+}
+
+// release frees the slots held by the lease of the batch id, if still there.
+// The lock must be held.
+func (info *MemoryScoreboard) release(id string) {
+	l, ok := info.held[id]
+	if !ok {
+		return
+	}
+	delete(info.held, id)
+	delete(info.expires, id)
+	for _, transfer := range l.Transfers {
+		delete(info.transfers, transfer)
+	}
+	for _, key := range l.Keys {
+		if info.counters[key] > 0 {
+			info.counters[key]--
+		}
+	}
+}
+
+// ReleaseSlot gives back the slots of the batch, if it still holds a lease
+func (info *MemoryScoreboard) ReleaseSlot(batch *messages.Batch) error {
+	info.lock.Lock()
+	defer info.lock.Unlock()
+	info.release(batch.GetID())
+	return nil
+}
+
+// renew pushes the expiration of the lease of the batch id, by the transfer if not empty,
+// and returns false if there is none. The lock must be held.
+func (info *MemoryScoreboard) renew(id, transfer string, now time.Time) bool {
+	l, ok := info.held[id]
+	if ok {
+		info.expires[id] = l.expiration(now, transfer)
+	}
+	return ok
+}
+
+// RenewBatch renews the lease of a running batch
+func (info *MemoryScoreboard) RenewBatch(batch *messages.Batch) (bool, error) {
+	info.lock.Lock()
+	defer info.lock.Unlock()
+	return info.renew(batch.GetID(), "", time.Now()), nil
+}
+
+// RenewTransfer renews the lease of the batch the transfer belongs to
+func (info *MemoryScoreboard) RenewTransfer(transferID string) (bool, error) {
+	info.lock.Lock()
+	defer info.lock.Unlock()
+	id, ok := info.transfers[transferID]
+	if !ok {
+		return false, nil
+	}
+	return info.renew(id, transferID, time.Now()), nil
+}
+
+// ReapLeases releases the slots of the leases expired by now, and returns their batch ids
+func (info *MemoryScoreboard) ReapLeases(now time.Time) ([]string, error) {
+	info.lock.Lock()
+	defer info.lock.Unlock()
+
+	expired := make([]string, 0)
+	for id, expiration := range info.expires {
+		if expiration <= now.Unix() {
+			expired = append(expired, id)
+		}
+	}
+	sort.Strings(expired)
+	for _, id := range expired {
+		info.release(id)
+	}
+	return expired, nil
+}
+
+// Reconcile rebuilds the counters from the live leases, after releasing the expired ones.
+// It returns the number of live leases.
+func (info *MemoryScoreboard) Reconcile(now time.Time) (int, error) {
+	if _, err := info.ReapLeases(now); err != nil {
+		return 0, err
+	}
+
+	info.lock.Lock()
+	defer info.lock.Unlock()
+	for key := range info.counters {
+		info.counters[key] = 0
+	}
+	for _, l := range info.held {
+		for _, key := range l.Keys {
+			info.counters[key]++
+		}
+	}
+	return len(info.held), nil
+}
+
+// GetBatchBan returns the ban stopping the batch, or nil if there is none
+func (info *MemoryScoreboard) GetBatchBan(batch *messages.Batch) (*Ban, error) {
+	info.lock.Lock()
+	defer info.lock.Unlock()
+	return info.firstBan(batchBans(batch)), nil
+}
+
+// SetBan adds, or replaces, a ban
+func (info *MemoryScoreboard) SetBan(ban *Ban) error {
+	if !validBanKind(ban.Kind) {
+		return fmt.Errorf("Unknown kind of ban %s", ban.Kind)
+	}
+	info.lock.Lock()
+	defer info.lock.Unlock()
+	info.bans[banField(ban.Kind, ban.Name)] = *ban
+	return nil
+}
+
+// RemoveBan lifts a ban, and returns false if there was none
+func (info *MemoryScoreboard) RemoveBan(kind, name string) (bool, error) {
+	info.lock.Lock()
+	defer info.lock.Unlock()
+	field := banField(kind, name)
+	_, ok := info.bans[field]
+	delete(info.bans, field)
+	return ok, nil
+}
+
+// ListBans returns all the bans in place, sorted by kind and name
+func (info *MemoryScoreboard) ListBans() ([]Ban, error) {
+	info.lock.Lock()
+	defer info.lock.Unlock()
+
+	fields := make([]string, 0, len(info.bans))
+	for field := range info.bans {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	bans := make([]Ban, 0, len(fields))
+	for _, field := range fields {
+		bans = append(bans, info.bans[field])
+	}
+	return bans, nil
+}
+
+// PauseQueue stops scheduling from the queue, and returns false if already paused
+func (info *MemoryScoreboard) PauseQueue(path []string) (bool, error) {
+	info.lock.Lock()
+	defer info.lock.Unlock()
+	key := strings.Join(path, KeySeparator)
+	if info.paused[key] {
+		return false, nil
+	}
+	info.paused[key] = true
+	return true, nil
+}
+
+// ResumeQueue resumes scheduling from the queue, and returns false if not paused
+func (info *MemoryScoreboard) ResumeQueue(path []string) (bool, error) {
+	info.lock.Lock()
+	defer info.lock.Unlock()
+	key := strings.Join(path, KeySeparator)
+	if !info.paused[key] {
+		return false, nil
+	}
+	delete(info.paused, key)
+	return true, nil
+}
+
+// ListPaused returns the paths of the paused queues
+func (info *MemoryScoreboard) ListPaused() ([][]string, error) {
+	info.lock.Lock()
+	defer info.lock.Unlock()
+	members := make([]string, 0, len(info.paused))
+	for key := range info.paused {
+		members = append(members, key)
+	}
+	return splitPaths(members), nil
+}
+
+// ExplainRoute goes through each level of the path, from the destination down to the
+// source, as IsThereAvailableSlots does when scheduling
+func (info *MemoryScoreboard) ExplainRoute(path []string) ([]LevelCheck, error) {
+	info.lock.Lock()
+	defer info.lock.Unlock()
+
+	levels := make([]LevelCheck, 0, len(path))
+	for i := range path {
+		route := path[:i+1]
+		level := LevelCheck{Level: QueueLevels[i], Route: route, Slots: make([]SlotCheck, 0, 2)}
+		level.Ban = info.firstBan(routeBans(route))
+		level.Paused = info.paused[strings.Join(route, KeySeparator)]
+		level.Blocked = level.Ban != nil || level.Paused
+		for _, k := range routeKeys(route) {
+			check := info.checkSlot(k)
+			level.Slots = append(level.Slots, check)
+			level.Blocked = level.Blocked || check.Full
+		}
+		levels = append(levels, level)
+	}
+	return levels, nil
+}
+
+// GetEntries returns the entries of the given kind, or all of them if empty, sorted by key.
+// As with Redis, only the keys that have been counted are entries.
+func (info *MemoryScoreboard) GetEntries(kind string) ([]ScoreboardEntry, error) {
+	info.lock.Lock()
+	defer info.lock.Unlock()
+
+	keys := make([]string, 0, len(info.counters))
+	for key := range info.counters {
+		if kind == "" || entryKind(key) == kind {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	entries := make([]ScoreboardEntry, 0, len(keys))
+	for _, key := range keys {
+		entry := ScoreboardEntry{Key: key, Kind: entryKind(key), Counter: info.counters[key]}
+		if max, ok := info.maxes[key]; ok {
+			entry.Max = &max
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// SetMax sets the maximum number of running transfers for a scoreboard key, and returns
+// ErrUnknownKey if the key is not in the scoreboard
+func (info *MemoryScoreboard) SetMax(key string, max int) error {
+	info.lock.Lock()
+	defer info.lock.Unlock()
+	if _, ok := info.counters[key]; !ok {
+		return ErrUnknownKey
+	}
+	info.maxes[key] = max
+	return nil
+}
@@ -0,0 +1,82 @@
+/*
+ * Copyright (c) CERN 2016
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"github.com/golang/protobuf/proto"
+	"gitlab.cern.ch/flutter/fts/messages"
+	"time"
+)
+
+// resetHops returns a copy of the multihop batch, submitted again for the link of the
+// given hop. The hops from that one on are reset, the previous ones are kept finished.
+func resetHops(batch *messages.Batch, from int) *messages.Batch {
+	next := proto.Clone(batch).(*messages.Batch)
+	next.State = messages.Batch_SUBMITTED
+	for _, hop := range next.Transfers[from:] {
+		hop.State = messages.Transfer_SUBMITTED
+		hop.Info = nil
+	}
+
+	hop := next.Transfers[from]
+	if sourceSe := messages.GetStorage(hop.Source); sourceSe != "" {
+		next.SourceSe = sourceSe
+	}
+	if destSe := messages.GetStorage(hop.Destination); destSe != "" {
+		next.DestSe = destSe
+	}
+	return next
+}
+
+// nextHopBatch returns the multihop batch submitted again for its next hop, if the
+// last one finished and there are more left on hold, or nil otherwise.
+// When a hop fails the worker fails the remaining ones, so there is nothing to do.
+func nextHopBatch(batch *messages.Batch) *messages.Batch {
+	if batch.Type != messages.Batch_MULTIHOP {
+		return nil
+	}
+	for i, hop := range batch.Transfers {
+		switch hop.State {
+		case messages.Transfer_FINISHED:
+			continue
+		case messages.Transfer_ON_HOLD:
+			return resetHops(batch, i)
+		}
+		return nil
+	}
+	return nil
+}
+
+// retryHops returns the multihop batch submitted again from the hop that failed, if
+// it can be retried, or nil otherwise
+func retryHops(batch *messages.Batch) (*messages.Batch, time.Duration) {
+	for i, hop := range batch.Transfers {
+		if hop.State == messages.Transfer_FINISHED {
+			continue
+		}
+		if hop.State != messages.Transfer_FAILED || !hop.GetInfo().GetError().GetRecoverable() {
+			return nil, 0
+		}
+		if hop.Retry >= hop.GetParameters().GetRetry() {
+			return nil, 0
+		}
+		retry := resetHops(batch, i)
+		retry.Transfers[i].Retry++
+		return retry, time.Duration(hop.GetParameters().GetRetryDelay().GetSeconds()) * time.Second
+	}
+	return nil, 0
+}
@@ -26,53 +26,158 @@ import (
 	"time"
 )
 
-// RunProducer runs the scheduler producer
-func (s *Scheduler) RunProducer() error {
+// stampStreams sets the number of streams decided by the optimizer on the transfers
+// that do not have one set by the user
+func (s *Scheduler) stampStreams(batch *messages.Batch) error {
+	streams, err := s.scoreboard.GetStreams(batch.SourceSe, batch.DestSe)
+	if err != nil || streams == 0 {
+		return err
+	}
+	for _, t := range batch.Transfers {
+		if t.Parameters == nil {
+			t.Parameters = &messages.TransferParameters{}
+		}
+		if t.Parameters.Nstreams == 0 {
+			t.Parameters.Nstreams = streams
+		}
+	}
+	return nil
+}
+
+// dispatch sends to the workers a batch that left the queue, after taking its slots,
+// unless held by a ban, expired or canceled meanwhile. It is handed back over to the
+// leader if it can not be sent.
+func (s *Scheduler) dispatch(batch *messages.Batch, token string) {
+	l := log.WithField("batch", batch.GetID())
+	if held, err := s.holdBanned(batch, time.Now()); err != nil {
+		l.WithError(err).Error("Failed to hold the banned batch")
+	} else if held {
+		l.Info("Held batch of a banned user")
+		return
+	}
+
+	ok, err := s.claimDeadline(batch, time.Now())
+	if err != nil {
+		l.WithError(err).Error("Failed to check the deadline of the batch")
+	}
+	if !ok {
+		l.Info("Discarded expired batch")
+		return
+	}
+	if ok, err = s.claimQueued(batch); err != nil {
+		l.WithError(err).Error("Failed to check for canceled transfers")
+	}
+	if !ok {
+		l.Info("Discarded canceled batch")
+		return
+	}
+
+	batch.State = messages.Batch_READY
+	if err := s.stampStreams(batch); err != nil {
+		l.WithError(err).Warn("Failed to get the number of streams for the link")
+	}
+
+	var data []byte
+	if data, err = proto.Marshal(batch); err != nil {
+		l.WithError(err).Error("Failed to marshal task")
+		return
+	}
+
 	sendParams := stomp.SendParams{Persistent: true, ContentType: "application/json"}
+	if err = s.scoreboard.ConsumeSlot(batch, token); err != nil {
+		if _, ok := err.(*ErrNoSlots); ok {
+			l.WithError(err).Info("Slots taken meanwhile")
+		} else if err == ErrFenced {
+			l.Warn("Another scheduler took over as leader")
+			s.loseLeadership(token)
+		} else {
+			l.WithError(err).Error("Failed to mark task as busy")
+		}
+	} else if err = s.producer.Send(config.TransferTopic, string(data), sendParams); err != nil {
+		l.WithError(err).Error("Failed to send the batch to que message queue")
+		if err := s.scoreboard.ReleaseSlot(batch); err != nil {
+			l.WithError(err).Error("Failed to release the slot")
+		}
+	}
 
-	log.Info("Producer started")
+	if err != nil {
+		l.Warn("Trying to requeue the batch")
+		if err = s.enqueue(batch); err != nil {
+			l.Panic(err)
+		}
+	} else {
+		for _, t := range batch.Transfers {
+			l.Info("Scheduled ", t.JobId, "/", t.TransferId)
+		}
+	}
+}
 
+// produce queues the batches handed over to the leader, and dispatches batches from the
+// queue until it runs dry, of batches or slots, or the leadership is lost. It returns
+// why it stopped: echelon.ErrEmpty, echelon.ErrNotEnoughSlots, ErrFenced or another error.
+func (s *Scheduler) produce(token string) error {
+	// The rest of the batches partially taken out of the queue go through the inbox
+	if err := s.removeUnqueued(token); err != nil {
+		log.WithError(err).Error("Failed to take the batches out of the queue")
+	}
+	if err := s.drainInbox(); err != nil {
+		log.WithError(err).Error("Failed to queue the batches from the inbox")
+	}
 	for {
-		var err error
+		// Stop as soon as the leadership is lost, even if not fenced yet
+		if s.leadership() != token {
+			return ErrFenced
+		}
 		batch := &messages.Batch{}
-		for err = s.echelon.Dequeue(batch); err == nil; err = s.echelon.Dequeue(batch) {
-			l := log.WithField("batch", batch.GetID())
-			batch.State = messages.Batch_READY
+		if err := s.pop(batch); err != nil {
+			return err
+		}
+		s.dispatch(batch, token)
+	}
+}
 
-			var data []byte
-			if data, err = proto.Marshal(batch); err != nil {
-				l.WithError(err).Error("Failed to marshal task")
-				continue
-			}
+// wait blocks until the producer is woken up, or for MaxIdle at most. After running out
+// of slots it waits for Backoff first; slots released meanwhile are not lost, since the
+// wake up stays pending.
+func (s *Scheduler) wait(backoff bool) {
+	if backoff {
+		time.Sleep(s.params.Backoff)
+	}
+	select {
+	case <-s.wakeup:
+	case <-time.After(s.params.MaxIdle):
+	}
+}
 
-			if err := s.scoreboard.ConsumeSlot(batch); err != nil {
-				l.WithError(err).Error("Failed to mark task as busy")
-			} else if err = s.producer.Send(config.TransferTopic, string(data), sendParams); err != nil {
-				l.WithError(err).Error("Failed to send the batch to que message queue")
-			}
+// RunProducer runs the scheduler producer, only while this scheduler is the leader
+func (s *Scheduler) RunProducer() error {
+	log.Info("Producer started")
 
-			if err != nil {
-				l.Warn("Trying to requeue the batch")
-				if err = s.echelon.Enqueue(batch); err != nil {
-					l.Panic(err)
-				}
-			} else {
-				for _, t := range batch.Transfers {
-					l.Info("Scheduled ", t.JobId, "/", t.TransferId)
-				}
+	var token string
+	for {
+		if current := s.leadership(); current != token {
+			token = current
+			if err := s.lead(token); err != nil {
+				return err
 			}
 		}
+		if token == "" {
+			s.wait(false)
+			continue
+		}
 
+		err := s.produce(token)
 		switch err {
 		case echelon.ErrEmpty:
-			log.Info("Empty queue")
+			log.Debug("Empty queue")
 		case echelon.ErrNotEnoughSlots:
-			log.Info("Run out of available slots")
+			log.Debug("Run out of available slots")
+		case ErrFenced:
+			log.Warn("Stopped producing, no longer the leader")
+			continue
 		default:
 			log.Error("Unexpected error: ", err)
 		}
-
-		// TODO: Make configurable the sleep interval
-		time.Sleep(15 * time.Second)
+		s.wait(err == echelon.ErrNotEnoughSlots)
 	}
 }
@@ -0,0 +1,380 @@
+/*
+ * Copyright (c) CERN 2016
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	log "github.com/Sirupsen/logrus"
+	"github.com/garyburd/redigo/redis"
+	"gitlab.cern.ch/flutter/fts/messages"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Redis keys describing the queues
+const (
+	// QueueDepthsKey is a hash with the number of queued batches, by path prefix
+	QueueDepthsKey = "fts-schedd-queue-depths"
+	// PausedKey is a set with the paths of the paused queues
+	PausedKey = "fts-schedd-paused"
+	// QueuedBatchesKey is a hash with a summary of the queued batches, by id
+	QueuedBatchesKey = "fts-schedd-queued-batches"
+	// QueuePrefix prefixes the path of each queue, for the sorted set with the ids of its
+	// batches, scored as they are ordered in the queue
+	QueuePrefix = "fts-schedd-queue#"
+	// UnqueuedKey is a set with the ids of the batches the leader must take out of the queue
+	UnqueuedKey = "fts-schedd-unqueued"
+)
+
+// QueueLevels names the levels of the path of a queue
+var QueueLevels = []string{"destination", "vo", "activity", "source"}
+
+type (
+	// QueueDepth is the number of batches queued under a path
+	QueueDepth struct {
+		Path  []string `json:"path"`
+		Level string   `json:"level"`
+		Depth int      `json:"depth"`
+	}
+
+	// QueuedBatch summarizes a queued batch, so it can be found by job and explained
+	QueuedBatch struct {
+		Path   []string `json:"path"`
+		JobIds []string `json:"job_ids"`
+		CredID string   `json:"cred_id"`
+	}
+)
+
+// queueKey returns the key of the sorted set of the queue with the given path
+func queueKey(path []string) string {
+	return QueuePrefix + strings.Join(path, KeySeparator)
+}
+
+// batchJobs returns the ids of the jobs with transfers in the batch
+func batchJobs(batch *messages.Batch) []string {
+	jobs := make([]string, 0, 1)
+	seen := make(map[string]bool)
+	for _, t := range batch.Transfers {
+		if !seen[t.JobId] {
+			seen[t.JobId] = true
+			jobs = append(jobs, t.JobId)
+		}
+	}
+	return jobs
+}
+
+// pathPrefixes returns the path of the batch, and each of its prefixes, joined
+func pathPrefixes(batch *messages.Batch) []string {
+	path := batch.GetPath()
+	prefixes := make([]string, 0, len(path))
+	for i := range path {
+		prefixes = append(prefixes, strings.Join(path[:i+1], KeySeparator))
+	}
+	return prefixes
+}
+
+// queuedSummary returns the summary kept for the queued batch
+func queuedSummary(batch *messages.Batch) ([]byte, error) {
+	return json.Marshal(&QueuedBatch{Path: batch.GetPath(), JobIds: batchJobs(batch), CredID: batch.CredId})
+}
+
+// queueScore returns the score of the batch in the sorted set of its queue
+func queueScore(batch *messages.Batch) float64 {
+	return float64(batch.GetTimestamp().UnixNano()) / float64(time.Second)
+}
+
+// TrackQueued counts the batch into the depth of its queue, and of the parents, and keeps
+// its place in the queue, or undoes all that if the batch is leaving it
+func (store *RedisStore) TrackQueued(batch *messages.Batch, queued bool) error {
+	delta := -1
+	var summary []byte
+	if queued {
+		var err error
+		delta = 1
+		if summary, err = queuedSummary(batch); err != nil {
+			return err
+		}
+	}
+
+	conn := store.pool.Get()
+	defer conn.Close()
+
+	conn.Send("MULTI")
+	for _, prefix := range pathPrefixes(batch) {
+		conn.Send("HINCRBY", QueueDepthsKey, prefix, delta)
+	}
+	if queued {
+		conn.Send("ZADD", queueKey(batch.GetPath()), queueScore(batch), batch.GetID())
+		conn.Send("HSET", QueuedBatchesKey, batch.GetID(), summary)
+	} else {
+		conn.Send("ZREM", queueKey(batch.GetPath()), batch.GetID())
+		conn.Send("HDEL", QueuedBatchesKey, batch.GetID())
+	}
+	_, err := conn.Do("EXEC")
+	return err
+}
+
+// push puts the batch into the queue, ordered by its priority, tracking it. The tracking
+// is only informative, so failing at it is not an error.
+func (s *Scheduler) push(batch *messages.Batch) error {
+	batch.SetPriorityOrder(s.params.PriorityAging)
+	if err := s.echelon.Enqueue(batch); err != nil {
+		return err
+	}
+	if err := s.store.TrackQueued(batch, true); err != nil {
+		log.WithError(err).WithField("batch", batch.GetID()).Warn("Failed to track the queued batch")
+	}
+	return nil
+}
+
+// pop takes the next batch from the queue, and stops tracking it
+func (s *Scheduler) pop(batch *messages.Batch) error {
+	if err := s.echelon.Dequeue(batch); err != nil {
+		return err
+	}
+	if err := s.store.TrackQueued(batch, false); err != nil {
+		log.WithError(err).WithField("batch", batch.GetID()).Warn("Failed to stop tracking the batch leaving the queue")
+	}
+	return nil
+}
+
+// queueDepths returns the depths of every non empty path prefix, sorted by path
+func queueDepths(values map[string]int) []QueueDepth {
+	prefixes := make([]string, 0, len(values))
+	for prefix, depth := range values {
+		if depth > 0 && strings.Count(prefix, KeySeparator) < len(QueueLevels) {
+			prefixes = append(prefixes, prefix)
+		}
+	}
+	sort.Strings(prefixes)
+
+	depths := make([]QueueDepth, 0, len(prefixes))
+	for _, prefix := range prefixes {
+		path := strings.Split(prefix, KeySeparator)
+		depths = append(depths, QueueDepth{Path: path, Level: QueueLevels[len(path)-1], Depth: values[prefix]})
+	}
+	return depths
+}
+
+// QueueDepths returns the number of queued batches for every non empty path prefix,
+// sorted by path
+func (store *RedisStore) QueueDepths() ([]QueueDepth, error) {
+	conn := store.pool.Get()
+	defer conn.Close()
+
+	values, err := redis.IntMap(conn.Do("HGETALL", QueueDepthsKey))
+	if err != nil {
+		return nil, err
+	}
+	return queueDepths(values), nil
+}
+
+// QueuedSummary returns the summary of a queued batch, or nil if not queued
+func (store *RedisStore) QueuedSummary(id string) ([]byte, error) {
+	conn := store.pool.Get()
+	defer conn.Close()
+
+	data, err := redis.Bytes(conn.Do("HGET", QueuedBatchesKey, id))
+	if err == redis.ErrNil {
+		return nil, nil
+	}
+	return data, err
+}
+
+// QueuedSummaries returns the summaries of all the queued batches, by id
+func (store *RedisStore) QueuedSummaries() (map[string][]byte, error) {
+	conn := store.pool.Get()
+	defer conn.Close()
+	return hashMap(conn, QueuedBatchesKey)
+}
+
+// QueuePosition returns the place of the batch in its queue, starting by 1, or 0 if not
+// there, and the length of the queue
+func (store *RedisStore) QueuePosition(path []string, id string) (int, int, error) {
+	conn := store.pool.Get()
+	defer conn.Close()
+
+	position := 0
+	rank, err := redis.Int(conn.Do("ZRANK", queueKey(path), id))
+	if err == nil {
+		position = rank + 1
+	} else if err != redis.ErrNil {
+		return 0, 0, err
+	}
+	length, err := redis.Int(conn.Do("ZCARD", queueKey(path)))
+	return position, length, err
+}
+
+// Unqueue asks the leader to take the batches out of the queue
+func (store *RedisStore) Unqueue(ids ...string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	conn := store.pool.Get()
+	defer conn.Close()
+	_, err := conn.Do("SADD", redis.Args{}.Add(UnqueuedKey).AddFlat(ids)...)
+	return err
+}
+
+// Unqueued returns the ids of the batches to take out of the queue
+func (store *RedisStore) Unqueued() ([]string, error) {
+	conn := store.pool.Get()
+	defer conn.Close()
+	return redis.Strings(conn.Do("SMEMBERS", UnqueuedKey))
+}
+
+// ForgetUnqueued drops the ids of batches taken out of the queue
+func (store *RedisStore) ForgetUnqueued(ids []string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	conn := store.pool.Get()
+	defer conn.Close()
+	_, err := conn.Do("SREM", redis.Args{}.Add(UnqueuedKey).AddFlat(ids)...)
+	return err
+}
+
+// removeUnqueued takes out of the queue the transfers of the batches others asked to,
+// because they have been canceled or expired, and reloads the queue if there were any,
+// since echelon only removes the batches it dequeues. The remaining transfers of a batch
+// are handed over again, as a batch of their own.
+// Batches not found in the queue are forgotten: if still in the inbox, their canceled or
+// expired transfers are discarded when they leave the queue, as they have been claimed.
+func (s *Scheduler) removeUnqueued(token string) error {
+	ids, err := s.store.Unqueued()
+	if err != nil || len(ids) == 0 {
+		return err
+	}
+	db := s.store.QueueDb()
+	removed := 0
+	remaining := make([]*messages.Batch, 0)
+	for _, id := range ids {
+		batch := &messages.Batch{}
+		if err := db.Get(id, batch); err != nil {
+			continue
+		}
+		transferIds := make([]string, 0, len(batch.Transfers))
+		for _, t := range batch.Transfers {
+			transferIds = append(transferIds, t.TransferId)
+		}
+		queuedIn, err := s.store.QueuedIn(transferIds)
+		if err != nil {
+			return err
+		}
+		kept := make([]*messages.Transfer, 0, len(batch.Transfers))
+		for i, t := range batch.Transfers {
+			if queuedIn[i] != "" {
+				kept = append(kept, t)
+			}
+		}
+		if len(kept) == len(batch.Transfers) {
+			continue
+		}
+
+		if err := db.Delete(id); err != nil {
+			return err
+		}
+		removed++
+		if err := s.store.TrackQueued(batch, false); err != nil {
+			log.WithError(err).WithField("batch", id).Warn("Failed to stop tracking the batch taken out of the queue")
+		}
+		if len(kept) == 0 {
+			continue
+		}
+		// The remaining transfers take over the deadline, unless expired meanwhile
+		if !batch.GetDeadline().IsZero() {
+			if claimed, err := s.store.ClaimDeadline(id); err != nil {
+				return err
+			} else if !claimed {
+				continue
+			}
+		}
+		batch.Transfers = kept
+		remaining = append(remaining, batch)
+	}
+
+	if removed > 0 {
+		log.Infof("Took %d batches out of the queue", removed)
+		if err := s.lead(token); err != nil {
+			return err
+		}
+	}
+	for _, batch := range remaining {
+		if err := s.enqueue(batch); err != nil {
+			return err
+		}
+		log.WithField("batch", batch.GetID()).Infof("Handed over again %d transfers left in the batch", len(batch.Transfers))
+	}
+	return s.store.ForgetUnqueued(ids)
+}
+
+// validQueuePath returns true if the path names a queue, or a level above
+func validQueuePath(path []string) bool {
+	if len(path) == 0 || len(path) > len(QueueLevels) {
+		return false
+	}
+	for _, p := range path {
+		if p == "" {
+			return false
+		}
+	}
+	return true
+}
+
+// PauseQueue stops scheduling from the queue, and those below it. It returns false if
+// it was already paused.
+func (info *RedisScoreboard) PauseQueue(path []string) (bool, error) {
+	conn := info.pool.Get()
+	defer conn.Close()
+	return redis.Bool(conn.Do("SADD", PausedKey, strings.Join(path, KeySeparator)))
+}
+
+// ResumeQueue resumes scheduling from the queue. It returns false if it was not paused.
+func (info *RedisScoreboard) ResumeQueue(path []string) (bool, error) {
+	conn := info.pool.Get()
+	defer conn.Close()
+	return redis.Bool(conn.Do("SREM", PausedKey, strings.Join(path, KeySeparator)))
+}
+
+// splitPaths returns the paths joined in the members of PausedKey, sorted
+func splitPaths(members []string) [][]string {
+	sort.Strings(members)
+	paths := make([][]string, 0, len(members))
+	for _, member := range members {
+		paths = append(paths, strings.Split(member, KeySeparator))
+	}
+	return paths
+}
+
+// ListPaused returns the paths of the paused queues
+func (info *RedisScoreboard) ListPaused() ([][]string, error) {
+	conn := info.pool.Get()
+	defer conn.Close()
+
+	members, err := redis.Strings(conn.Do("SMEMBERS", PausedKey))
+	if err != nil {
+		return nil, err
+	}
+	return splitPaths(members), nil
+}
+
+// isPaused returns true if the queue of the route has been paused. Those below it are
+// skipped along with it.
+func isPaused(conn redis.Conn, route []string) (bool, error) {
+	return redis.Bool(conn.Do("SISMEMBER", PausedKey, strings.Join(route, KeySeparator)))
+}
@@ -0,0 +1,47 @@
+/*
+ * Copyright (c) CERN 2016
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/garyburd/redigo/redis"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"time"
+)
+
+var reconcileCmd = &cobra.Command{
+	Use:   "reconcile",
+	Short: "Rebuild the counters of the scoreboard from the live leases",
+	Run: func(cmd *cobra.Command, args []string) {
+		redisAddr := viper.Get("schedd.redis").(string)
+		pool := &redis.Pool{
+			Dial: func() (redis.Conn, error) {
+				return redis.Dial("tcp", redisAddr)
+			},
+		}
+		defer pool.Close()
+
+		scoreboard := &RedisScoreboard{pool: pool}
+		live, err := scoreboard.Reconcile(time.Now())
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println("Counters rebuilt from", live, "live leases")
+	},
+}
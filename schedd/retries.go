@@ -0,0 +1,196 @@
+/*
+ * Copyright (c) CERN 2016
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"github.com/garyburd/redigo/redis"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"gitlab.cern.ch/flutter/fts/config"
+	"gitlab.cern.ch/flutter/fts/messages"
+	"gitlab.cern.ch/flutter/stomp"
+	"time"
+)
+
+// Redis keys holding the batches waiting to be retried
+const (
+	// RetriesKey is a sorted set with the id of the batches to retry, scored by when
+	RetriesKey = "fts-schedd-retries"
+	// RetryDataKey is a hash with the serialized batches to retry, by id
+	RetryDataKey = "fts-schedd-retry-data"
+)
+
+// retryClaim is how long a claimed batch is kept from the other schedulers, before it
+// is due again unless resubmitted and forgotten
+const retryClaim = time.Minute
+
+// retryBatch returns a new submitted batch with the transfers of a done batch that failed
+// with a recoverable error, and still have attempts left, or nil if there are none.
+// The delay is the longest of their retry delays.
+// Multihop batches are retried from the hop that failed.
+func retryBatch(batch *messages.Batch) (*messages.Batch, time.Duration) {
+	if batch.Type == messages.Batch_MULTIHOP {
+		return retryHops(batch)
+	}
+
+	var delay time.Duration
+	transfers := make([]*messages.Transfer, 0)
+	for _, t := range batch.Transfers {
+		if t.State != messages.Transfer_FAILED || !t.GetInfo().GetError().GetRecoverable() {
+			continue
+		}
+		if t.Retry >= t.GetParameters().GetRetry() {
+			continue
+		}
+		retry := proto.Clone(t).(*messages.Transfer)
+		retry.State = messages.Transfer_SUBMITTED
+		retry.Retry++
+		retry.Info = nil
+		transfers = append(transfers, retry)
+
+		if tDelay := time.Duration(t.GetParameters().GetRetryDelay().GetSeconds()) * time.Second; tDelay > delay {
+			delay = tDelay
+		}
+	}
+	if len(transfers) == 0 {
+		return nil, 0
+	}
+	return &messages.Batch{
+		Submitted: batch.Submitted,
+		State:     messages.Batch_SUBMITTED,
+		Transfers: transfers,
+		CredId:    batch.CredId,
+		SourceSe:  batch.SourceSe,
+		DestSe:    batch.DestSe,
+		Vo:        batch.Vo,
+		Activity:  batch.Activity,
+		Priority:  batch.Priority,
+		Type:      batch.Type,
+	}, delay
+}
+
+// ScheduleRetry keeps the batch until it is due for a retry
+func (store *RedisStore) ScheduleRetry(id string, data []byte, due time.Time) error {
+	conn := store.pool.Get()
+	defer conn.Close()
+
+	conn.Send("MULTI")
+	conn.Send("HSET", RetryDataKey, id, data)
+	conn.Send("ZADD", RetriesKey, due.Unix(), id)
+	_, err := conn.Do("EXEC")
+	return err
+}
+
+// claimRetriesScript claims the batches due for a retry by ARGV[1], pushing them back
+// to ARGV[2] so they are due again if not forgotten by then, and returns them as id and
+// data pairs. Ids without data left are dropped.
+var claimRetriesScript = redis.NewScript(2, `
+local retriesKey, retryDataKey = KEYS[1], KEYS[2]
+local claimed = {}
+for _, id in ipairs(redis.call("ZRANGEBYSCORE", retriesKey, "-inf", ARGV[1])) do
+	local data = redis.call("HGET", retryDataKey, id)
+	if data then
+		redis.call("ZADD", retriesKey, ARGV[2], id)
+		table.insert(claimed, id)
+		table.insert(claimed, data)
+	else
+		redis.call("ZREM", retriesKey, id)
+	end
+end
+return claimed
+`)
+
+// ClaimRetries claims the batches due for a retry by now, and returns them by id.
+// They are due again at until, so a batch is not lost if the scheduler dies before
+// forgetting it, and no other scheduler picks it up before.
+func (store *RedisStore) ClaimRetries(now, until time.Time) (map[string][]byte, error) {
+	conn := store.pool.Get()
+	defer conn.Close()
+
+	claimed, err := redis.StringMap(claimRetriesScript.Do(conn, RetriesKey, RetryDataKey, now.Unix(), until.Unix()))
+	if err != nil {
+		return nil, err
+	}
+	due := make(map[string][]byte, len(claimed))
+	for id, data := range claimed {
+		due[id] = []byte(data)
+	}
+	return due, nil
+}
+
+// RetryLater puts back a claimed batch, due again at the given time
+func (store *RedisStore) RetryLater(id string, due time.Time) error {
+	conn := store.pool.Get()
+	defer conn.Close()
+	_, err := conn.Do("ZADD", RetriesKey, due.Unix(), id)
+	return err
+}
+
+// ForgetRetry drops a claimed batch, once resubmitted
+func (store *RedisStore) ForgetRetry(id string) error {
+	conn := store.pool.Get()
+	defer conn.Close()
+
+	conn.Send("MULTI")
+	conn.Send("ZREM", RetriesKey, id)
+	conn.Send("HDEL", RetryDataKey, id)
+	_, err := conn.Do("EXEC")
+	return err
+}
+
+// scheduleRetry stores the batch until it is due for a retry. The retry is submitted
+// again when due, so its queue timeout starts over from then.
+func (s *Scheduler) scheduleRetry(batch *messages.Batch, due time.Time) error {
+	batch.Submitted = &timestamp.Timestamp{Seconds: due.Unix(), Nanos: int32(due.Nanosecond())}
+	data, err := proto.Marshal(batch)
+	if err != nil {
+		return err
+	}
+	return s.store.ScheduleRetry(batch.GetID(), data, due)
+}
+
+// submitRetries resubmits the batches due for a retry by now
+func (s *Scheduler) submitRetries(now time.Time) error {
+	due, err := s.store.ClaimRetries(now, now.Add(retryClaim))
+	for id, data := range due {
+		l := log.WithField("batch", id)
+		if err := s.producer.Send(config.TransferTopic, string(data), stomp.SendParams{Persistent: true}); err != nil {
+			l.WithError(err).Error("Failed to resubmit the batch, will try again")
+			if err = s.store.RetryLater(id, now); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := s.store.ForgetRetry(id); err != nil {
+			return err
+		}
+		l.Info("Batch resubmitted for retry")
+	}
+	return err
+}
+
+// RunRetrier periodically resubmits the batches due for a retry
+func (s *Scheduler) RunRetrier() error {
+	log.Info("Retrier started")
+	for {
+		time.Sleep(s.params.RetryInterval)
+		if err := s.submitRetries(time.Now()); err != nil {
+			log.WithError(err).Error("Failed to resubmit the batches due for a retry")
+		}
+	}
+}
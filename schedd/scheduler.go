@@ -18,63 +18,105 @@ package main
 
 import (
 	log "github.com/Sirupsen/logrus"
-	"github.com/garyburd/redigo/redis"
+	"github.com/golang/protobuf/proto"
+	"github.com/satori/go.uuid"
 	"gitlab.cern.ch/flutter/echelon"
+	"gitlab.cern.ch/flutter/fts/config"
+	"gitlab.cern.ch/flutter/fts/messages"
 	"gitlab.cern.ch/flutter/stomp"
+	"os"
+	"sync"
 	"time"
-	"gitlab.cern.ch/flutter/fts/messages"
 )
 
 type (
+	// Params configures the scheduler
+	Params struct {
+		Limits config.Limits
+		Shares config.Shares
+		Leases LeaseParams
+		// Coalesce configures the packing of small submissions
+		Coalesce CoalesceParams
+		// Election configures the election of the scheduler running the producer
+		Election ElectionParams
+		// MaxIdle is the longest the producer waits without being woken up
+		MaxIdle time.Duration
+		// Backoff is the least the producer waits after running out of slots
+		Backoff time.Duration
+		// PriorityAging is the waiting worth one level of priority
+		PriorityAging time.Duration
+		// Sweep is the interval between sweeps of the expired batches
+		Sweep time.Duration
+		// RetryInterval is the interval between checks for batches due for a retry
+		RetryInterval time.Duration
+		// Admin is the address the admin API listens on, disabled if empty
+		Admin string
+		// AdminToken is required by the admin API to change anything. Without it, changes
+		// are only allowed from this host.
+		AdminToken string
+	}
+
+	// sender sends messages to the broker
+	sender interface {
+		Send(destination, message string, params stomp.SendParams) error
+		Close()
+	}
+
 	// Scheduler data
 	Scheduler struct {
-		producer *stomp.Producer
-		consumer *stomp.Consumer
+		params Params
+
+		producer       sender
+		consumer       *stomp.Consumer
+		markerConsumer *stomp.Consumer
+		killConsumer   *stomp.Consumer
 
+		// echelon is only loaded while leading, and only used by the producer
 		echelon    *echelon.Echelon
-		pool       *redis.Pool
-		scoreboard *Scoreboard
+		store      Store
+		scoreboard Scoreboard
+		// packer holds the small batches being packed by the consumer
+		packer *coalescer
+		// wakeup signals the producer that there may be something to schedule
+		wakeup chan struct{}
+
+		// id tells apart the schedulers in the election
+		id           string
+		leaderLock   sync.Mutex
+		token        string
+		tokenExpires time.Time
 	}
 )
 
-// NewScheduler creates a new scheduler
-func NewScheduler(params stomp.ConnectionParameters, redisAddr string) (*Scheduler, error) {
-	var err error
-	sched := &Scheduler{}
-
-	if sched.producer, err = stomp.NewProducer(params); err != nil {
-		return nil, err
+// newScheduler creates a scheduler sending through the producer, without consumers
+func newScheduler(store Store, scoreboard Scoreboard, producer sender, params Params) *Scheduler {
+	hostname, _ := os.Hostname()
+	return &Scheduler{
+		params:     params,
+		producer:   producer,
+		store:      store,
+		scoreboard: scoreboard,
+		packer:     newCoalescer(params.Coalesce),
+		wakeup:     make(chan struct{}, 1),
+		id:         hostname + "-" + uuid.NewV4().String(),
 	}
-	if sched.consumer, err = stomp.NewConsumer(params); err != nil {
+}
+
+// NewScheduler creates a new scheduler, keeping its state in the store and the scoreboard
+func NewScheduler(stompParams stomp.ConnectionParameters, store Store, scoreboard Scoreboard, params Params) (*Scheduler, error) {
+	producer, err := stomp.NewProducer(stompParams)
+	if err != nil {
 		return nil, err
 	}
-	sched.pool = &redis.Pool{
-		Dial: func() (redis.Conn, error) {
-			log.Debug("Dial Redis connection")
-			return redis.Dial("tcp", redisAddr)
-		},
-		TestOnBorrow: func(c redis.Conn, t time.Time) error {
-			_, err := c.Do("PING")
-			return err
-		},
-		MaxIdle:     10,
-		MaxActive:   50,
-		IdleTimeout: 60 * time.Second,
-		Wait:        true,
-	}
-	sched.scoreboard = &Scoreboard{
-		pool: sched.pool,
-	}
+	sched := newScheduler(store, scoreboard, producer, params)
 
-	echelonRedis := &echelon.RedisDb{
-		Pool:   sched.pool,
-		Prefix: "fts-sched-",
+	if sched.consumer, err = stomp.NewConsumer(stompParams); err != nil {
+		return nil, err
 	}
-
-	if sched.echelon, err = echelon.New(&messages.Batch{}, echelonRedis, sched.scoreboard); err != nil {
+	if sched.markerConsumer, err = stomp.NewConsumer(stompParams); err != nil {
 		return nil, err
 	}
-	if err = sched.echelon.Restore(); err != nil {
+	if sched.killConsumer, err = stomp.NewConsumer(stompParams); err != nil {
 		return nil, err
 	}
 	return sched, nil
@@ -82,22 +124,69 @@ func NewScheduler(params stomp.ConnectionParameters, redisAddr string) (*Schedul
 
 // Close finishes the scheduler
 func (s *Scheduler) Close() {
+	s.Resign()
 	s.consumer.Close()
+	s.markerConsumer.Close()
+	s.killConsumer.Close()
 	s.producer.Close()
-	s.echelon.Close()
-	s.pool.Close()
+	if s.echelon != nil {
+		s.echelon.Close()
+	}
+	if err := s.store.Close(); err != nil {
+		log.WithError(err).Warn("Failed to close the store")
+	}
+}
+
+// submit sends the batch to the transfer topic, as a new submission
+func (s *Scheduler) submit(batch *messages.Batch) error {
+	data, err := proto.Marshal(batch)
+	if err != nil {
+		return err
+	}
+	return s.producer.Send(config.TransferTopic, string(data), stomp.SendParams{Persistent: true})
+}
+
+// wake signals the producer, without blocking if it has been signaled already
+func (s *Scheduler) wake() {
+	select {
+	case s.wakeup <- struct{}{}:
+	default:
+	}
 }
 
 // Run spawns required subservices and waits for them
 func (s *Scheduler) Run() error {
 	errors := make(chan error, 10)
 
+	go func() {
+		errors <- s.RunElection()
+	}()
 	go func() {
 		errors <- s.RunConsumer()
 	}()
 	go func() {
 		errors <- s.RunProducer()
 	}()
+	go func() {
+		errors <- s.RunMarkerConsumer()
+	}()
+	go func() {
+		errors <- s.RunKillConsumer()
+	}()
+	go func() {
+		errors <- s.RunReaper()
+	}()
+	go func() {
+		errors <- s.RunSweeper()
+	}()
+	go func() {
+		errors <- s.RunRetrier()
+	}()
+	if s.params.Admin != "" {
+		go func() {
+			errors <- s.RunAdmin()
+		}()
+	}
 
 	return <-errors
 }
@@ -0,0 +1,804 @@
+/*
+ * Copyright (c) CERN 2016
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"errors"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes/duration"
+	"gitlab.cern.ch/flutter/echelon"
+	"gitlab.cern.ch/flutter/fts/config"
+	"gitlab.cern.ch/flutter/fts/messages"
+	"gitlab.cern.ch/flutter/stomp"
+	"testing"
+	"time"
+)
+
+// testSender keeps the batches sent to the transfer topic, instead of sending them,
+// or fails if told so
+type testSender struct {
+	sent []*messages.Batch
+	fail bool
+}
+
+func (sender *testSender) Send(destination, message string, params stomp.SendParams) error {
+	if sender.fail {
+		return errors.New("Broker unavailable")
+	}
+	if destination == config.TransferTopic {
+		batch := &messages.Batch{}
+		if err := proto.Unmarshal([]byte(message), batch); err != nil {
+			return err
+		}
+		sender.sent = append(sender.sent, batch)
+	}
+	return nil
+}
+
+func (sender *testSender) Close() {
+}
+
+// testMessage counts how many times it is acknowledged
+type testMessage struct {
+	acks int
+}
+
+func (msg *testMessage) Ack() error {
+	msg.acks++
+	return nil
+}
+
+// newTestScheduler returns a scheduler on top of the memory backend, as the leader,
+// with a single slot on the link
+func newTestScheduler(t *testing.T) (*Scheduler, *MemoryStore, *testSender, string) {
+	params := Params{
+		Limits: config.Limits{
+			testSource: config.Limit{Storage: testSource, Fixed: 10},
+			testDest:   config.Limit{Storage: testDest, Fixed: 10},
+			testLink:   config.Limit{Source: testSource, Destination: testDest, Fixed: 1},
+		},
+		Leases:   testLeases,
+		Election: ElectionParams{TTL: time.Minute, Interval: time.Second},
+		MaxIdle:  100 * time.Millisecond,
+		Backoff:  50 * time.Millisecond,
+
+		PriorityAging: 10 * time.Minute,
+	}
+	store, scoreboard := NewMemoryBackend(params)
+	sender := &testSender{}
+	s := newScheduler(store, scoreboard, sender, params)
+
+	token, err := store.Elect("", s.id, params.Election.TTL)
+	if err != nil || token == "" {
+		t.Fatal("Expecting to become the leader, got ", err)
+	}
+	s.setLeadership(token, time.Now().Add(params.Election.TTL))
+	if err = s.lead(token); err != nil {
+		t.Fatal(err)
+	}
+	return s, store, sender, token
+}
+
+// Submitted batches must be sent to the workers while there are slots, and the next
+// ones once done batches give them back.
+func TestSchedulerProduce(t *testing.T) {
+	s, store, sender, token := newTestScheduler(t)
+	first, second := newTestBatch("atlas", "a"), newTestBatch("atlas", "b")
+	second.Submitted.Seconds++
+	for _, batch := range []*messages.Batch{first, second} {
+		if err := s.handle(batch); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := s.produce(token); err != echelon.ErrNotEnoughSlots {
+		t.Fatal("Expecting to run out of slots, got ", err)
+	}
+	if len(sender.sent) != 1 || sender.sent[0].State != messages.Batch_READY || sender.sent[0].GetID() != first.GetID() {
+		t.Fatal("Expecting the first batch to be sent, got ", sender.sent)
+	}
+	if depths, _ := store.QueueDepths(); len(depths) != 4 || depths[0].Depth != 1 {
+		t.Fatal("Expecting the second batch still queued, got ", depths)
+	}
+
+	done := sender.sent[0]
+	done.State = messages.Batch_DONE
+	done.Transfers[0].State = messages.Transfer_FINISHED
+	if err := s.handle(done); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.produce(token); err != echelon.ErrEmpty {
+		t.Fatal("Expecting the queue to run dry, got ", err)
+	}
+	if len(sender.sent) != 2 || sender.sent[1].GetID() != second.GetID() {
+		t.Fatal("Expecting the second batch to be sent, got ", sender.sent)
+	}
+	if depths, _ := store.QueueDepths(); len(depths) != 0 {
+		t.Fatal("Expecting no queued batches, got ", depths)
+	}
+}
+
+// The producer must be woken up by new batches and released slots, without blocking
+// those waking it, and otherwise wait for MaxIdle. It must back off when out of slots.
+func TestSchedulerWakeup(t *testing.T) {
+	s, _, sender, token := newTestScheduler(t)
+	<-s.wakeup
+	if err := s.handle(newTestBatch("atlas", "a")); err != nil {
+		t.Fatal(err)
+	}
+	s.wake()
+	if len(s.wakeup) != 1 {
+		t.Fatal("Expecting a single pending wake up, got ", len(s.wakeup))
+	}
+
+	start := time.Now()
+	s.wait(false)
+	if elapsed := time.Since(start); elapsed >= s.params.MaxIdle {
+		t.Fatal("Expecting to be woken up right away, waited ", elapsed)
+	}
+	start = time.Now()
+	s.wait(false)
+	if elapsed := time.Since(start); elapsed < s.params.MaxIdle {
+		t.Fatal("Expecting to wait for MaxIdle, waited ", elapsed)
+	}
+
+	s.produce(token)
+	done := sender.sent[0]
+	done.State = messages.Batch_DONE
+	if err := s.handle(done); err != nil {
+		t.Fatal(err)
+	}
+	start = time.Now()
+	s.wait(true)
+	if elapsed := time.Since(start); elapsed < s.params.Backoff || elapsed >= s.params.MaxIdle {
+		t.Fatal("Expecting to back off, and then be woken up by the released slot, waited ", elapsed)
+	}
+}
+
+// Small batches must be packed by kind until the packed batch is full, would go over
+// the limits, or has waited long enough.
+func TestCoalescer(t *testing.T) {
+	c := newCoalescer(CoalesceParams{Files: 3, Bytes: 100, Wait: time.Second})
+	newSmallBatch := func(vo, id string, size uint64) *messages.Batch {
+		batch := newTestBatch(vo, id)
+		batch.Transfers[0].Filesize = size
+		return batch
+	}
+	if !c.Packable(newSmallBatch("atlas", "a", 10)) {
+		t.Fatal("Expecting a small submission to be packable")
+	}
+	if c.Packable(newSmallBatch("atlas", "a", 100)) || c.Packable(newTestBatch("atlas", "a", "b")) {
+		t.Fatal("Expecting big or several transfer batches not to be packable")
+	}
+	if newCoalescer(CoalesceParams{Files: 1, Wait: time.Second}).Packable(newSmallBatch("atlas", "a", 10)) {
+		t.Fatal("Expecting packing to be disabled with a single file")
+	}
+
+	now := time.Now()
+	for _, batch := range []*messages.Batch{newSmallBatch("atlas", "a", 10), newSmallBatch("atlas", "b", 10), newSmallBatch("cms", "c", 10)} {
+		if ready := c.Add(batch, &testMessage{}, now); len(ready) != 0 {
+			t.Fatal("Not expecting a packed batch to be ready, got ", ready)
+		}
+	}
+	ready := c.Add(newSmallBatch("atlas", "d", 85), &testMessage{}, now)
+	if len(ready) != 1 || len(ready[0].batch.Transfers) != 2 || len(ready[0].messages) != 2 || ready[0].bytes != 20 {
+		t.Fatal("Expecting the batch that would go over the size to be ready, got ", ready)
+	}
+	if ready = c.Add(newSmallBatch("atlas", "e", 15), &testMessage{}, now); len(ready) != 1 || len(ready[0].batch.Transfers) != 2 {
+		t.Fatal("Expecting the batch full by size to be ready, got ", ready)
+	}
+	for _, id := range []string{"f", "g", "h"} {
+		ready = c.Add(newSmallBatch("atlas", id, 1), &testMessage{}, now)
+	}
+	if len(ready) != 1 || len(ready[0].batch.Transfers) != 3 {
+		t.Fatal("Expecting the batch full by files to be ready, got ", ready)
+	}
+
+	if expired := c.Expired(now.Add(time.Second / 2)); len(expired) != 0 {
+		t.Fatal("Not expecting the pending batch to be ready yet, got ", expired)
+	}
+	if expired := c.Expired(now.Add(time.Second)); len(expired) != 1 || expired[0].batch.Vo != "cms" {
+		t.Fatal("Expecting the pending batch to be ready once waited, got ", expired)
+	}
+	if len(c.pending) != 0 {
+		t.Fatal("Not expecting pending batches, got ", c.pending)
+	}
+}
+
+// The messages of a packed batch must be acknowledged once it is queued.
+func TestSchedulerEnqueuePacked(t *testing.T) {
+	s, store, _, _ := newTestScheduler(t)
+	c := newCoalescer(CoalesceParams{Files: 2, Wait: time.Second})
+	first, second := &testMessage{}, &testMessage{}
+	c.Add(newTestBatch("atlas", "a"), first, time.Now())
+	ready := c.Add(newTestBatch("atlas", "b"), second, time.Now())
+	if len(ready) != 1 || first.acks != 0 {
+		t.Fatal("Expecting the messages not to be acknowledged before queued, got ", ready)
+	}
+
+	if err := s.enqueuePacked(ready[0]); err != nil {
+		t.Fatal(err)
+	}
+	if first.acks != 1 || second.acks != 1 {
+		t.Fatal("Expecting both messages acknowledged, got ", first.acks, second.acks)
+	}
+	data, _ := store.NextInbox()
+	batch := &messages.Batch{}
+	if err := proto.Unmarshal(data, batch); err != nil || len(batch.Transfers) != 2 {
+		t.Fatal("Expecting the packed batch handed over to the leader, got ", batch, err)
+	}
+}
+
+// Batches of higher priority must go first, unless the others have waited longer than
+// the aging of the difference.
+func TestSchedulerPriority(t *testing.T) {
+	s, _, sender, token := newTestScheduler(t)
+	low, high, urgent := newTestBatch("atlas", "low"), newTestBatch("atlas", "high"), newTestBatch("atlas", "urgent")
+	low.Priority, high.Priority, urgent.Priority = 1, 2, 5
+	low.Submitted.Seconds -= 15 * 60
+	high.Submitted.Seconds -= 60
+	for _, batch := range []*messages.Batch{low, high, urgent} {
+		if err := s.handle(batch); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var order []string
+	for len(order) < 3 {
+		if err := s.produce(token); err != echelon.ErrNotEnoughSlots && err != echelon.ErrEmpty {
+			t.Fatal("Expecting to send one batch at a time, got ", err)
+		}
+		done := sender.sent[len(sender.sent)-1]
+		order = append(order, done.Transfers[0].TransferId)
+		done.State = messages.Batch_DONE
+		done.Transfers[0].State = messages.Transfer_FINISHED
+		if err := s.handle(done); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if order[0] != "urgent" || order[1] != "low" || order[2] != "high" {
+		t.Fatal("Expecting the urgent batch, then the one waiting longer than the aging, got ", order)
+	}
+}
+
+// A batch that can not be sent must give its slots back, and be handed over again.
+func TestSchedulerSendFailure(t *testing.T) {
+	s, store, sender, token := newTestScheduler(t)
+	if err := s.handle(newTestBatch("atlas", "a")); err != nil {
+		t.Fatal(err)
+	}
+
+	sender.fail = true
+	s.produce(token)
+	if n := counter(t, s.scoreboard, testLink); n != 0 {
+		t.Fatal("Expecting the slot to be released, got ", n)
+	}
+	if data, _ := store.NextInbox(); data == nil {
+		t.Fatal("Expecting the batch back in the inbox")
+	}
+
+	sender.fail = false
+	if err := s.produce(token); err != echelon.ErrEmpty {
+		t.Fatal("Expecting the queue to run dry, got ", err)
+	}
+	if len(sender.sent) != 1 || counter(t, s.scoreboard, testLink) != 1 {
+		t.Fatal("Expecting the batch to be sent once, got ", sender.sent)
+	}
+}
+
+// Transfers canceled while queued must be reported, and never sent.
+func TestSchedulerCancel(t *testing.T) {
+	s, _, sender, token := newTestScheduler(t)
+	if err := s.handle(newTestBatch("atlas", "a")); err != nil {
+		t.Fatal(err)
+	}
+
+	canceled, err := s.cancel(&messages.Kill{TransferId: "a"})
+	if err != nil || len(canceled) != 1 {
+		t.Fatal("Expecting the transfer to be canceled, got ", canceled, err)
+	}
+	if err = s.produce(token); err != echelon.ErrEmpty {
+		t.Fatal("Expecting the queue to run dry, got ", err)
+	}
+	if len(sender.sent) != 1 || sender.sent[0].Transfers[0].State != messages.Transfer_CANCELED {
+		t.Fatal("Expecting only the cancellation to be sent, got ", sender.sent)
+	}
+}
+
+// Kill results must list the queued transfers canceled, and nothing if none matched.
+func TestSchedulerKillResult(t *testing.T) {
+	s, _, _, _ := newTestScheduler(t)
+	if err := s.handle(newTestBatch("atlas", "a", "b")); err != nil {
+		t.Fatal(err)
+	}
+
+	kill := &messages.Kill{Vo: "atlas"}
+	kill.EnsureID()
+	result := s.kill(kill)
+	if result.Agent != "fts-schedd" || result.GetKill().GetId() != kill.Id || result.Finished == nil {
+		t.Fatal("Expecting the result of the kill, got ", result)
+	}
+	if len(result.Targets) != 1 || len(result.Targets[0].TransferIds) != 2 || result.Targets[0].Error != "" {
+		t.Fatal("Expecting both transfers to be canceled, got ", result.Targets)
+	}
+	if result = s.kill(kill); len(result.Targets) != 0 {
+		t.Fatal("Expecting nothing left to cancel, got ", result.Targets)
+	}
+}
+
+// Transfers canceled from a queued batch must be taken out of the queue, and the rest of
+// the batch sent alone.
+func TestSchedulerPartialCancel(t *testing.T) {
+	s, store, sender, token := newTestScheduler(t)
+	if err := s.handle(newTestBatch("atlas", "busy")); err != nil {
+		t.Fatal(err)
+	}
+	s.produce(token)
+	batch := newTestBatch("atlas", "a", "b")
+	if err := s.handle(batch); err != nil {
+		t.Fatal(err)
+	}
+	s.produce(token)
+
+	canceled, err := s.cancel(&messages.Kill{TransferId: "a"})
+	if err != nil || len(canceled) != 1 || canceled[0] != "a" {
+		t.Fatal("Expecting the transfer to be canceled, got ", canceled, err)
+	}
+	if ids, _ := store.Unqueued(); len(ids) != 1 || ids[0] != batch.GetID() {
+		t.Fatal("Expecting the batch to be taken out of the queue, got ", ids)
+	}
+	s.produce(token)
+	if _, length, _ := store.QueuePosition(batch.GetPath(), batch.GetID()); length != 1 {
+		t.Fatal("Expecting the rest of the batch queued alone, got ", length)
+	}
+
+	done := sender.sent[0]
+	done.State = messages.Batch_DONE
+	if err = s.handle(done); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.produce(token); err != echelon.ErrEmpty {
+		t.Fatal("Expecting the queue to run dry, got ", err)
+	}
+	if len(sender.sent) != 3 || sender.sent[1].Transfers[0].State != messages.Transfer_CANCELED {
+		t.Fatal("Expecting the cancellation, and then the rest of the batch, got ", sender.sent)
+	}
+	if rest := sender.sent[2]; len(rest.Transfers) != 1 || rest.Transfers[0].TransferId != "b" {
+		t.Fatal("Expecting only the transfer left to be sent, got ", rest)
+	}
+}
+
+// Transfers canceled while waiting to be packed must be reported and acknowledged, and
+// the rest left to be packed.
+func TestSchedulerCancelPacked(t *testing.T) {
+	s, _, sender, _ := newTestScheduler(t)
+	s.packer = newCoalescer(CoalesceParams{Files: 3, Wait: time.Second})
+	first, second := &testMessage{}, &testMessage{}
+	s.packer.Add(newTestBatch("atlas", "a"), first, time.Now())
+	s.packer.Add(newTestBatch("atlas", "b"), second, time.Now())
+
+	canceled, err := s.cancel(&messages.Kill{JobId: "job-a"})
+	if err != nil || len(canceled) != 1 || canceled[0] != "a" {
+		t.Fatal("Expecting the pending transfer to be canceled, got ", canceled, err)
+	}
+	if first.acks != 1 || second.acks != 0 {
+		t.Fatal("Expecting only the canceled message to be acknowledged, got ", first.acks, second.acks)
+	}
+	if len(sender.sent) != 1 || sender.sent[0].Transfers[0].State != messages.Transfer_CANCELED {
+		t.Fatal("Expecting the cancellation to be sent, got ", sender.sent)
+	}
+	ready := s.packer.Expired(time.Now().Add(time.Second))
+	if len(ready) != 1 || len(ready[0].batch.Transfers) != 1 || ready[0].batch.Transfers[0].TransferId != "b" {
+		t.Fatal("Expecting the other transfer still pending, got ", ready)
+	}
+}
+
+// Batches past their deadline must be reported as expired, and taken out of the queue.
+func TestSchedulerExpiration(t *testing.T) {
+	s, store, sender, token := newTestScheduler(t)
+	if err := s.handle(newTestBatch("atlas", "busy")); err != nil {
+		t.Fatal(err)
+	}
+	s.produce(token)
+	batch := newTestBatch("atlas", "a")
+	batch.Transfers[0].Parameters = &messages.TransferParameters{QueueTimeout: &duration.Duration{Seconds: 60}}
+	if err := s.handle(batch); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.produce(token); err != echelon.ErrNotEnoughSlots {
+		t.Fatal("Expecting the batch to wait for a slot, got ", err)
+	}
+
+	if err := s.sweepDeadlines(time.Now()); err != nil || len(sender.sent) != 1 {
+		t.Fatal("Not expecting the batch to expire yet, got ", sender.sent, err)
+	}
+	if err := s.sweepDeadlines(time.Now().Add(2 * time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if len(sender.sent) != 2 || sender.sent[1].Transfers[0].State != messages.Transfer_FAILED {
+		t.Fatal("Expecting the batch to be reported as expired, got ", sender.sent)
+	}
+	if ids, _ := store.Unqueued(); len(ids) != 1 || ids[0] != batch.GetID() {
+		t.Fatal("Expecting the batch to be taken out of the queue, got ", ids)
+	}
+
+	s.produce(token)
+	if depths, _ := store.QueueDepths(); len(depths) != 0 {
+		t.Fatal("Expecting no queued batches, got ", depths)
+	}
+	if ids, _ := store.Unqueued(); len(ids) != 0 {
+		t.Fatal("Expecting the batch to be forgotten once out of the queue, got ", ids)
+	}
+	done := sender.sent[0]
+	done.State = messages.Batch_DONE
+	if err := s.handle(done); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.produce(token); err != echelon.ErrEmpty || len(sender.sent) != 2 {
+		t.Fatal("Not expecting the expired batch to be sent, got ", sender.sent, err)
+	}
+}
+
+// A batch leaving the queue must only run if it claims its deadline on time.
+func TestSchedulerClaimDeadline(t *testing.T) {
+	s, _, sender, _ := newTestScheduler(t)
+	if ok, err := s.claimDeadline(newTestBatch("atlas", "none"), time.Now()); !ok || err != nil {
+		t.Fatal("Expecting a batch without deadline to run, got ", err)
+	}
+
+	onTime, late := newTestBatch("atlas", "a"), newTestBatch("atlas", "b")
+	for _, batch := range []*messages.Batch{onTime, late} {
+		batch.Transfers[0].Parameters = &messages.TransferParameters{QueueTimeout: &duration.Duration{Seconds: 60}}
+		if err := s.enqueue(batch); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if ok, err := s.claimDeadline(onTime, time.Now()); !ok || err != nil {
+		t.Fatal("Expecting the batch to run, got ", err)
+	}
+	if ok, _ := s.claimDeadline(onTime, time.Now()); ok {
+		t.Fatal("Expecting a claimed deadline not to be claimed again")
+	}
+	if len(sender.sent) != 0 {
+		t.Fatal("Not expecting any report, got ", sender.sent)
+	}
+
+	if ok, err := s.claimDeadline(late, time.Now().Add(2*time.Minute)); ok || err != nil {
+		t.Fatal("Expecting the late batch not to run, got ", err)
+	}
+	if len(sender.sent) != 1 || sender.sent[0].Transfers[0].Info.Error.Description != "Transfer expired while queued" {
+		t.Fatal("Expecting the late batch to be reported as expired, got ", sender.sent)
+	}
+}
+
+// Batches of banned users must be parked when they leave the queue, and queued again
+// once the ban is lifted.
+func TestSchedulerBans(t *testing.T) {
+	s, store, sender, token := newTestScheduler(t)
+	s.scoreboard.SetBan(&Ban{Kind: BanUser, Name: "credentials"})
+	batch := newTestBatch("atlas", "a")
+	if err := s.handle(batch); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.produce(token); err != echelon.ErrEmpty {
+		t.Fatal("Expecting the queue to run dry, got ", err)
+	}
+	if parked, _ := store.ParkedBatch(batch.GetID()); len(sender.sent) != 0 || parked == nil {
+		t.Fatal("Expecting the batch to be parked, got ", sender.sent)
+	}
+
+	s.scoreboard.RemoveBan(BanUser, "credentials")
+	if unparked, err := s.unparkBatches(); err != nil || unparked != 1 {
+		t.Fatal("Expecting the batch to be unparked, got ", unparked, err)
+	}
+	s.produce(token)
+	if len(sender.sent) != 1 || sender.sent[0].State != messages.Batch_READY {
+		t.Fatal("Expecting the batch to be sent, got ", sender.sent)
+	}
+}
+
+// Batches queued under a ban that cancels must be canceled, and taken out of the queue.
+func TestSchedulerPurgeBanned(t *testing.T) {
+	s, store, sender, token := newTestScheduler(t)
+	s.scoreboard.SetBan(&Ban{Kind: BanVo, Name: "dteam"})
+	batch := newTestBatch("dteam", "a")
+	if err := s.handle(batch); err != nil {
+		t.Fatal(err)
+	}
+	s.produce(token)
+	if purged, err := s.purgeBanned(time.Now()); err != nil || purged != 0 {
+		t.Fatal("Not expecting a batch waiting for the ban to be purged, got ", purged, err)
+	}
+
+	s.scoreboard.SetBan(&Ban{Kind: BanVo, Name: "dteam", Cancel: true})
+	if purged, err := s.purgeBanned(time.Now()); err != nil || purged != 1 {
+		t.Fatal("Expecting the batch to be purged, got ", purged, err)
+	}
+	if len(sender.sent) != 1 || sender.sent[0].Transfers[0].State != messages.Transfer_CANCELED {
+		t.Fatal("Expecting the cancellation to be sent, got ", sender.sent)
+	}
+	s.produce(token)
+	if _, length, _ := store.QueuePosition(batch.GetPath(), batch.GetID()); length != 0 {
+		t.Fatal("Expecting the batch out of the queue, got ", length)
+	}
+
+	s.scoreboard.RemoveBan(BanVo, "dteam")
+	if err := s.produce(token); err != echelon.ErrEmpty || len(sender.sent) != 1 {
+		t.Fatal("Expecting nothing left to send, got ", err, sender.sent)
+	}
+}
+
+// The bans stopping a queued batch must cover every level of its path, and its user.
+func TestSummaryBans(t *testing.T) {
+	summary := &QueuedBatch{Path: []string{"dest", "dteam", "default", "source"}, CredID: "credentials"}
+	fields := summaryBans(summary)
+	expected := []string{
+		banField(BanDestination, "dest"), banField(BanStorage, "dest"), banField(BanVo, "dteam"),
+		banField(BanSource, "source"), banField(BanStorage, "source"), banField(BanUser, "credentials"),
+	}
+	if len(fields) != len(expected) {
+		t.Fatal("Expecting ", expected, ", got ", fields)
+	}
+	for i := range expected {
+		if fields[i] != expected[i] {
+			t.Fatal("Expecting ", expected, ", got ", fields)
+		}
+	}
+}
+
+// A leader that has been replaced must stop, and hand the batch back over to the new one.
+func TestSchedulerFenced(t *testing.T) {
+	s, store, sender, token := newTestScheduler(t)
+	if err := s.handle(newTestBatch("atlas", "a")); err != nil {
+		t.Fatal(err)
+	}
+	store.Resign(token)
+	if other, _ := store.Elect("", "other", time.Minute); other == "" {
+		t.Fatal("Expecting another scheduler to take over")
+	}
+
+	if err := s.produce(token); err != ErrFenced {
+		t.Fatal("Expecting to be fenced, got ", err)
+	}
+	if len(sender.sent) != 0 {
+		t.Fatal("Not expecting any batch sent, got ", sender.sent)
+	}
+	if s.leadership() != "" {
+		t.Fatal("Expecting the leadership to be lost")
+	}
+	if data, _ := store.NextInbox(); data == nil {
+		t.Fatal("Expecting the batch back in the inbox")
+	}
+}
+
+// Only the transfers failed with a recoverable error, and attempts left, must be
+// retried, after the longest of their delays, in a batch with its own id.
+func TestRetryBatch(t *testing.T) {
+	done := newTestBatch("atlas", "a", "b", "c", "d", "e")
+	done.State = messages.Batch_DONE
+	for i, transfer := range done.Transfers {
+		transfer.State = messages.Transfer_FAILED
+		transfer.Parameters = &messages.TransferParameters{Retry: 2, RetryDelay: &duration.Duration{Seconds: int64(30 * (i + 1))}}
+		transfer.Info = &messages.TransferInfo{Error: &messages.TransferError{Recoverable: true}}
+	}
+	done.Transfers[1].Info.Error.Recoverable = false
+	done.Transfers[2].Retry = 2
+	done.Transfers[3].State = messages.Transfer_FINISHED
+
+	retry, delay := retryBatch(done)
+	if retry == nil || len(retry.Transfers) != 2 || retry.Transfers[0].TransferId != "a" || retry.Transfers[1].TransferId != "e" {
+		t.Fatal("Expecting the first and last transfers to be retried, got ", retry)
+	}
+	if delay != 150*time.Second {
+		t.Fatal("Expecting the longest delay, got ", delay)
+	}
+	if retry.State != messages.Batch_SUBMITTED || retry.Transfers[0].State != messages.Transfer_SUBMITTED ||
+		retry.Transfers[0].Retry != 1 || retry.Transfers[0].Info != nil {
+		t.Fatal("Expecting submitted transfers on their next attempt, got ", retry)
+	}
+	if done.Transfers[0].Retry != 0 {
+		t.Fatal("Expecting the done batch to be left as it was, got ", done.Transfers[0])
+	}
+
+	single := newTestBatch("atlas", "a")
+	single.Transfers[0].State = messages.Transfer_FAILED
+	single.Transfers[0].Parameters = done.Transfers[0].Parameters
+	single.Transfers[0].Info = done.Transfers[0].Info
+	if retry, _ = retryBatch(single); retry == nil || retry.GetID() == single.GetID() {
+		t.Fatal("Expecting the retry to get its own id, got ", retry)
+	}
+	done.Transfers[0].Retry, done.Transfers[4].Retry = 2, 2
+	if retry, _ = retryBatch(done); retry != nil {
+		t.Fatal("Not expecting a retry without attempts left, got ", retry)
+	}
+}
+
+// newMultisourceBatch returns a done multisource batch, where the first alternative
+// failed with the error, and the others are on hold
+func newMultisourceBatch(transferError *messages.TransferError, sources ...string) *messages.Batch {
+	batch := newTestBatch("atlas")
+	batch.State = messages.Batch_DONE
+	batch.Type = messages.Batch_MULTISOURCE
+	for i, source := range sources {
+		batch.Transfers = append(batch.Transfers, &messages.Transfer{
+			TransferId: source, Source: source + "/file", Destination: "gsiftp://dest/file", State: messages.Transfer_ON_HOLD,
+		})
+		if i == 0 {
+			batch.Transfers[0].State = messages.Transfer_FAILED
+			batch.Transfers[0].Info = &messages.TransferInfo{Error: transferError}
+		}
+	}
+	return batch
+}
+
+// A failed multisource batch must fail over to the next alternative, queued for its
+// source, until there are none left, or the failure would happen from any source.
+func TestFailoverBatch(t *testing.T) {
+	sourceError := &messages.TransferError{Scope: messages.TransferError_SOURCE, Description: "No such file"}
+	batch := newMultisourceBatch(sourceError, "gsiftp://a", "gsiftp://b", "gsiftp://c")
+	next := failoverBatch(batch)
+	if next == nil || next.State != messages.Batch_SUBMITTED || next.SourceSe != "gsiftp://b" || len(next.Transfers) != 2 {
+		t.Fatal("Expecting the batch to fail over to the second alternative, got ", next)
+	}
+	if next.Transfers[0].State != messages.Transfer_SUBMITTED || next.Transfers[1].TransferId != "gsiftp://c" {
+		t.Fatal("Expecting the alternatives left submitted, got ", next.Transfers)
+	}
+	if batch.Transfers[1].State != messages.Transfer_ON_HOLD {
+		t.Fatal("Expecting the done batch to be left as it was, got ", batch.Transfers[1])
+	}
+
+	next.State = messages.Batch_DONE
+	next.Transfers[0].State = messages.Transfer_FAILED
+	next.Transfers[0].Info = &messages.TransferInfo{Error: sourceError}
+	next.Transfers[1].State = messages.Transfer_ON_HOLD
+	last := failoverBatch(next)
+	if last == nil || last.SourceSe != "gsiftp://c" || len(last.Transfers) != 1 {
+		t.Fatal("Expecting the batch to fail over to the last alternative, got ", last)
+	}
+	last.State = messages.Batch_DONE
+	last.Transfers[0].State = messages.Transfer_FAILED
+	last.Transfers[0].Info = &messages.TransferInfo{Error: sourceError}
+	if again := failoverBatch(last); again != nil {
+		t.Fatal("Not expecting a failover without alternatives left, got ", again)
+	}
+
+	destError := &messages.TransferError{Scope: messages.TransferError_DESTINATION, Description: "Permission denied"}
+	if again := failoverBatch(newMultisourceBatch(destError, "gsiftp://a", "gsiftp://b")); again != nil {
+		t.Fatal("Not expecting a failover after an unrecoverable destination error, got ", again)
+	}
+	destError.Recoverable = true
+	if again := failoverBatch(newMultisourceBatch(destError, "gsiftp://a", "gsiftp://b")); again == nil {
+		t.Fatal("Expecting a failover after a recoverable error")
+	}
+}
+
+// The scheduler must submit the next alternative of a failed multisource batch, and
+// let the batch fail once they are exhausted, or the failure would happen from any source.
+func TestSchedulerFailover(t *testing.T) {
+	s, store, sender, _ := newTestScheduler(t)
+	sourceError := &messages.TransferError{Scope: messages.TransferError_SOURCE, Description: "No such file"}
+	if err := s.handle(newMultisourceBatch(sourceError, "gsiftp://a", "gsiftp://b")); err != nil {
+		t.Fatal(err)
+	}
+	if len(sender.sent) != 1 || sender.sent[0].SourceSe != "gsiftp://b" || sender.sent[0].Transfers[0].TransferId != "gsiftp://b" {
+		t.Fatal("Expecting the next alternative submitted, got ", sender.sent)
+	}
+
+	exhausted := newMultisourceBatch(sourceError, "gsiftp://b")
+	destError := &messages.TransferError{Scope: messages.TransferError_DESTINATION, Description: "Permission denied"}
+	for _, done := range []*messages.Batch{exhausted, newMultisourceBatch(destError, "gsiftp://a", "gsiftp://b")} {
+		sender.sent = nil
+		if err := s.handle(done); err != nil {
+			t.Fatal(err)
+		}
+		if len(sender.sent) != 0 {
+			t.Fatal("Expecting the batch to fail, got ", sender.sent)
+		}
+		if due, _ := store.ClaimRetries(time.Now().Add(time.Hour), time.Now().Add(2*time.Hour)); len(due) != 0 {
+			t.Fatal("Not expecting a retry of an unrecoverable error, got ", due)
+		}
+	}
+}
+
+// A multihop batch must be submitted again for each hop on hold, on the link of that hop,
+// and retried from the hop that failed.
+func TestMultihop(t *testing.T) {
+	batch := &messages.Batch{
+		Type:     messages.Batch_MULTIHOP,
+		State:    messages.Batch_DONE,
+		SourceSe: "gsiftp://a",
+		DestSe:   "gsiftp://b",
+		Transfers: []*messages.Transfer{
+			{TransferId: "1", Source: "gsiftp://a/file", Destination: "gsiftp://b/file", State: messages.Transfer_FINISHED},
+			{TransferId: "2", Source: "gsiftp://b/file", Destination: "gsiftp://c/file", State: messages.Transfer_ON_HOLD,
+				Parameters: &messages.TransferParameters{Retry: 1, RetryDelay: &duration.Duration{Seconds: 60}}},
+		},
+	}
+	if next := nextHopBatch(&messages.Batch{Transfers: batch.Transfers}); next != nil {
+		t.Fatal("Expecting only multihop batches to go on to the next hop, got ", next)
+	}
+
+	next := nextHopBatch(batch)
+	if next == nil || next.State != messages.Batch_SUBMITTED || next.SourceSe != "gsiftp://b" || next.DestSe != "gsiftp://c" {
+		t.Fatal("Expecting the batch submitted again for the second hop, got ", next)
+	}
+	if next.Transfers[0].State != messages.Transfer_FINISHED || next.Transfers[1].State != messages.Transfer_SUBMITTED {
+		t.Fatal("Expecting the first hop kept finished, and the second one submitted, got ", next.Transfers)
+	}
+	if batch.Transfers[1].State != messages.Transfer_ON_HOLD {
+		t.Fatal("Expecting the done batch to be left as it was, got ", batch.Transfers[1])
+	}
+
+	next.State = messages.Batch_DONE
+	next.Transfers[1].State = messages.Transfer_FAILED
+	next.Transfers[1].Info = &messages.TransferInfo{Error: &messages.TransferError{Recoverable: true}}
+	if again := nextHopBatch(next); again != nil {
+		t.Fatal("Not expecting a next hop after a failed one, got ", again)
+	}
+	retry, delay := retryBatch(next)
+	if retry == nil || delay != time.Minute || retry.SourceSe != "gsiftp://b" || len(retry.Transfers) != 2 {
+		t.Fatal("Expecting the batch retried from the second hop, got ", retry, delay)
+	}
+	if retry.Transfers[0].State != messages.Transfer_FINISHED || retry.Transfers[1].Retry != 1 || retry.Transfers[1].Info != nil {
+		t.Fatal("Expecting the second hop on its next attempt, got ", retry.Transfers)
+	}
+
+	retry.Transfers[1].State = messages.Transfer_FAILED
+	retry.Transfers[1].Info = next.Transfers[1].Info
+	if again, _ := retryHops(retry); again != nil {
+		t.Fatal("Not expecting a retry without attempts left, got ", again)
+	}
+	next.Transfers[1].Info.Error.Recoverable = false
+	if again, _ := retryHops(next); again != nil {
+		t.Fatal("Not expecting a retry of an unrecoverable error, got ", again)
+	}
+}
+
+// Transfers failed with a recoverable error must be resubmitted once due, with their
+// queue timeout counted from then.
+func TestSchedulerRetry(t *testing.T) {
+	s, store, sender, _ := newTestScheduler(t)
+	done := newTestBatch("atlas", "a", "b")
+	done.State = messages.Batch_DONE
+	for _, transfer := range done.Transfers {
+		transfer.State = messages.Transfer_FAILED
+		transfer.Parameters = &messages.TransferParameters{
+			Retry: 1, RetryDelay: &duration.Duration{Seconds: 60}, QueueTimeout: &duration.Duration{Seconds: 30},
+		}
+	}
+	done.Transfers[0].Info = &messages.TransferInfo{Error: &messages.TransferError{Recoverable: true}}
+	if err := s.handle(done); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.submitRetries(time.Now()); err != nil || len(sender.sent) != 0 {
+		t.Fatal("Not expecting a retry before the delay, got ", sender.sent, err)
+	}
+	if err := s.submitRetries(time.Now().Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if len(sender.sent) != 1 || len(sender.sent[0].Transfers) != 1 || sender.sent[0].Transfers[0].Retry != 1 {
+		t.Fatal("Expecting the recoverable transfer resubmitted, got ", sender.sent)
+	}
+	if deadline := sender.sent[0].GetDeadline(); deadline.Before(time.Now().Add(time.Minute)) {
+		t.Fatal("Expecting the queue timeout to start over when the retry is due, got ", deadline)
+	}
+	if due, _ := store.ClaimRetries(time.Now().Add(time.Hour), time.Now().Add(2*time.Hour)); len(due) != 0 {
+		t.Fatal("Expecting the retry to be forgotten, got ", due)
+	}
+}
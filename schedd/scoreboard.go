@@ -19,151 +19,251 @@ package main
 import (
 	log "github.com/Sirupsen/logrus"
 	"github.com/garyburd/redigo/redis"
+	"gitlab.cern.ch/flutter/echelon"
+	"gitlab.cern.ch/flutter/fts/config"
 	"gitlab.cern.ch/flutter/fts/messages"
+	"strconv"
 	"strings"
+	"time"
 )
 
 const (
 	// DefaultSlots is the number of parallel transfers by default
-	DefaultSlots = 2
+	DefaultSlots = config.ScoreboardDefaultSlots
 	// KeySeparator is used to join scoreboard keys together
-	KeySeparator = "#"
+	KeySeparator = config.ScoreboardKeySeparator
 
-	fieldCounter = "counter"
-	fieldMax     = "max"
+	fieldCounter = config.ScoreboardCounterField
+	fieldMax     = config.ScoreboardMaxField
+	fieldStreams = config.ScoreboardStreamsField
+	fieldBreaker = config.ScoreboardBreakerField
 )
 
 type (
 	// Scoreboard implements accounting on the number of transfer running
-	// for a given source/destination/pair
-	Scoreboard struct {
-		pool *redis.Pool
-	}
+	// for a given source/destination/pair, and decides which queues can schedule
+	Scoreboard interface {
+		echelon.InfoProvider
 
-	//ts.DestSe, ts.Vo, ts.Activity, ts.SourceSe
-)
+		// GetStreams returns the number of streams per transfer for the link, 0 if not set
+		GetStreams(source, destination string) (uint32, error)
+		// ConsumeSlot takes the slots of the batch, with a lease, or fails with ErrNoSlots.
+		// Unless empty, the token must be that of the current leader, or ErrFenced is returned.
+		ConsumeSlot(batch *messages.Batch, token string) error
+		// ReleaseSlot gives back the slots of the batch, if it still holds a lease
+		ReleaseSlot(batch *messages.Batch) error
+		// RenewBatch renews the lease of the batch, and returns false if there is none
+		RenewBatch(batch *messages.Batch) (bool, error)
+		// RenewTransfer renews the lease of the batch running the transfer
+		RenewTransfer(transferID string) (bool, error)
+		// ReapLeases releases the leases expired by now, and returns their batch ids
+		ReapLeases(now time.Time) ([]string, error)
+		// Reconcile rebuilds the counters from the live leases, and returns how many
+		Reconcile(now time.Time) (int, error)
 
-// GetWeight returns the weight of the given route
-func (info *Scoreboard) GetWeight(route []string) float32 {
-	// TODO: Access config
-	return 1.0
-}
+		// GetBatchBan returns the ban stopping the batch, or nil if there is none
+		GetBatchBan(batch *messages.Batch) (*Ban, error)
+		// SetBan adds, or replaces, a ban
+		SetBan(ban *Ban) error
+		// RemoveBan lifts a ban, and returns false if there was none
+		RemoveBan(kind, name string) (bool, error)
+		// ListBans returns the bans in place
+		ListBans() ([]Ban, error)
 
-func availableSlots(conn redis.Conn, keys ...string) (bool, error) {
-	key := strings.Join(keys, KeySeparator)
-	l := log.WithField("key", key)
+		// PauseQueue stops scheduling from the queue, and returns false if already paused
+		PauseQueue(path []string) (bool, error)
+		// ResumeQueue resumes scheduling from the queue, and returns false if not paused
+		ResumeQueue(path []string) (bool, error)
+		// ListPaused returns the paths of the paused queues
+		ListPaused() ([][]string, error)
 
-	values, err := redis.Values(conn.Do("HMGET", key, fieldCounter, fieldMax))
-	if err != nil {
-		return false, err
+		// ExplainRoute tells what each level of the path of a queue is waiting for
+		ExplainRoute(path []string) ([]LevelCheck, error)
+		// GetEntries returns the entries of the given kind, or all if empty, sorted by key
+		GetEntries(kind string) ([]ScoreboardEntry, error)
+		// SetMax sets the maximum number of running transfers of a key, only if already
+		// in the scoreboard
+		SetMax(key string, max int) error
 	}
 
-	var count, max int
-	if _, err := redis.Scan(values, &count, &max); err != nil {
-		return false, err
+	// RedisScoreboard keeps the scoreboard in Redis, so it can be shared by several
+	// schedulers, and the optimizer
+	RedisScoreboard struct {
+		pool   *redis.Pool
+		limits config.Limits
+		shares config.Shares
+		leases LeaseParams
+	}
+)
+
+// getShareTable returns the share table for the owner, or the wildcard one.
+// Tables stored in Redis take precedence over those from the configuration.
+func (info *RedisScoreboard) getShareTable(conn redis.Conn, kind, owner string) (config.ShareTable, error) {
+	for _, candidate := range []string{strings.ToLower(owner), config.ShareWildcard} {
+		values, err := redis.StringMap(conn.Do("HGETALL", config.ShareKey(kind, candidate)))
+		if err != nil {
+			return nil, err
+		}
+		if len(values) > 0 {
+			table := make(config.ShareTable, len(values))
+			for name, value := range values {
+				weight, err := strconv.ParseFloat(value, 32)
+				if err != nil {
+					return nil, err
+				}
+				table[strings.ToLower(name)] = float32(weight)
+			}
+			return table, nil
+		}
+		if table, ok := info.shares[kind][candidate]; ok {
+			return table, nil
+		}
 	}
+	return nil, nil
+}
 
-	if max == 0 {
-		l.Debug("No entry, assuming there are available slots")
-		_, err := conn.Do("HSET", key, fieldMax, DefaultSlots)
-		return true, err
+// shareOwner returns the kind of share table weighting the route within its parent, and
+// its owner: the destination for the VOs, or the VO for the activities
+func shareOwner(route []string) (string, string, bool) {
+	switch len(route) {
+	// Destination/Vo
+	case 2:
+		return config.ShareVo, route[0], true
+	// Destination/Vo/Activity
+	case 3:
+		return config.ShareActivity, route[1], true
 	}
-	l.WithFields(log.Fields{"slots": max, "count": count}).Debug("Available slots")
-	return count < max, nil
+	return "", "", false
 }
 
-// IsThereAvailableSlots returns true if there can be a new transfer for the given route
-func (info *Scoreboard) IsThereAvailableSlots(route []string) (bool, error) {
+// GetWeight returns the weight of the given route within its parent: the weight of the VO
+// for the destination, or the weight of the activity for the VO
+func (info *RedisScoreboard) GetWeight(route []string) float32 {
+	kind, owner, ok := shareOwner(route)
+	if !ok {
+		return 1.0
+	}
+
 	conn := info.pool.Get()
 	defer conn.Close()
 
+	table, err := info.getShareTable(conn, kind, owner)
+	if err != nil {
+		log.WithError(err).WithField("route", route).Error("Failed to get the share table")
+		return 1.0
+	}
+	return table.Weight(route[len(route)-1])
+}
+
+// routeKeys returns the scoreboard keys that limit the given route
+func routeKeys(route []string) []slotKey {
 	switch len(route) {
-	// Root node, overall FTS, so there are slots
-	case 0:
-		return true, nil
 	// Destination storage
 	case 1:
-		return availableSlots(conn, route[0])
-	// Destination/Vo, we do not have slots per vo, so always available
+		return []slotKey{{key: route[0]}}
+	// Destination/Vo, optional cap per vo
 	case 2:
-		return true, nil
-	// Destination/Vo/Activity, still no cap per activity
+		return []slotKey{{key: strings.Join(route[0:2], KeySeparator), optional: true}}
+	// Destination/Vo/Activity, optional cap per activity
 	case 3:
-		return true, nil
+		return []slotKey{{key: strings.Join(route[0:3], KeySeparator), optional: true}}
 	// Destination/Vo/Activity/Source, we get two caps: link and source
 	case 4:
-		if forSource, err := availableSlots(conn, route[3]); err != nil {
-			return false, err
-		} else if forLink, err := availableSlots(conn, route[3], route[0]); err != nil {
-			return false, err
-		} else {
-			return forSource && forLink, nil
-		}
+		return []slotKey{{key: route[3]}, {key: route[3] + KeySeparator + route[0]}}
 	}
-	return true, nil
+	// Root node, overall FTS, so there are slots
+	return nil
 }
 
-func increaseActiveCount(conn redis.Conn, keys ...string) error {
-	key := strings.Join(keys, KeySeparator)
-	l := log.WithField("key", key)
-
-	newCount, err := redis.Int(conn.Do("HINCRBY", key, fieldCounter, 1))
-	if err != nil {
-		return err
+// batchKeys returns all the scoreboard keys accounting the batch
+func batchKeys(batch *messages.Batch) []slotKey {
+	return []slotKey{
+		{key: batch.SourceSe},
+		{key: batch.DestSe},
+		{key: batch.SourceSe + KeySeparator + batch.DestSe},
+		{key: strings.Join([]string{batch.DestSe, batch.Vo}, KeySeparator), optional: true},
+		{key: strings.Join([]string{batch.DestSe, batch.Vo, batch.Activity}, KeySeparator), optional: true},
 	}
-
-	l.WithField("count", newCount).Debug("Increment active count")
-	return nil
 }
 
-// ConsumeSlot reduces by one the number of available slots for the source, destination,
-// and link.
-func (info *Scoreboard) ConsumeSlot(batch *messages.Batch) error {
+// IsThereAvailableSlots returns true if there can be a new transfer for the given route,
+// which must not be banned nor paused
+func (info *RedisScoreboard) IsThereAvailableSlots(route []string) (bool, error) {
+	keys := routeKeys(route)
+	if len(keys) == 0 {
+		return true, nil
+	}
+
 	conn := info.pool.Get()
 	defer conn.Close()
-	if err := increaseActiveCount(conn, batch.SourceSe); err != nil {
-		return err
-	}
-	if err := increaseActiveCount(conn, batch.DestSe); err != nil {
-		return err
+
+	// Banned queues stay, but are skipped
+	if ban, err := getBan(conn, routeBans(route)); err != nil {
+		return false, err
+	} else if ban != nil {
+		log.WithField("route", route).Debugf("Banned %s %s", ban.Kind, ban.Name)
+		return false, nil
 	}
-	if err := increaseActiveCount(conn, batch.SourceSe, batch.DestSe); err != nil {
-		return err
+	if paused, err := isPaused(conn, route); err != nil {
+		return false, err
+	} else if paused {
+		log.WithField("route", route).Debug("Paused")
+		return false, nil
 	}
-	return nil
-}
-
-func decreaseActiveCount(conn redis.Conn, keys ...string) error {
-	key := strings.Join(keys, KeySeparator)
-	l := log.WithField("key", key)
 
-	newCount, err := redis.Int(conn.Do("HINCRBY", key, fieldCounter, -1))
+	full, err := info.runSlotScript(conn, slotCheck, nil, keys)
 	if err != nil {
-		return err
+		return false, err
 	}
-	if newCount < 0 {
-		l.Warn("New active counter below 0, reset value")
-		newCount = 0
-		conn.Do("HSET", key, fieldCounter, newCount)
+	if full != "" {
+		log.WithField("key", full).Debug("No available slots")
 	}
-
-	l.WithField("count", newCount).Debug("Decrement active count")
-	return nil
+	return full == "", nil
 }
 
-// ReleaseSlot increases by one the number of available slots for the source, destination,
-// and link.
-func (info *Scoreboard) ReleaseSlot(batch *messages.Batch) error {
+// GetStreams returns the number of streams per transfer decided by the optimizer for the link,
+// or 0 if there is none
+func (info *RedisScoreboard) GetStreams(source, destination string) (uint32, error) {
 	conn := info.pool.Get()
 	defer conn.Close()
-	if err := decreaseActiveCount(conn, batch.SourceSe); err != nil {
-		return err
-	}
-	if err := decreaseActiveCount(conn, batch.DestSe); err != nil {
-		return err
+
+	streams, err := redis.Uint64(conn.Do("HGET", strings.Join([]string{source, destination}, KeySeparator), fieldStreams))
+	if err == redis.ErrNil {
+		return 0, nil
 	}
-	if err := decreaseActiveCount(conn, batch.SourceSe, batch.DestSe); err != nil {
+	return uint32(streams), err
+}
+
+// ConsumeSlot reduces by one the number of available slots for the source, destination,
+// link, and vo and activity within the destination. The check and the increment happen
+// atomically, so several schedulers can share the scoreboard. ErrNoSlots is returned if
+// any of them is full, and then nothing is consumed.
+// The slots are held by a lease on the batch, released when done, or when it expires.
+// Unless empty, the token must be that of the current leader, or ErrFenced is returned.
+func (info *RedisScoreboard) ConsumeSlot(batch *messages.Batch, token string) error {
+	conn := info.pool.Get()
+	defer conn.Close()
+
+	keys := batchKeys(batch)
+	l := info.leases.newLease(batch, keys)
+	l.fence = token
+	full, err := info.runSlotScript(conn, slotConsume, l, keys)
+	if e, ok := err.(redis.Error); ok && strings.Contains(e.Error(), "FENCED") {
+		return ErrFenced
+	} else if err != nil {
 		return err
+	} else if full != "" {
+		return &ErrNoSlots{Key: full}
 	}
 	return nil
 }
+
+// ReleaseSlot increases by one the number of available slots for the source, destination,
+// link, and vo and activity within the destination. Nothing is released if the batch
+// does not hold a lease, so it is safe to call more than once.
+func (info *RedisScoreboard) ReleaseSlot(batch *messages.Batch) error {
+	conn := info.pool.Get()
+	defer conn.Close()
+
+	return info.releaseLease(conn, batch.GetID())
+}
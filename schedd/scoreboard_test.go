@@ -0,0 +1,416 @@
+/*
+ * Copyright (c) CERN 2016
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"github.com/alicebob/miniredis/v2"
+	"github.com/golang/protobuf/ptypes/duration"
+	"gitlab.cern.ch/flutter/fts/config"
+	"gitlab.cern.ch/flutter/fts/messages"
+	"testing"
+	"time"
+)
+
+const (
+	testSource = "gsiftp://source.example.com"
+	testDest   = "gsiftp://dest.example.com"
+	testLink   = testSource + KeySeparator + testDest
+)
+
+var testLeases = LeaseParams{
+	Timeout:  time.Hour,
+	Grace:    10 * time.Minute,
+	Interval: time.Minute,
+}
+
+func newTestBatch(vo string, transferIds ...string) *messages.Batch {
+	batch := &messages.Batch{
+		Submitted: messages.Now(),
+		State:     messages.Batch_SUBMITTED,
+		SourceSe:  testSource,
+		DestSe:    testDest,
+		Vo:        vo,
+		Activity:  "default",
+		CredId:    "credentials",
+	}
+	for _, id := range transferIds {
+		batch.Transfers = append(batch.Transfers, &messages.Transfer{TransferId: id, JobId: "job-" + id})
+	}
+	return batch
+}
+
+// testBackend is a store and scoreboard pair, from one of the backends
+type testBackend struct {
+	name       string
+	store      Store
+	scoreboard Scoreboard
+}
+
+// newTestBackends returns both backends, Redis running on a fake server
+func newTestBackends(t *testing.T, limits config.Limits) []testBackend {
+	params := Params{Limits: limits, Leases: testLeases}
+	redisStore, redisScoreboard := NewRedisBackend(miniredis.RunT(t).Addr(), params)
+	memoryStore, memoryScoreboard := NewMemoryBackend(params)
+	return []testBackend{
+		{name: BackendRedis, store: redisStore, scoreboard: redisScoreboard},
+		{name: BackendMemory, store: memoryStore, scoreboard: memoryScoreboard},
+	}
+}
+
+// setCounter makes the counter of the key drift
+func setCounter(t *testing.T, scoreboard Scoreboard, key string, n int) {
+	switch scoreboard := scoreboard.(type) {
+	case *MemoryScoreboard:
+		scoreboard.counters[key] = n
+	case *RedisScoreboard:
+		conn := scoreboard.pool.Get()
+		defer conn.Close()
+		if _, err := conn.Do("HSET", key, fieldCounter, n); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// counter returns the number of slots taken on the key
+func counter(t *testing.T, scoreboard Scoreboard, key string) int {
+	entries, err := scoreboard.GetEntries("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if entry.Key == key {
+			return entry.Counter
+		}
+	}
+	return 0
+}
+
+// Slots must be taken and given back once per batch, and a full key must stop both
+// the queue and the batches consuming from it, without consuming from the other keys.
+func TestScoreboardSlots(t *testing.T) {
+	for _, backend := range newTestBackends(t, config.Limits{
+		testSource: config.Limit{Storage: testSource, Fixed: 10},
+		testDest:   config.Limit{Storage: testDest, Fixed: 10},
+		testLink:   config.Limit{Source: testSource, Destination: testDest, Fixed: 2},
+	}) {
+		scoreboard := backend.scoreboard
+		first, second, third := newTestBatch("atlas", "a"), newTestBatch("atlas", "b"), newTestBatch("atlas", "c")
+		path := first.GetPath()
+
+		for _, batch := range []*messages.Batch{first, first, second} {
+			if err := scoreboard.ConsumeSlot(batch, ""); err != nil {
+				t.Fatal(backend.name, ": ", err)
+			}
+		}
+		if n := counter(t, scoreboard, testLink); n != 2 {
+			t.Fatal(backend.name, ": Expecting 2 slots taken on the link, got ", n)
+		}
+		err := scoreboard.ConsumeSlot(third, "")
+		if noSlots, ok := err.(*ErrNoSlots); !ok || noSlots.Key != testLink {
+			t.Fatal(backend.name, ": Expecting the link to be full, got ", err)
+		}
+		if n := counter(t, scoreboard, testSource); n != 2 {
+			t.Fatal(backend.name, ": Expecting nothing consumed from the source, got ", n)
+		}
+		if available, _ := scoreboard.IsThereAvailableSlots(path); available {
+			t.Fatal(backend.name, ": Expecting no available slots for the source")
+		}
+		if available, _ := scoreboard.IsThereAvailableSlots(path[:1]); !available {
+			t.Fatal(backend.name, ": Expecting available slots for the destination")
+		}
+
+		scoreboard.ReleaseSlot(first)
+		scoreboard.ReleaseSlot(first)
+		if n := counter(t, scoreboard, testLink); n != 1 {
+			t.Fatal(backend.name, ": Expecting 1 slot taken on the link, got ", n)
+		}
+		if available, _ := scoreboard.IsThereAvailableSlots(path); !available {
+			t.Fatal(backend.name, ": Expecting available slots once released")
+		}
+	}
+}
+
+// The maximum set at runtime must be bound by the static limits, the same for both backends.
+func TestScoreboardSlotLimits(t *testing.T) {
+	for _, backend := range newTestBackends(t, config.Limits{
+		testSource: config.Limit{Storage: testSource, Fixed: 10},
+		testDest:   config.Limit{Storage: testDest, Fixed: 10},
+		testLink:   config.Limit{Source: testSource, Destination: testDest, Min: 1, Max: 3},
+	}) {
+		scoreboard := backend.scoreboard
+		for _, id := range []string{"a", "b", "c"} {
+			if err := scoreboard.ConsumeSlot(newTestBatch("atlas", id), ""); err != nil {
+				t.Fatal(backend.name, ": ", err)
+			}
+			scoreboard.SetMax(testLink, 5)
+		}
+		err := scoreboard.ConsumeSlot(newTestBatch("atlas", "d"), "")
+		if noSlots, ok := err.(*ErrNoSlots); !ok || noSlots.Key != testLink {
+			t.Fatal(backend.name, ": Expecting the maximum to be bound by the static limits, got ", err)
+		}
+
+		scoreboard.SetMax(testLink, 0)
+		for _, id := range []string{"a", "b", "c"} {
+			scoreboard.ReleaseSlot(newTestBatch("atlas", id))
+		}
+		if err = scoreboard.ConsumeSlot(newTestBatch("atlas", "e"), ""); err != nil {
+			t.Fatal(backend.name, ": Expecting the default slots once the maximum is cleared, got ", err)
+		}
+	}
+}
+
+// The slot script must follow the circuit breakers.
+func TestRedisBreakers(t *testing.T) {
+	server := miniredis.RunT(t)
+	_, scoreboard := NewRedisBackend(server.Addr(), Params{
+		Limits: config.Limits{
+			testSource: config.Limit{Storage: testSource, Fixed: 10},
+			testDest:   config.Limit{Storage: testDest, Fixed: 10},
+		},
+		Leases: testLeases,
+	})
+
+	server.HSet(testDest, fieldBreaker, config.BreakerOpen)
+	if available, _ := scoreboard.IsThereAvailableSlots([]string{testDest}); available {
+		t.Fatal("Expecting no slots while the breaker is open")
+	}
+	server.HSet(testDest, fieldBreaker, config.BreakerProbe)
+	if err := scoreboard.ConsumeSlot(newTestBatch("atlas", "e"), ""); err != nil {
+		t.Fatal("Expecting a probe to go through, got ", err)
+	}
+	err := scoreboard.ConsumeSlot(newTestBatch("atlas", "f"), "")
+	if noSlots, ok := err.(*ErrNoSlots); !ok || noSlots.Key != testDest {
+		t.Fatal("Expecting a single probe, got ", err)
+	}
+}
+
+// VOs and activities are not limited, unless capped by the static limits or by a
+// maximum set at runtime.
+func TestScoreboardOptionalCaps(t *testing.T) {
+	voKey := testDest + KeySeparator + "atlas"
+	for _, backend := range newTestBackends(t, config.Limits{
+		testSource: config.Limit{Storage: testSource, Fixed: 10},
+		testDest:   config.Limit{Storage: testDest, Fixed: 10},
+		testLink:   config.Limit{Source: testSource, Destination: testDest, Fixed: 10},
+		voKey:      config.Limit{Storage: testDest, Vo: "atlas", Max: 1},
+	}) {
+		scoreboard := backend.scoreboard
+		if err := scoreboard.ConsumeSlot(newTestBatch("atlas", "a"), ""); err != nil {
+			t.Fatal(backend.name, ": ", err)
+		}
+		err := scoreboard.ConsumeSlot(newTestBatch("atlas", "b"), "")
+		if noSlots, ok := err.(*ErrNoSlots); !ok || noSlots.Key != voKey {
+			t.Fatal(backend.name, ": Expecting the VO to be full, got ", err)
+		}
+		for _, id := range []string{"c", "d", "e"} {
+			if err := scoreboard.ConsumeSlot(newTestBatch("cms", id), ""); err != nil {
+				t.Fatal(backend.name, ": Expecting no cap for the VO, got ", err)
+			}
+		}
+
+		if err = scoreboard.SetMax(testDest+KeySeparator+"cms", 3); err != nil {
+			t.Fatal(backend.name, ": ", err)
+		}
+		if err := scoreboard.ConsumeSlot(newTestBatch("cms", "f"), ""); err == nil {
+			t.Fatal(backend.name, ": Expecting the VO to be full once capped")
+		}
+		entries, _ := scoreboard.GetEntries(EntryVo)
+		if len(entries) != 2 || entries[1].Counter != 3 || entries[1].Max == nil || *entries[1].Max != 3 {
+			t.Fatal(backend.name, ": Expecting two VOs, with cms capped, got ", entries)
+		}
+	}
+}
+
+// Leases must last for the longest timeout of their transfers, and be renewed by each
+// one for its own timeout. Those expired must be released, and left out when reconciling.
+func TestScoreboardLeases(t *testing.T) {
+	running := newTestBatch("atlas", "a", "b")
+	running.Transfers[0].Parameters = &messages.TransferParameters{
+		Timeout: &duration.Duration{Seconds: 3 * 3600},
+	}
+	l := testLeases.newLease(running, batchKeys(running))
+	if l.TTL != 3*3600+600 || l.TransferTTL["b"] != 3600+600 || len(l.TransferTTL) != 1 {
+		t.Fatal("Expecting the lease to last for the longest timeout, got ", l.TTL, l.TransferTTL)
+	}
+
+	for _, backend := range newTestBackends(t, nil) {
+		scoreboard := backend.scoreboard
+		lost := newTestBatch("atlas", "c")
+		scoreboard.ConsumeSlot(running, "")
+		scoreboard.ConsumeSlot(lost, "")
+
+		now := time.Now()
+		if expired, _ := scoreboard.ReapLeases(now.Add(time.Hour)); len(expired) != 0 {
+			t.Fatal(backend.name, ": Not expecting expired leases within the grace period, got ", expired)
+		}
+		expired, _ := scoreboard.ReapLeases(now.Add(2 * time.Hour))
+		if len(expired) != 1 || expired[0] != lost.GetID() {
+			t.Fatal(backend.name, ": Expecting the lost batch to expire, got ", expired)
+		}
+		if renewed, _ := scoreboard.RenewBatch(lost); renewed {
+			t.Fatal(backend.name, ": Not expecting a lease once expired")
+		}
+		if renewed, _ := scoreboard.RenewTransfer("unknown"); renewed {
+			t.Fatal(backend.name, ": Not expecting a lease for an unknown transfer")
+		}
+
+		if renewed, _ := scoreboard.RenewTransfer("b"); !renewed {
+			t.Fatal(backend.name, ": Expecting the lease to be renewed by the transfer")
+		}
+		expired, _ = scoreboard.ReapLeases(now.Add(80 * time.Minute))
+		if len(expired) != 1 || expired[0] != running.GetID() {
+			t.Fatal(backend.name, ": Expecting the lease to expire with the timeout of the transfer, got ", expired)
+		}
+
+		scoreboard.ConsumeSlot(newTestBatch("atlas", "d"), "")
+		setCounter(t, scoreboard, testDest, 10)
+		if live, _ := scoreboard.Reconcile(now); live != 1 {
+			t.Fatal(backend.name, ": Expecting 1 live lease, got ", live)
+		}
+		if n := counter(t, scoreboard, testDest); n != 1 {
+			t.Fatal(backend.name, ": Expecting the counter rebuilt from the leases, got ", n)
+		}
+	}
+}
+
+// Banned and paused queues must be skipped, and explained.
+func TestScoreboardBans(t *testing.T) {
+	for _, backend := range newTestBackends(t, nil) {
+		scoreboard := backend.scoreboard
+		batch := newTestBatch("atlas", "a")
+		path := batch.GetPath()
+
+		scoreboard.SetBan(&Ban{Kind: BanStorage, Name: testSource})
+		if available, _ := scoreboard.IsThereAvailableSlots(path); available {
+			t.Fatal(backend.name, ": Expecting the queue of a banned source to be skipped")
+		}
+		if ban, _ := scoreboard.GetBatchBan(batch); ban == nil || ban.Name != testSource {
+			t.Fatal(backend.name, ": Expecting the batch to be banned, got ", ban)
+		}
+		if err := scoreboard.SetBan(&Ban{Kind: "planet", Name: "earth"}); err == nil {
+			t.Fatal(backend.name, ": Expecting an unknown kind of ban to be rejected")
+		}
+		if removed, _ := scoreboard.RemoveBan(BanStorage, testSource); !removed {
+			t.Fatal(backend.name, ": Expecting the ban to be lifted")
+		}
+		if bans, _ := scoreboard.ListBans(); len(bans) != 0 {
+			t.Fatal(backend.name, ": Expecting no bans, got ", bans)
+		}
+
+		scoreboard.PauseQueue(path[:2])
+		if available, _ := scoreboard.IsThereAvailableSlots(path[:2]); available {
+			t.Fatal(backend.name, ": Expecting the paused queue to be skipped")
+		}
+		levels, _ := scoreboard.ExplainRoute(path)
+		if len(levels) != 4 || levels[0].Blocked || !levels[1].Paused || !levels[1].Blocked {
+			t.Fatal(backend.name, ": Expecting the VO level to be paused, got ", levels)
+		}
+		if resumed, _ := scoreboard.ResumeQueue(path[:2]); !resumed {
+			t.Fatal(backend.name, ": Expecting the queue to be resumed")
+		}
+		if paused, _ := scoreboard.ListPaused(); len(paused) != 0 {
+			t.Fatal(backend.name, ": Expecting no paused queues, got ", paused)
+		}
+	}
+}
+
+// Only the current leader can consume slots.
+func TestScoreboardFencing(t *testing.T) {
+	for _, backend := range newTestBackends(t, nil) {
+		store, scoreboard := backend.store, backend.scoreboard
+		token, _ := store.Elect("", "schedd", time.Minute)
+		if token == "" {
+			t.Fatal(backend.name, ": Expecting to become the leader")
+		}
+		if other, _ := store.Elect("", "other", time.Minute); other != "" {
+			t.Fatal(backend.name, ": Not expecting a second leader, got ", other)
+		}
+
+		if err := scoreboard.ConsumeSlot(newTestBatch("atlas", "a"), "stale"); err != ErrFenced {
+			t.Fatal(backend.name, ": Expecting a stale leader to be fenced, got ", err)
+		}
+		if err := scoreboard.ConsumeSlot(newTestBatch("atlas", "a"), token); err != nil {
+			t.Fatal(backend.name, ": ", err)
+		}
+		store.Resign(token)
+		if err := scoreboard.ConsumeSlot(newTestBatch("atlas", "b"), token); err != ErrFenced {
+			t.Fatal(backend.name, ": Expecting to be fenced after resigning, got ", err)
+		}
+	}
+}
+
+// Batches to take out of the queue must be kept until forgotten.
+func TestStoreUnqueue(t *testing.T) {
+	for _, backend := range newTestBackends(t, nil) {
+		if err := backend.store.Unqueue("a", "b"); err != nil {
+			t.Fatal(backend.name, ": ", err)
+		}
+		backend.store.Unqueue("a")
+		if ids, _ := backend.store.Unqueued(); len(ids) != 2 {
+			t.Fatal(backend.name, ": Expecting two batches to take out of the queue, got ", ids)
+		}
+		backend.store.ForgetUnqueued([]string{"a"})
+		if ids, _ := backend.store.Unqueued(); len(ids) != 1 || ids[0] != "b" {
+			t.Fatal(backend.name, ": Expecting the other batch to be kept, got ", ids)
+		}
+	}
+}
+
+// Claimed retries must be due again if not forgotten, so they are not lost.
+func TestStoreRetries(t *testing.T) {
+	now := time.Now()
+	for _, backend := range newTestBackends(t, nil) {
+		if err := backend.store.ScheduleRetry("a", []byte("data"), now); err != nil {
+			t.Fatal(backend.name, ": ", err)
+		}
+		if due, err := backend.store.ClaimRetries(now, now.Add(time.Minute)); err != nil || string(due["a"]) != "data" {
+			t.Fatal(backend.name, ": Expecting the retry to be claimed, got ", due, err)
+		}
+		if due, _ := backend.store.ClaimRetries(now, now.Add(time.Minute)); len(due) != 0 {
+			t.Fatal(backend.name, ": Not expecting a claimed retry to be claimed again, got ", due)
+		}
+		if due, _ := backend.store.ClaimRetries(now.Add(time.Minute), now.Add(2*time.Minute)); len(due) != 1 {
+			t.Fatal(backend.name, ": Expecting the retry to be due again, got ", due)
+		}
+		if err := backend.store.ForgetRetry("a"); err != nil {
+			t.Fatal(backend.name, ": ", err)
+		}
+		if due, _ := backend.store.ClaimRetries(now.Add(time.Hour), now.Add(2*time.Hour)); len(due) != 0 {
+			t.Fatal(backend.name, ": Expecting the retry to be forgotten, got ", due)
+		}
+	}
+}
+
+// The queued batch of each transfer must be known until the transfer is claimed.
+func TestStoreQueuedIn(t *testing.T) {
+	for _, backend := range newTestBackends(t, nil) {
+		batch := newTestBatch("atlas", "a", "b")
+		if err := backend.store.Enqueue(batch); err != nil {
+			t.Fatal(backend.name, ": ", err)
+		}
+		if ids, err := backend.store.QueuedIn([]string{"a", "b", "c"}); err != nil || len(ids) != 3 ||
+			ids[0] != batch.GetID() || ids[1] != batch.GetID() || ids[2] != "" {
+			t.Fatal(backend.name, ": Expecting the batch of the queued transfers, got ", ids, err)
+		}
+		if claimed, _ := backend.store.ClaimTransfers([]string{"a"}); len(claimed) != 1 || !claimed[0] {
+			t.Fatal(backend.name, ": Expecting the transfer to be claimed, got ", claimed)
+		}
+		if ids, _ := backend.store.QueuedIn([]string{"a", "b"}); ids[0] != "" || ids[1] != batch.GetID() {
+			t.Fatal(backend.name, ": Expecting the claimed transfer no longer queued, got ", ids)
+		}
+	}
+}
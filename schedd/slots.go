@@ -0,0 +1,188 @@
+/*
+ * Copyright (c) CERN 2016
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"gitlab.cern.ch/flutter/fts/config"
+	"time"
+)
+
+// Modes of the slot script
+const (
+	slotCheck   = "check"
+	slotConsume = "consume"
+	slotRelease = "release"
+	slotLimits  = "limits"
+)
+
+type (
+	// slotKey is a scoreboard key limiting a transfer. Optional keys have no
+	// limit unless one is set, the others use the default number of slots.
+	slotKey struct {
+		key      string
+		optional bool
+	}
+
+	// ErrNoSlots is returned when a slot can not be consumed because one of the keys is full
+	ErrNoSlots struct {
+		Key string
+	}
+)
+
+// Error implements the error interface
+func (e *ErrNoSlots) Error() string {
+	return fmt.Sprint("No slots available for ", e.Key)
+}
+
+// slotScript checks, consumes or releases slots for a set of keys in one go, so the
+// accounting is consistent even with several schedulers sharing the scoreboard.
+// KEYS are the scoreboard hashes. ARGV[1] is the mode, ARGV[2] to ARGV[5] the batch id,
+// expiration, data and fencing token of the lease, followed by the fallback, minimum and
+// maximum number of slots for each key, from the static limits (0 meaning none).
+// It returns the first key without slots, or an empty string, except for the limits mode,
+// which returns the maximum in effect for each key, 0 meaning none, followed by 1 if it
+// is full or 0 otherwise. Nothing is consumed if any key is full, or if the batch already
+// holds a lease. Only a live lease is released.
+// A lease with a fencing token is only consumed if it is still that of the leader, and
+// a FENCED error is returned otherwise.
+var slotScript = redis.NewScript(-1, fmt.Sprintf(`
+local counterField, maxField, breakerField = %q, %q, %q
+local breakerOpen, breakerProbe = %q, %q
+local leasesKey, leaseDataKey, leaseTransfersKey, leaderKey = %q, %q, %q, %q
+local mode, leaseId, expiration, leaseData, fence = ARGV[1], ARGV[2], ARGV[3], ARGV[4], ARGV[5]
+
+if mode == "release" then
+	if redis.call("ZREM", leasesKey, leaseId) == 0 then
+		return ""
+	end
+	redis.call("HDEL", leaseDataKey, leaseId)
+	for _, transfer in ipairs(cjson.decode(leaseData).transfers) do
+		redis.call("HDEL", leaseTransfersKey, transfer)
+	end
+	for _, key in ipairs(KEYS) do
+		if redis.call("HINCRBY", key, counterField, -1) < 0 then
+			redis.call("HSET", key, counterField, 0)
+		end
+	end
+	return ""
+end
+
+if mode == "consume" and fence ~= "" and redis.call("GET", leaderKey) ~= fence then
+	return redis.error_reply("FENCED Not the leader")
+end
+
+local limits = {}
+for i, key in ipairs(KEYS) do
+	local values = redis.call("HMGET", key, counterField, maxField, breakerField)
+	local count = tonumber(values[1]) or 0
+	local max = tonumber(values[2]) or 0
+	local n = 6 + (i - 1) * 3
+	if max == 0 then
+		max = tonumber(ARGV[n])
+	end
+	local lower, upper = tonumber(ARGV[n + 1]), tonumber(ARGV[n + 2])
+	if lower > 0 and max < lower then
+		max = lower
+	end
+	if upper > 0 and max > upper then
+		max = upper
+	end
+	if values[3] == breakerProbe then
+		max = 1
+	end
+
+	local full = values[3] == breakerOpen or (max > 0 and count >= max)
+	if mode == "limits" then
+		table.insert(limits, max)
+		table.insert(limits, full and 1 or 0)
+	elseif full then
+		return key
+	end
+end
+if mode == "limits" then
+	return limits
+end
+
+if mode == "consume" and redis.call("ZSCORE", leasesKey, leaseId) == false then
+	for _, key in ipairs(KEYS) do
+		redis.call("HINCRBY", key, counterField, 1)
+	end
+	redis.call("ZADD", leasesKey, expiration, leaseId)
+	redis.call("HSET", leaseDataKey, leaseId, leaseData)
+	for _, transfer in ipairs(cjson.decode(leaseData).transfers) do
+		redis.call("HSET", leaseTransfersKey, transfer, leaseId)
+	end
+end
+return ""
+`, fieldCounter, fieldMax, fieldBreaker, config.BreakerOpen, config.BreakerProbe,
+	LeasesKey, LeaseDataKey, LeaseTransfersKey, LeaderKey))
+
+// slotArgs returns the arguments of the slot script for the given keys. The lease is
+// only needed to consume or release.
+func (info *RedisScoreboard) slotArgs(mode string, l *lease, keys []slotKey) ([]interface{}, error) {
+	args := make([]interface{}, 0, 6+len(keys)*4)
+	args = append(args, len(keys))
+	for _, k := range keys {
+		args = append(args, k.key)
+	}
+	if l != nil {
+		data, err := l.encode()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, mode, l.id, l.expiration(time.Now(), ""), data, l.fence)
+	} else {
+		args = append(args, mode, "", 0, "", "")
+	}
+	for _, k := range keys {
+		fallback := info.limits.Initial(k.key)
+		if k.optional {
+			fallback = info.limits.Cap(k.key)
+		}
+		min, max := info.limits.Range(k.key)
+		args = append(args, fallback, min, max)
+	}
+	return args, nil
+}
+
+// runSlotScript runs the slot script for the given keys, and returns the first key without
+// slots, if any. The lease is only needed to consume or release.
+func (info *RedisScoreboard) runSlotScript(conn redis.Conn, mode string, l *lease, keys []slotKey) (string, error) {
+	args, err := info.slotArgs(mode, l, keys)
+	if err != nil {
+		return "", err
+	}
+	return redis.String(slotScript.Do(conn, args...))
+}
+
+// slotLimit returns the maximum in effect for the key, as the slot script enforces it,
+// 0 meaning none, and whether it is full
+func (info *RedisScoreboard) slotLimit(conn redis.Conn, k slotKey) (int, bool, error) {
+	args, err := info.slotArgs(slotLimits, nil, []slotKey{k})
+	if err != nil {
+		return 0, false, err
+	}
+	values, err := redis.Ints(slotScript.Do(conn, args...))
+	if err != nil {
+		return 0, false, err
+	} else if len(values) != 2 {
+		return 0, false, fmt.Errorf("Unexpected limits for %s: %v", k.key, values)
+	}
+	return values[0], values[1] == 1, nil
+}
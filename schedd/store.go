@@ -0,0 +1,159 @@
+/*
+ * Copyright (c) CERN 2016
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"github.com/garyburd/redigo/redis"
+	"gitlab.cern.ch/flutter/echelon"
+	"gitlab.cern.ch/flutter/fts/messages"
+	"time"
+)
+
+// Backends of the scheduler state
+const (
+	BackendRedis  = "redis"
+	BackendMemory = "memory"
+)
+
+type (
+	// Store keeps the state of the scheduler besides the scoreboard: the batches handed over
+	// to the leader, those queued with their deadlines and transfers, the parked batches,
+	// the retries and the leader election.
+	// Claims return false when someone else claimed first, since several schedulers may
+	// share the store.
+	Store interface {
+		// QueueDb returns the storage of the queue
+		QueueDb() echelon.StorageBackend
+
+		// Enqueue tracks the transfers of the batch, and its deadline if any, and hands it
+		// over to the leader
+		Enqueue(batch *messages.Batch) error
+		// NextInbox returns the first batch handed over to the leader, or nil if there is none
+		NextInbox() ([]byte, error)
+		// RemoveInbox removes the batch from the inbox, once queued
+		RemoveInbox(data []byte) error
+
+		// TrackQueued counts the batch into the depth of its queue, and keeps its place
+		// and summary, or undoes all that if the batch is leaving the queue
+		TrackQueued(batch *messages.Batch, queued bool) error
+		// QueueDepths returns the number of queued batches for every non empty path prefix,
+		// sorted by path
+		QueueDepths() ([]QueueDepth, error)
+		// QueuedSummary returns the summary of a queued batch, or nil if not queued
+		QueuedSummary(id string) ([]byte, error)
+		// QueuedSummaries returns the summaries of the queued batches, by id
+		QueuedSummaries() (map[string][]byte, error)
+		// QueuePosition returns the place of the batch in its queue, starting by 1, or 0 if
+		// not there, and the length of the queue
+		QueuePosition(path []string, id string) (int, int, error)
+		// Unqueue asks the leader to take the batches out of the queue
+		Unqueue(ids ...string) error
+		// Unqueued returns the ids of the batches to take out of the queue
+		Unqueued() ([]string, error)
+		// ForgetUnqueued drops the ids of batches taken out of the queue
+		ForgetUnqueued(ids []string) error
+
+		// ClaimDeadline stops tracking the deadline of the batch
+		ClaimDeadline(id string) (bool, error)
+		// ClaimExpired stops tracking the batches past their deadline by now, and returns them
+		ClaimExpired(now time.Time) ([][]byte, error)
+		// ClaimTransfers stops tracking the transfers, and tells which ones were claimed
+		ClaimTransfers(ids []string) ([]bool, error)
+		// QueuedIn returns the id of the queued batch of each transfer, or an empty string
+		// for those no longer queued
+		QueuedIn(ids []string) ([]string, error)
+		// QueuedTransfers returns the batch tracked for the transfer, or those of all the
+		// transfers if the id is empty
+		QueuedTransfers(id string) ([][]byte, error)
+
+		// Park keeps aside the batch of a banned user
+		Park(id string, data []byte) error
+		// ParkedBatch returns a parked batch, or nil if not parked
+		ParkedBatch(id string) ([]byte, error)
+		// Parked returns the parked batches, by id
+		Parked() (map[string][]byte, error)
+		// Unpark hands a parked batch back over to the leader
+		Unpark(id string, data []byte) (bool, error)
+
+		// ScheduleRetry keeps the batch until it is due for a retry
+		ScheduleRetry(id string, data []byte, due time.Time) error
+		// ClaimRetries claims the batches due for a retry by now, and returns them by id.
+		// They are due again at until, unless retried later, or forgotten, before.
+		ClaimRetries(now, until time.Time) (map[string][]byte, error)
+		// RetryLater puts back a claimed batch, due again at the given time
+		RetryLater(id string, due time.Time) error
+		// ForgetRetry drops a claimed batch, once resubmitted
+		ForgetRetry(id string) error
+
+		// Elect renews or takes the leadership for the scheduler id, and returns the token,
+		// empty if someone else is the leader
+		Elect(token, id string, ttl time.Duration) (string, error)
+		// Resign gives up the leadership held with the token
+		Resign(token string) error
+		// Leader returns the token of the current leader, or an empty string if there is none
+		Leader() (string, error)
+
+		// Close releases the resources of the store
+		Close() error
+	}
+
+	// RedisStore keeps the state in Redis, shared by all the schedulers
+	RedisStore struct {
+		pool *redis.Pool
+	}
+)
+
+// NewRedisBackend returns the store and the scoreboard kept in the Redis server
+// at the given address
+func NewRedisBackend(redisAddr string, params Params) (*RedisStore, *RedisScoreboard) {
+	pool := &redis.Pool{
+		Dial: func() (redis.Conn, error) {
+			log.Debug("Dial Redis connection")
+			return redis.Dial("tcp", redisAddr)
+		},
+		TestOnBorrow: func(c redis.Conn, t time.Time) error {
+			_, err := c.Do("PING")
+			return err
+		},
+		MaxIdle:     10,
+		MaxActive:   50,
+		IdleTimeout: 60 * time.Second,
+		Wait:        true,
+	}
+	store := &RedisStore{pool: pool}
+	scoreboard := &RedisScoreboard{
+		pool:   pool,
+		limits: params.Limits,
+		shares: params.Shares,
+		leases: params.Leases,
+	}
+	return store, scoreboard
+}
+
+// QueueDb returns the storage of the queue, in Redis
+func (store *RedisStore) QueueDb() echelon.StorageBackend {
+	return &echelon.RedisDb{
+		Pool:   store.pool,
+		Prefix: "fts-sched-",
+	}
+}
+
+// Close closes the connections to Redis, shared with the scoreboard
+func (store *RedisStore) Close() error {
+	return store.pool.Close()
+}
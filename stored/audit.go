@@ -0,0 +1,194 @@
+/*
+ * Copyright (c) CERN 2016
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"database/sql"
+	log "github.com/Sirupsen/logrus"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes/timestamp"
+	_ "github.com/lib/pq"
+	"github.com/satori/go.uuid"
+	"gitlab.cern.ch/flutter/fts/config"
+	"gitlab.cern.ch/flutter/fts/messages"
+	"gitlab.cern.ch/flutter/stomp"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Auditor keeps a record of the kill requests, and of what every agent did for them
+type Auditor struct {
+	db             *sql.DB
+	killConsumer   *stomp.Consumer
+	resultConsumer *stomp.Consumer
+}
+
+// connectDatabase connects to a remote database from a url-like connection string
+func connectDatabase(dbURL string) (*sql.DB, error) {
+	parsed, err := url.Parse(dbURL)
+	if err != nil {
+		return nil, err
+	}
+	return sql.Open(parsed.Scheme, parsed.String())
+}
+
+// NewAuditor connects to the database and the broker
+func NewAuditor(stompParams stomp.ConnectionParameters, database string) (*Auditor, error) {
+	var err error
+	a := &Auditor{}
+	if a.db, err = connectDatabase(database); err != nil {
+		return nil, err
+	}
+	if err = a.db.Ping(); err != nil {
+		a.db.Close()
+		return nil, err
+	}
+	if a.killConsumer, err = stomp.NewConsumer(stompParams); err != nil {
+		a.db.Close()
+		return nil, err
+	}
+	if a.resultConsumer, err = stomp.NewConsumer(stompParams); err != nil {
+		a.killConsumer.Close()
+		a.db.Close()
+		return nil, err
+	}
+	return a, nil
+}
+
+// Close finalizes the connections
+func (a *Auditor) Close() {
+	a.killConsumer.Close()
+	a.resultConsumer.Close()
+	a.db.Close()
+}
+
+// toTime converts a protobuf timestamp, nil if not set
+func toTime(ts *timestamp.Timestamp) *time.Time {
+	if ts == nil {
+		return nil
+	}
+	t := time.Unix(ts.Seconds, int64(ts.Nanos)).UTC()
+	return &t
+}
+
+// recordKill stores a kill request, with the id the agents give it if it has none
+func (a *Auditor) recordKill(kill *messages.Kill) error {
+	kill.EnsureID()
+	_, err := a.db.Exec(`INSERT INTO t_kill_requests
+		(kill_id, requester, requested, received, transfer_id, job_id, source_se, dest_se, vo, cred_id)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`,
+		kill.Id, kill.Requester, toTime(kill.Requested), time.Now().UTC(),
+		kill.TransferId, kill.JobId, kill.SourceSe, kill.DestSe, kill.Vo, kill.CredId,
+	)
+	return err
+}
+
+// resultRows returns the rows stored for what an agent did for a kill, one per target.
+// An agent that found nothing to kill gets a single row without transfers.
+func resultRows(result *messages.KillResult) [][]interface{} {
+	targets := result.Targets
+	if len(targets) == 0 {
+		targets = []*messages.KillResult_Target{{}}
+	}
+	rows := make([][]interface{}, 0, len(targets))
+	for _, target := range targets {
+		rows = append(rows, []interface{}{
+			result.GetKill().GetId(), result.Agent, result.Host, target.Pid,
+			strings.Join(target.TransferIds, ","), target.Signal, target.Error,
+			toTime(result.Received), toTime(result.Finished),
+		})
+	}
+	return rows
+}
+
+// recordResult stores what an agent did for a kill, in a single transaction
+func (a *Auditor) recordResult(result *messages.KillResult) error {
+	tx, err := a.db.Begin()
+	if err != nil {
+		return err
+	}
+	for _, row := range resultRows(result) {
+		if _, err = tx.Exec(`INSERT INTO t_kill_results
+			(kill_id, agent, host, pid, transfer_ids, signal, error, received, finished)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`, row...,
+		); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Run records the kill requests and results as they come. They are read from queues,
+// and only acknowledged once recorded, so none is missed while stored is down.
+func (a *Auditor) Run() error {
+	id := uuid.NewV4().String()
+	kills, killErrors, err := a.killConsumer.Subscribe(config.AuditKillQueue, "stored-kill-"+id, stomp.AckIndividual)
+	if err != nil {
+		return err
+	}
+	results, resultErrors, err := a.resultConsumer.Subscribe(config.AuditResultQueue, "stored-kill-result-"+id, stomp.AckIndividual)
+	if err != nil {
+		return err
+	}
+
+	log.Info("Kill auditor started")
+
+	for {
+		select {
+		case m, ok := <-kills:
+			if !ok {
+				return nil
+			}
+			kill := &messages.Kill{}
+			if err = proto.Unmarshal(m.Body, kill); err != nil {
+				m.Nack()
+				log.WithError(err).Error("Malformed kill message")
+			} else if err = a.recordKill(kill); err != nil {
+				m.Nack()
+				log.WithError(err).WithField("kill", kill.Id).Error("Failed to record the kill request")
+			} else {
+				m.Ack()
+			}
+		case m, ok := <-results:
+			if !ok {
+				return nil
+			}
+			result := &messages.KillResult{}
+			if err = proto.Unmarshal(m.Body, result); err != nil {
+				m.Nack()
+				log.WithError(err).Error("Malformed kill result")
+			} else if err = a.recordResult(result); err != nil {
+				m.Nack()
+				log.WithError(err).WithField("kill", result.GetKill().GetId()).Error("Failed to record the kill result")
+			} else {
+				m.Ack()
+			}
+		case e, ok := <-killErrors:
+			if !ok {
+				return nil
+			}
+			log.WithError(e).Warn("Got an error from the subcription channel")
+		case e, ok := <-resultErrors:
+			if !ok {
+				return nil
+			}
+			log.WithError(e).Warn("Got an error from the subcription channel")
+		}
+	}
+}
@@ -0,0 +1,52 @@
+/*
+ * Copyright (c) CERN 2016
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"gitlab.cern.ch/flutter/fts/messages"
+	"testing"
+	"time"
+)
+
+// Results must be stored one row per target, or as a single row when nothing matched.
+func TestResultRows(t *testing.T) {
+	result := &messages.KillResult{
+		Kill:     &messages.Kill{Id: "kill", JobId: "job"},
+		Agent:    "fts-workerd",
+		Host:     "host",
+		Received: messages.Now(),
+		Targets: []*messages.KillResult_Target{
+			{Pid: 42, TransferIds: []string{"a", "b"}, Signal: "SIGUSR1"},
+			{Pid: 43, TransferIds: []string{"c"}, Signal: "SIGKILL", Error: "Timeout"},
+		},
+	}
+	rows := resultRows(result)
+	if len(rows) != 2 || len(rows[0]) != 9 {
+		t.Fatal("Expecting a row per target, got ", rows)
+	}
+	if rows[0][0] != "kill" || rows[0][3] != int32(42) || rows[0][4] != "a,b" || rows[1][6] != "Timeout" {
+		t.Fatal("Expecting the kill id and the targets, got ", rows)
+	}
+	if rows[0][7].(*time.Time) == nil || rows[0][8].(*time.Time) != nil {
+		t.Fatal("Expecting only the received time to be set, got ", rows[0][7], rows[0][8])
+	}
+
+	result.Targets = nil
+	if rows = resultRows(result); len(rows) != 1 || rows[0][0] != "kill" || rows[0][4] != "" {
+		t.Fatal("Expecting a single row without transfers, got ", rows)
+	}
+}
@@ -34,6 +34,7 @@ import (
 
 var keepTaskFile = flag.Bool("KeepTaskFile", false, "Do not delete the task file once read")
 var x509proxy = flag.String("Proxy", "", "User X509 proxy")
+var cleanupHops = flag.Bool("CleanupHops", false, "Delete the intermediate replicas once the last hop of a multihop batch finishes")
 
 type urlCopy struct {
 	context  *gfal2.Context
@@ -44,6 +45,8 @@ type urlCopy struct {
 	batch         messages.Batch
 	transferIndex int
 	terminalSent  bool
+	// Transfers canceled on their own, while the rest keep running
+	canceledIds map[string]bool
 
 	// Transfer being run
 	transfer *messages.Transfer
@@ -53,7 +56,9 @@ type urlCopy struct {
 // serialized in the file pointed by taskfile.
 func newURLCopy(taskfile string) *urlCopy {
 	var err error
-	copy := urlCopy{}
+	copy := urlCopy{
+		canceledIds: make(map[string]bool),
+	}
 
 	raw, err := ioutil.ReadFile(taskfile)
 	if err != nil {
@@ -69,8 +74,11 @@ func newURLCopy(taskfile string) *urlCopy {
 	}
 
 	// All transfers, from now on, will have a status
+	// Hops of a multihop batch run before keep theirs
 	for index := range copy.batch.Transfers {
-		copy.batch.Transfers[index].Info = &messages.TransferInfo{}
+		if copy.batch.Transfers[index].Info == nil {
+			copy.batch.Transfers[index].Info = &messages.TransferInfo{}
+		}
 	}
 
 	copy.context, err = gfal2.NewContext()
@@ -124,6 +132,12 @@ func (copy *urlCopy) createCopyHandler(transfer *messages.Transfer) (handler *gf
 		handler.SetOverwrite(transfer.Parameters.Overwrite)
 		handler.SetSourceSpacetoken(transfer.Parameters.SourceSpacetoken)
 		handler.SetDestinationSpaceToken(transfer.Parameters.DestSpacetoken)
+		if transfer.Parameters.Nstreams > 0 {
+			handler.SetNbStreams(int(transfer.Parameters.Nstreams))
+		}
+		if transfer.Parameters.TcpBufferSize > 0 {
+			handler.SetTcpBufferSize(int(transfer.Parameters.TcpBufferSize))
+		}
 
 		checksumMode := 0
 		switch transfer.Parameters.ChecksumMode {
@@ -155,8 +169,8 @@ func (copy *urlCopy) NotifyPerformanceMarker(marker gfal2.Marker) {
 		TransferId:  copy.transfer.TransferId,
 		Throughput:  float32(marker.AvgThroughput),
 		Transferred: marker.BytesTransferred,
-		SourceSe:    "TODO",
-		DestSe:      "TODO",
+		SourceSe:    copy.batch.SourceSe,
+		DestSe:      copy.batch.DestSe,
 	}
 	if err := copy.reportPerformance(perf); err != nil {
 		log.Error(err)
@@ -192,7 +206,7 @@ func (copy *urlCopy) runTransfer(transfer *messages.Transfer) {
 	}
 
 	log.Info("Transfer accepted")
-	if err != nil {
+	if err = copy.reportTransferStart(transfer); err != nil {
 		log.Errorf("Failed to send the start message: %s", err.Error())
 	}
 
@@ -216,6 +230,8 @@ func (copy *urlCopy) runTransfer(transfer *messages.Transfer) {
 	if transfer.Parameters != nil {
 		log.Infof("Dest space token: %s", transfer.Parameters.DestSpacetoken)
 		log.Infof("Source space token: %s", transfer.Parameters.SourceSpacetoken)
+		log.Infof("Number of streams: %d", transfer.Parameters.Nstreams)
+		log.Infof("TCP buffer size: %d", transfer.Parameters.TcpBufferSize)
 	}
 	log.Infof("Checksum: %s", transfer.Checksum)
 	log.Infof("User filesize: %d", transfer.Filesize)
@@ -307,23 +323,36 @@ func (copy *urlCopy) runTransfer(transfer *messages.Transfer) {
 
 // sendTerminalForRemaining send a terminal message for any transfer than hasn't run yet.
 // This could be due to external cancellation, or multihop failures.
+// The alternatives of a multisource batch are left on hold for the scheduler if the
+// one that run failed, or unused if it succeeded. The next hops of a multihop batch are
+// left on hold if the hop succeeded.
 func (copy *urlCopy) setStateForRemaining() {
-	// TODO
 	var remainingInfo *messages.TransferInfo
 	var remainingState messages.Transfer_State
 
-	remainingState = messages.Transfer_FAILED
-	remainingInfo = &messages.TransferInfo{
-		Error: &messages.TransferError{
-			Scope:       messages.TransferError_AGENT,
-			Code:        int32(syscall.ECANCELED),
-			Description: "Transfer canceled because a previous hop failed",
-			Recoverable: false,
-		},
+	switch {
+	case copy.batch.Type == messages.Batch_MULTISOURCE && !copy.canceled && copy.failures == 0:
+		remainingState = messages.Transfer_UNUSED
+	case copy.batch.Type == messages.Batch_MULTISOURCE && !copy.canceled:
+		remainingState = messages.Transfer_ON_HOLD
+	case copy.batch.Type == messages.Batch_MULTIHOP && !copy.canceled && copy.failures == 0:
+		remainingState = messages.Transfer_ON_HOLD
+	default:
+		remainingState = messages.Transfer_FAILED
+		remainingInfo = &messages.TransferInfo{
+			Error: &messages.TransferError{
+				Scope:       messages.TransferError_AGENT,
+				Code:        int32(syscall.ECANCELED),
+				Description: "Transfer canceled because a previous hop failed",
+				Recoverable: false,
+			},
+		}
 	}
 	for transfer := copy.next(); transfer != nil; transfer = copy.next() {
 		transfer.State = remainingState
-		transfer.Info = remainingInfo
+		if remainingInfo != nil {
+			transfer.Info = remainingInfo
+		}
 	}
 }
 
@@ -331,6 +360,21 @@ func (copy *urlCopy) setStateForRemaining() {
 func (copy *urlCopy) Run() {
 	copy.reportBatchStart()
 	for copy.transfer = copy.next(); copy.transfer != nil && !copy.canceled; copy.transfer = copy.next() {
+		// Hops finished in a previous run
+		if copy.batch.Type == messages.Batch_MULTIHOP && copy.transfer.State == messages.Transfer_FINISHED {
+			continue
+		}
+		if copy.isCanceled(copy.transfer) {
+			copy.transfer.State = messages.Transfer_CANCELED
+			copy.transfer.Info.Error = &messages.TransferError{
+				Scope:       messages.TransferError_AGENT,
+				Code:        int32(syscall.ECANCELED),
+				Description: "Transfer canceled",
+				Recoverable: false,
+			}
+			log.Info("Transfer canceled before running")
+			continue
+		}
 		copy.runTransfer(copy.transfer)
 
 		if copy.transfer.Info.Error != nil {
@@ -352,19 +396,63 @@ func (copy *urlCopy) Run() {
 			log.Info("Transfer finished successfully")
 		}
 
-		// TODO: Multihop, multisources
+		// Only one alternative of a multisource batch, or hop of a multihop, runs.
+		// The scheduler picks the next.
+		if copy.batch.Type == messages.Batch_MULTISOURCE || copy.batch.Type == messages.Batch_MULTIHOP {
+			break
+		}
 	}
 
 	copy.setStateForRemaining()
+	if *cleanupHops && copy.batch.Type == messages.Batch_MULTIHOP && copy.transfer != nil &&
+		copy.transfer.State == messages.Transfer_FINISHED &&
+		copy.transfer == copy.batch.Transfers[len(copy.batch.Transfers)-1] {
+		copy.cleanupHops()
+	}
 	copy.reportBatchEnd()
 }
 
+// cleanupHops deletes the intermediate replicas of a multihop batch, once the last hop
+// has finished. Failures are only logged, since the transfer is done.
+func (copy *urlCopy) cleanupHops() {
+	hops := copy.batch.Transfers
+	for _, hop := range hops[:len(hops)-1] {
+		if gerr := copy.context.Unlink(hop.Destination); gerr != nil {
+			log.Warnf("Failed to delete the intermediate replica %s: %s", hop.Destination, gerr.Error())
+		} else {
+			log.Infof("Deleted the intermediate replica %s", hop.Destination)
+		}
+	}
+}
+
 // Triggers a graceful cancellation.
 func (copy *urlCopy) Cancel() {
 	copy.context.Cancel()
 	copy.canceled = true
 }
 
+// CancelTransfers cancels some of the transfers, and keeps running the rest.
+// The one running is aborted if it is among them.
+func (copy *urlCopy) CancelTransfers(ids []string) {
+	copy.mutex.Lock()
+	defer copy.mutex.Unlock()
+
+	for _, id := range ids {
+		log.Info("Canceling ", id)
+		copy.canceledIds[id] = true
+	}
+	if copy.transfer != nil && copy.canceledIds[copy.transfer.TransferId] {
+		copy.context.Cancel()
+	}
+}
+
+// isCanceled returns true if the transfer has been canceled on its own
+func (copy *urlCopy) isCanceled(transfer *messages.Transfer) bool {
+	copy.mutex.Lock()
+	defer copy.mutex.Unlock()
+	return copy.canceledIds[transfer.TransferId]
+}
+
 // Ungracefully terminates the transfers. It doesn't even bother sending a Cancel, since
 // the underlying gfal2 handler may be in an inconsistent state and the reason for the Panic.
 // It tries its best to send a termination message for all non-executed transfers.
@@ -19,24 +19,56 @@ package main
 import (
 	"flag"
 	log "github.com/Sirupsen/logrus"
+	"gitlab.cern.ch/flutter/fts/config"
+	"io/ioutil"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 )
 
+// readCancelFile returns the ids of the transfers the worker asked to cancel.
+// The file is moved away first, so ids written meanwhile go to a new one, signaled again.
+func readCancelFile() ([]string, error) {
+	cancelFile := config.CancelFile(*dirqBasePath, os.Getpid())
+	taken := cancelFile + ".taken"
+	if err := os.Rename(cancelFile, taken); err != nil {
+		return nil, err
+	}
+	defer os.Remove(taken)
+
+	fd, err := os.OpenFile(taken, os.O_RDONLY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+	data, err := ioutil.ReadAll(fd)
+	if err != nil {
+		return nil, err
+	}
+	return strings.Fields(string(data)), nil
+}
+
 // signalHandler listen for signals that are triggered either by a fatal error inside
 // the code (i.e. SIGSEGV), or cancellation signals coming from FTS (i.e. SIGTERM).
 // For fatal error signals, it will force-quit after trying to send the terminal messages.
+// SIGUSR1 cancels only the transfers listed in the cancel file.
 func signalHandler(copy *urlCopy) {
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, syscall.SIGABRT, syscall.SIGSEGV, syscall.SIGILL, syscall.SIGFPE,
-		syscall.SIGBUS, syscall.SIGTRAP, syscall.SIGSYS, syscall.SIGINT, syscall.SIGTERM)
+		syscall.SIGBUS, syscall.SIGTRAP, syscall.SIGSYS, syscall.SIGINT, syscall.SIGTERM, syscall.SIGUSR1)
 
 	for signum := range c {
 		log.Warning("Received signal ", signum)
 		switch signum {
 		case syscall.SIGINT, syscall.SIGTERM:
 			copy.Cancel()
+		case syscall.SIGUSR1:
+			if ids, err := readCancelFile(); err != nil {
+				log.WithError(err).Error("Failed to read the transfers to cancel")
+			} else {
+				copy.CancelTransfers(ids)
+			}
 		default:
 			copy.Panic("Transfer process died with: %d", signum)
 			log.Panic("Transfer process died with: ", signum)
@@ -78,6 +78,16 @@ func (copy *urlCopy) reportBatchEnd() {
 	copy.terminalSent = true
 }
 
+// reportTransferStart sends an empty performance marker when a transfer starts, so the
+// scheduler renews the lease of the batch for the timeout of the transfer.
+func (copy *urlCopy) reportTransferStart(transfer *messages.Transfer) error {
+	return copy.reportPerformance(&messages.PerformanceMarker{
+		TransferId: transfer.TransferId,
+		SourceSe:   copy.batch.SourceSe,
+		DestSe:     copy.batch.DestSe,
+	})
+}
+
 // ReportPerformance sends the progress of a transfer.
 func (copy *urlCopy) reportPerformance(perf *messages.PerformanceMarker) error {
 	perf.Timestamp = messages.Now()
@@ -20,6 +20,7 @@ import (
 	"github.com/Sirupsen/logrus"
 	"github.com/golang/protobuf/proto"
 	"github.com/golang/protobuf/ptypes/duration"
+	"gitlab.cern.ch/flutter/fts/config"
 	"gitlab.cern.ch/flutter/fts/messages"
 	"gitlab.cern.ch/flutter/go-dirq"
 	"io/ioutil"
@@ -429,6 +430,83 @@ func TestMultipleCancel(t *testing.T) {
 	}
 }
 
+// Cancel some of the transfers of the batch, one while running and one before it runs.
+// Those must be canceled, and the rest must keep running.
+func TestCancelTransfers(t *testing.T) {
+	transfer1 := &messages.Transfer{
+		TransferId:  "8c5b2a5e-2bd4-11e6-9c7b-02163e006dd0",
+		Source:      "mock://host/path?size=10",
+		Destination: "mock://host/path?size_post=10&time=2",
+	}
+	transfer2 := &messages.Transfer{
+		TransferId:  "9a1f4c2e-2bd4-11e6-81e2-02163e006dd0",
+		Source:      "mock://host/path?size=42",
+		Destination: "mock://host/path?size_post=42&time=10",
+	}
+	transfer3 := &messages.Transfer{
+		TransferId:  "a4e0d7b8-2bd4-11e6-81e2-02163e006dd0",
+		Source:      "mock://host/path?size=5",
+		Destination: "mock://host/path?size_post=5&time=1",
+	}
+	transfer4 := &messages.Transfer{
+		TransferId:  "b0c2e8f4-2bd4-11e6-81e2-02163e006dd0",
+		Source:      "mock://host/path?size=5",
+		Destination: "mock://host/path?size_post=5&time=1",
+	}
+
+	task := &messages.Batch{
+		Transfers: []*messages.Transfer{transfer1, transfer2, transfer3, transfer4},
+	}
+
+	path := Serialize(t, task)
+	copy := newURLCopy(path)
+	go func() {
+		time.Sleep(1 * time.Second)
+		copy.CancelTransfers([]string{transfer3.TransferId})
+		time.Sleep(3 * time.Second)
+		copy.CancelTransfers([]string{transfer2.TransferId})
+	}()
+	copy.Run()
+
+	ConsumeStartMessages(t)
+	end := ConsumeEndMessages(t)
+
+	if len(end.Transfers) != 4 {
+		t.Fatal("Expecting 4 end messages, got", len(end.Transfers))
+	}
+	expected := []messages.Transfer_State{
+		messages.Transfer_FINISHED, messages.Transfer_CANCELED,
+		messages.Transfer_CANCELED, messages.Transfer_FINISHED,
+	}
+	for i, state := range expected {
+		if end.Transfers[i].State != state {
+			t.Error("Expecting ", state, " for transfer ", i+1, ", got ", end.Transfers[i].State)
+		}
+	}
+	if end.Transfers[1].Info.Error == nil || end.Transfers[1].Info.Error.Code != int32(syscall.ECANCELED) {
+		t.Error("Expecting ECANCELED for the running transfer, got", end.Transfers[1].Info.Error)
+	}
+}
+
+// The ids in the cancel file must be read once, and the file moved away.
+func TestReadCancelFile(t *testing.T) {
+	cancelFile := config.CancelFile(*dirqBasePath, os.Getpid())
+	if err := os.MkdirAll(config.CancelDir(*dirqBasePath), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(cancelFile, []byte("a\nb\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	ids, err := readCancelFile()
+	if err != nil || len(ids) != 2 || ids[0] != "a" || ids[1] != "b" {
+		t.Fatal("Expecting the two ids, got ", ids, err)
+	}
+	if _, err = readCancelFile(); err == nil {
+		t.Fatal("Expecting the cancel file to be gone")
+	}
+}
+
 // Similar to the cancel test, but this time trigger a Panic, which normally would be
 // called by the signal handler. The process normally would terminate immediately, but an
 // end message must have been generated.
@@ -485,25 +563,23 @@ func TestMultiplePanic(t *testing.T) {
 	}
 }
 
-/*
-THESE TESTS ARE DISABLED
 // Test a multihop transfer. Since the first hop fails, the second must not run, even though it would
 // success.
 func TestMultiHop(t *testing.T) {
 	transfer1 := &messages.Transfer{
 		TransferId:  "e0ccca86-2279-11e6-9c7b-02163e006dd0",
-		Source:      surlHelper("mock://host/path?size=10&errno=2"),
-		Destination: surlHelper("mock://host/path?size_post=10&time=2"),
+		Source:      "mock://host/path?size=10&errno=2",
+		Destination: "mock://host/path?size_post=10&time=2",
 	}
 	transfer2 := &messages.Transfer{
-		JobID:       "d025fb26-2279-11e6-a607-02163e006dd0",
+		JobId:       "d025fb26-2279-11e6-a607-02163e006dd0",
 		TransferId:  "1e97ce14-227b-11e6-81e2-02163e006dd0",
-		Source:      surlHelper("mock://host/path?size=42"),
-		Destination: surlHelper("mock://host/path?size_post=42&time=2"),
+		Source:      "mock://host/path?size=42",
+		Destination: "mock://host/path?size_post=42&time=2",
 	}
 
 	task := &messages.Batch{
-		Type:      messages.BatchMultihop,
+		Type:      messages.Batch_MULTIHOP,
 		Transfers: []*messages.Transfer{transfer1, transfer2},
 	}
 
@@ -525,21 +601,21 @@ func TestMultiHop(t *testing.T) {
 		return
 	}
 
-	if end.Transfers[0].State != messages.TransferFailed {
+	if end.Transfers[0].State != messages.Transfer_FAILED {
 		t.Error("Expecting Failed, got", end.Transfers[0].State)
 	}
-	if end.Transfers[1].State != messages.TransferFailed {
+	if end.Transfers[1].State != messages.Transfer_FAILED {
 		t.Error("Expecting Failed, got", end.Transfers[1].State)
 	}
 
 	if end.Transfers[0].Info.Error == nil {
 		t.Error("First transfer expecting failure, got success")
-	} else if end.Transfers[0].Info.Error.Code != syscall.ENOENT {
+	} else if end.Transfers[0].Info.Error.Code != int32(syscall.ENOENT) {
 		t.Error("First transfer expecting ENOENT, got", end.Transfers[0].Info.Error.Code)
 	}
 	if end.Transfers[1].Info.Error == nil {
 		t.Error("Second transfer expecting failure, got success")
-	} else if end.Transfers[1].Info.Error.Code != syscall.ECANCELED {
+	} else if end.Transfers[1].Info.Error.Code != int32(syscall.ECANCELED) {
 		t.Error("Second transfer expecting ECANCELED, got", end.Transfers[0].Info.Error.Code)
 	}
 }
@@ -547,20 +623,20 @@ func TestMultiHop(t *testing.T) {
 // Test a multihop transfer. The first succeeds, but the second should be pushed to the queue by the scheduler.
 func TestMultiHop2(t *testing.T) {
 	transfer1 := &messages.Transfer{
-		JobID:       "d025fb26-2279-11e6-a607-02163e006dd0",
+		JobId:       "d025fb26-2279-11e6-a607-02163e006dd0",
 		TransferId:  "e0ccca86-2279-11e6-9c7b-02163e006dd0",
-		Source:      surlHelper("mock://host/path?size=10"),
-		Destination: surlHelper("mock://host/path?size_post=10&time=2"),
+		Source:      "mock://host/path?size=10",
+		Destination: "mock://host/path?size_post=10&time=2",
 	}
 	transfer2 := &messages.Transfer{
-		JobID:       "d025fb26-2279-11e6-a607-02163e006dd0",
+		JobId:       "d025fb26-2279-11e6-a607-02163e006dd0",
 		TransferId:  "1e97ce14-227b-11e6-81e2-02163e006dd0",
-		Source:      surlHelper("mock://host/path?size=10"),
-		Destination: surlHelper("mock://host/path?size_post=10&time=2"),
+		Source:      "mock://host/path?size=10",
+		Destination: "mock://host/path?size_post=10&time=2",
 	}
 
 	task := &messages.Batch{
-		Type:      messages.BatchMultihop,
+		Type:      messages.Batch_MULTIHOP,
 		Transfers: []*messages.Transfer{transfer1, transfer2},
 	}
 
@@ -582,10 +658,10 @@ func TestMultiHop2(t *testing.T) {
 		return
 	}
 
-	if end.Transfers[0].State != messages.TransferFinished {
+	if end.Transfers[0].State != messages.Transfer_FINISHED {
 		t.Error("Expecting Finished, got", end.Transfers[0].State)
 	}
-	if end.Transfers[1].State != messages.TransferOnHold {
+	if end.Transfers[1].State != messages.Transfer_ON_HOLD {
 		t.Error("Expecting On Hold, got", end.Transfers[1].State)
 	}
 
@@ -601,20 +677,20 @@ func TestMultiHop2(t *testing.T) {
 // It is not up to url copy to run the remaining options
 func TestMultisources(t *testing.T) {
 	transfer1 := &messages.Transfer{
-		JobID:       "d025fb26-2279-11e6-a607-02163e006dd0",
+		JobId:       "d025fb26-2279-11e6-a607-02163e006dd0",
 		TransferId:  "e0ccca86-2279-11e6-9c7b-02163e006dd0",
-		Source:      surlHelper("mock://host/path?size=10&errno=2"),
-		Destination: surlHelper("mock://host/path?size_post=10&time=2"),
+		Source:      "mock://host/path?size=10&errno=2",
+		Destination: "mock://host/path?size_post=10&time=2",
 	}
 	transfer2 := &messages.Transfer{
-		JobID:       "d025fb26-2279-11e6-a607-02163e006dd0",
+		JobId:       "d025fb26-2279-11e6-a607-02163e006dd0",
 		TransferId:  "1e97ce14-227b-11e6-81e2-02163e006dd0",
-		Source:      surlHelper("mock://host/path?size=10"),
-		Destination: surlHelper("mock://host/path?size_post=10&time=2"),
+		Source:      "mock://host/path?size=10",
+		Destination: "mock://host/path?size_post=10&time=2",
 	}
 
 	task := &messages.Batch{
-		Type:      messages.BatchMultisource,
+		Type:      messages.Batch_MULTISOURCE,
 		Transfers: []*messages.Transfer{transfer1, transfer2},
 	}
 
@@ -636,16 +712,16 @@ func TestMultisources(t *testing.T) {
 		return
 	}
 
-	if end.Transfers[0].State != messages.TransferFailed {
+	if end.Transfers[0].State != messages.Transfer_FAILED {
 		t.Error("Expecting Failed, got", end.Transfers[0].State)
 	}
-	if end.Transfers[1].State != messages.TransferOnHold {
+	if end.Transfers[1].State != messages.Transfer_ON_HOLD {
 		t.Error("Expecting On Hold, got", end.Transfers[1].State)
 	}
 
 	if end.Transfers[0].Info.Error == nil {
 		t.Error("First transfer expecting failure, got success")
-	} else if end.Transfers[0].Info.Error.Code != syscall.ENOENT {
+	} else if end.Transfers[0].Info.Error.Code != int32(syscall.ENOENT) {
 		t.Error("First transfer expecting ENOENT, got", end.Transfers[0].Info.Error.Code)
 	}
 	if end.Transfers[1].Info.Error != nil {
@@ -656,20 +732,20 @@ func TestMultisources(t *testing.T) {
 // Test a multiple source batch where the current step succeeds
 func TestMultisources2(t *testing.T) {
 	transfer1 := &messages.Transfer{
-		JobID:       "d025fb26-2279-11e6-a607-02163e006dd0",
+		JobId:       "d025fb26-2279-11e6-a607-02163e006dd0",
 		TransferId:  "e0ccca86-2279-11e6-9c7b-02163e006dd0",
-		Source:      surlHelper("mock://host/path?size=10"),
-		Destination: surlHelper("mock://host/path?size_post=10&time=2"),
+		Source:      "mock://host/path?size=10",
+		Destination: "mock://host/path?size_post=10&time=2",
 	}
 	transfer2 := &messages.Transfer{
-		JobID:       "d025fb26-2279-11e6-a607-02163e006dd0",
+		JobId:       "d025fb26-2279-11e6-a607-02163e006dd0",
 		TransferId:  "1e97ce14-227b-11e6-81e2-02163e006dd0",
-		Source:      surlHelper("mock://host/path?size=10"),
-		Destination: surlHelper("mock://host/path?size_post=10&time=2"),
+		Source:      "mock://host/path?size=10",
+		Destination: "mock://host/path?size_post=10&time=2",
 	}
 
 	task := &messages.Batch{
-		Type:      messages.BatchMultisource,
+		Type:      messages.Batch_MULTISOURCE,
 		Transfers: []*messages.Transfer{transfer1, transfer2},
 	}
 
@@ -691,10 +767,10 @@ func TestMultisources2(t *testing.T) {
 		return
 	}
 
-	if end.Transfers[0].State != messages.TransferFinished {
+	if end.Transfers[0].State != messages.Transfer_FINISHED {
 		t.Error("Expecting Finished, got", end.Transfers[0].State)
 	}
-	if end.Transfers[1].State != messages.TransferUnused {
+	if end.Transfers[1].State != messages.Transfer_UNUSED {
 		t.Error("Expecting Unused, got", end.Transfers[1].State)
 	}
 
@@ -705,4 +781,3 @@ func TestMultisources2(t *testing.T) {
 		t.Error("Second transfer expecting no failure, got", end.Transfers[1].Info.Error)
 	}
 }
-*/
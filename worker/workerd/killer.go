@@ -23,6 +23,7 @@ import (
 	"gitlab.cern.ch/flutter/fts/config"
 	"gitlab.cern.ch/flutter/fts/messages"
 	"gitlab.cern.ch/flutter/stomp"
+	"os"
 )
 
 type (
@@ -30,9 +31,54 @@ type (
 	Killer struct {
 		Context  *Worker
 		consumer *stomp.Consumer
+		producer *stomp.Producer
 	}
 )
 
+// kill stops the transfers matched by the kill, and returns what has been done
+func (k *Killer) kill(kill *messages.Kill) *messages.KillResult {
+	hostname, _ := os.Hostname()
+	result := &messages.KillResult{
+		Kill:     kill,
+		Agent:    "fts-workerd",
+		Host:     hostname,
+		Received: messages.Now(),
+		Targets:  make([]*messages.KillResult_Target, 0),
+	}
+
+	for _, target := range k.Context.supervisor.GetKillTargets(kill) {
+		var err error
+		killed := &messages.KillResult_Target{
+			Pid:         int32(target.Pid),
+			TransferIds: target.Transfers,
+		}
+		if target.All {
+			killed.Signal, err = k.Context.supervisor.Kill(target.Pid)
+		} else {
+			killed.Signal = "SIGUSR1"
+			err = k.Context.supervisor.CancelTransfers(target.Pid, target.Transfers)
+		}
+		if err != nil {
+			log.WithError(err).Error("Failed to kill the transfers of ", target.Pid)
+			killed.Error = err.Error()
+		}
+		result.Targets = append(result.Targets, killed)
+	}
+
+	result.Finished = messages.Now()
+	return result
+}
+
+// report sends the result of a kill, even if nothing matched, so the requester
+// hears back from every worker
+func (k *Killer) report(result *messages.KillResult) error {
+	data, err := proto.Marshal(result)
+	if err != nil {
+		return err
+	}
+	return k.producer.Send(config.KillResultTopic, string(data), stomp.SendParams{Persistent: true})
+}
+
 // Run executes the Killer subroutine
 func (k *Killer) Run() error {
 	var err error
@@ -40,6 +86,9 @@ func (k *Killer) Run() error {
 	if k.consumer, err = stomp.NewConsumer(k.Context.params.StompParams); err != nil {
 		return err
 	}
+	if k.producer, err = stomp.NewProducer(k.Context.params.StompParams); err != nil {
+		return err
+	}
 
 	var killChannel <-chan stomp.Message
 	var errorChannel <-chan error
@@ -61,11 +110,13 @@ func (k *Killer) Run() error {
 			var kill messages.Kill
 			if err := proto.Unmarshal(m.Body, &kill); err != nil {
 				log.WithError(err).Error("Malformed kill message")
+			} else if kill.IsEmpty() {
+				log.Warn("Ignoring kill without selectors")
 			} else {
-				log.Info("Got kill signal")
-				pids := k.Context.supervisor.GetPidsForKillTask(&kill)
-				for _, pid := range pids {
-					k.Context.supervisor.Kill(pid)
+				kill.EnsureID()
+				log.WithField("kill", kill.Id).Info("Got kill signal")
+				if err := k.report(k.kill(&kill)); err != nil {
+					log.WithError(err).Error("Failed to send the kill result")
 				}
 			}
 		case error, ok := <-errorChannel:
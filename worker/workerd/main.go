@@ -51,6 +51,7 @@ var workerCmd = &cobra.Command{
 			TransferLogPath: viper.Get("worker.transfers.logs").(string),
 			DirQPath:        viper.Get("worker.dirq").(string),
 			PidDBPath:       viper.Get("worker.piddb").(string),
+			CleanupHops:     viper.Get("worker.cleanuphops").(bool),
 			StompParams: stomp.ConnectionParameters{
 				ClientID: "fts-workerd-" + hostname,
 				Address:  viper.Get("stomp").(string),
@@ -98,6 +99,7 @@ func main() {
 	workerCmd.Flags().String("PidDB", "/var/lib/fts/pid.db", "PID database")
 	workerCmd.Flags().String("UrlCopy", "url-copy", "url-copy command")
 	workerCmd.Flags().String("TransfersLogDir", "/var/log/fts/transfers", "Transfer logs base dir")
+	workerCmd.Flags().Bool("CleanupHops", false, "Delete the intermediate replicas of multihop transfers")
 	workerCmd.Flags().Bool("Debug", true, "Enable debugging")
 
 	viper.BindPFlag("worker.log", workerCmd.Flags().Lookup("Log"))
@@ -106,6 +108,7 @@ func main() {
 	viper.BindPFlag("worker.piddb", workerCmd.Flags().Lookup("PidDB"))
 	viper.BindPFlag("worker.urlcopy", workerCmd.Flags().Lookup("UrlCopy"))
 	viper.BindPFlag("worker.transfers.logs", workerCmd.Flags().Lookup("TransfersLogDir"))
+	viper.BindPFlag("worker.cleanuphops", workerCmd.Flags().Lookup("CleanupHops"))
 	viper.BindPFlag("worker.debug", workerCmd.Flags().Lookup("Debug"))
 
 	cobra.OnInitialize(func() {
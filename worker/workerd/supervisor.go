@@ -21,10 +21,12 @@ import (
 	log "github.com/Sirupsen/logrus"
 	"github.com/golang/protobuf/proto"
 	"github.com/syndtr/goleveldb/leveldb"
+	"gitlab.cern.ch/flutter/fts/config"
 	"gitlab.cern.ch/flutter/fts/messages"
 	"golang.org/x/sys/unix"
 	"os"
 	"strconv"
+	"strings"
 	"syscall"
 	"time"
 )
@@ -39,22 +41,36 @@ type (
 
 	// Supervisor watches url copy processes
 	Supervisor struct {
-		Timeout time.Duration
-		db      *leveldb.DB
-		gone    chan procGone
+		Timeout  time.Duration
+		db       *leveldb.DB
+		gone     chan procGone
+		dirqPath string
+	}
+
+	// KillTarget is a process running transfers matched by a kill
+	KillTarget struct {
+		Pid       int
+		Transfers []string
+		// All is true if every transfer of the process is matched
+		All bool
 	}
 )
 
-// NewSupervisor opens the local db
-func NewSupervisor(path string) (*Supervisor, error) {
+// NewSupervisor opens the local db, and creates the directory of the cancel files under
+// the dirq base directory
+func NewSupervisor(path, dirqPath string) (*Supervisor, error) {
+	if err := os.MkdirAll(config.CancelDir(dirqPath), 0700); err != nil {
+		return nil, err
+	}
 	leveldb, err := leveldb.OpenFile(path, nil)
 	if err != nil {
 		return nil, err
 	}
 	superv := &Supervisor{
-		db:      leveldb,
-		Timeout: time.Second * 5,
-		gone:    make(chan procGone, 10),
+		db:       leveldb,
+		Timeout:  time.Second * 5,
+		gone:     make(chan procGone, 10),
+		dirqPath: dirqPath,
 	}
 	return superv, superv.recover()
 }
@@ -89,6 +105,7 @@ func (superv *Supervisor) Run() {
 		if err := superv.delete(gone.pid); err != nil {
 			log.WithError(err).Error("Failed to delete pid from the database")
 		}
+		os.Remove(config.CancelFile(superv.dirqPath, gone.pid))
 	}
 	log.Info("Supervisor finished")
 }
@@ -151,9 +168,9 @@ func (superv *Supervisor) delete(pid int) error {
 	return superv.db.Delete([]byte(pidStr), nil)
 }
 
-// GetPidsForKillTask returns the PIDs associated with the batch pointed by the kill task
-func (superv *Supervisor) GetPidsForKillTask(kill *messages.Kill) []int {
-	pids := make([]int, 0, 1)
+// GetKillTargets returns the processes running transfers matched by the kill
+func (superv *Supervisor) GetKillTargets(kill *messages.Kill) []KillTarget {
+	targets := make([]KillTarget, 0, 1)
 	iter := superv.db.NewIterator(nil, nil)
 	for iter.Next() {
 		var err error
@@ -168,26 +185,56 @@ func (superv *Supervisor) GetPidsForKillTask(kill *messages.Kill) []int {
 			log.WithError(err).Error("Failed to parse entry pid in the local db")
 		}
 
-		found := false
-		for _, transfer := range batch.Transfers {
-			found = (kill.TransferId != "" && kill.TransferId == transfer.TransferId)
-			if found {
-				log.Info("Found kill target ", transfer.TransferId)
-				found = true
-				break
-			}
-		}
-		if found {
-			pids = append(pids, pid)
+		if transfers := kill.Select(&batch); len(transfers) > 0 {
+			log.Info("Found kill targets ", transfers)
+			targets = append(targets, KillTarget{
+				Pid:       pid,
+				Transfers: transfers,
+				All:       len(transfers) == len(batch.Transfers),
+			})
 		}
 	}
+	return targets
+}
+
+// GetPidsForKillTask returns the PIDs associated with the batch pointed by the kill task
+func (superv *Supervisor) GetPidsForKillTask(kill *messages.Kill) []int {
+	targets := superv.GetKillTargets(kill)
+	pids := make([]int, 0, len(targets))
+	for _, target := range targets {
+		pids = append(pids, target.Pid)
+	}
 	return pids
 }
 
-// Kill sends first a SIGTERM and then a SIGKILL
-func (superv *Supervisor) Kill(pid int) {
+// CancelTransfers asks the process to cancel some of its transfers, and keep running the rest.
+// Their ids are appended to the cancel file of the process, which reads it on SIGUSR1.
+// The file is only created if missing, and never followed if a link.
+func (superv *Supervisor) CancelTransfers(pid int, transfers []string) error {
+	cancelFile := config.CancelFile(superv.dirqPath, pid)
+	fd, err := os.OpenFile(cancelFile, os.O_WRONLY|os.O_CREATE|os.O_EXCL|syscall.O_NOFOLLOW, 0600)
+	if os.IsExist(err) {
+		// Not taken by the process yet, so the ids are added to those there
+		fd, err = os.OpenFile(cancelFile, os.O_WRONLY|os.O_APPEND|syscall.O_NOFOLLOW, 0600)
+	}
+	if err != nil {
+		return err
+	}
+	_, err = fd.WriteString(strings.Join(transfers, "\n") + "\n")
+	fd.Close()
+	if err != nil {
+		return err
+	}
+	log.Info("Sending SIGUSR1 to ", pid)
+	return syscall.Kill(pid, unix.SIGUSR1)
+}
+
+// Kill sends first a SIGTERM and then a SIGKILL. It returns the last signal sent.
+func (superv *Supervisor) Kill(pid int) (string, error) {
 	log.Info("Sending SIGTERM to ", pid)
-	syscall.Kill(pid, unix.SIGTERM)
+	if err := syscall.Kill(pid, unix.SIGTERM); err != nil {
+		return "SIGTERM", err
+	}
 
 	done := make(chan error)
 
@@ -201,11 +248,14 @@ func (superv *Supervisor) Kill(pid int) {
 
 	select {
 	case err, _ := <-done:
-		if err != nil {
+		// ECHILD if the watcher reaped it first
+		if err != nil && err != syscall.ECHILD {
 			log.WithError(err).Warn("Failed to kill pid ", pid)
+			return "SIGTERM", err
 		}
+		return "SIGTERM", nil
 	case <-time.After(superv.Timeout):
 		log.Warn("Sending SIGKILL to ", pid)
-		syscall.Kill(pid, unix.SIGKILL)
+		return "SIGKILL", syscall.Kill(pid, unix.SIGKILL)
 	}
 }
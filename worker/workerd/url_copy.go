@@ -93,14 +93,17 @@ func RunTransfer(c *Worker, task *messages.Batch) (int, error) {
 		return 0, err
 	}
 
-	cmd := exec.Command(c.params.URLCopyBin,
+	args := []string{
 		"-LogLevel", fmt.Sprintf("%d", log.GetLevel()),
 		"-DirQ", c.params.DirQPath,
 		"-LogDir", c.params.TransferLogPath,
 		"-Proxy", pemFile,
 		"-KeepTaskFile",
-		taskFile,
-	)
+	}
+	if c.params.CleanupHops {
+		args = append(args, "-CleanupHops")
+	}
+	cmd := exec.Command(c.params.URLCopyBin, append(args, taskFile)...)
 	cmd.Dir = "/tmp"
 	cmd.Stdin = nil
 	cmd.SysProcAttr = &syscall.SysProcAttr{
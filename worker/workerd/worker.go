@@ -33,6 +33,8 @@ type (
 		DirQPath        string
 		Database        string
 		PidDBPath       string
+		// CleanupHops makes url-copy delete the intermediate replicas of multihop batches
+		CleanupHops bool
 	}
 
 	// Worker is used by each subsystem
@@ -64,7 +66,7 @@ func NewWorker(params Params) (w *Worker, err error) {
 		params: params,
 	}
 
-	if w.supervisor, err = NewSupervisor(params.PidDBPath); err != nil {
+	if w.supervisor, err = NewSupervisor(params.PidDBPath, params.DirQPath); err != nil {
 		return nil, err
 	}
 	log.Debugf("Started supervisor with DB %s", params.PidDBPath)
@@ -18,7 +18,9 @@ package main
 
 import (
 	"github.com/satori/go.uuid"
+	"gitlab.cern.ch/flutter/fts/config"
 	"gitlab.cern.ch/flutter/fts/messages"
+	"io/ioutil"
 	"os"
 	"os/exec"
 	"syscall"
@@ -27,9 +29,10 @@ import (
 )
 
 var localDbTestPath = "/tmp/worker-test.db"
+var localDirQTestPath = "/tmp/worker-test-dirq"
 
 func TestKillProc(t *testing.T) {
-	supervisor, err := NewSupervisor(localDbTestPath)
+	supervisor, err := NewSupervisor(localDbTestPath, localDirQTestPath)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -53,7 +56,7 @@ func TestKillProc(t *testing.T) {
 }
 
 func TestSigKill(t *testing.T) {
-	supervisor, err := NewSupervisor(localDbTestPath)
+	supervisor, err := NewSupervisor(localDbTestPath, localDirQTestPath)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -91,7 +94,7 @@ func TestSigKill(t *testing.T) {
 
 func TestStoreBatch(t *testing.T) {
 	os.RemoveAll(localDbTestPath)
-	supervisor, err := NewSupervisor(localDbTestPath)
+	supervisor, err := NewSupervisor(localDbTestPath, localDirQTestPath)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -130,3 +133,130 @@ func TestStoreBatch(t *testing.T) {
 		t.Fatal("Batch should have been removed")
 	}
 }
+
+func TestKillTargets(t *testing.T) {
+	os.RemoveAll(localDbTestPath)
+	supervisor, err := NewSupervisor(localDbTestPath, localDirQTestPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer supervisor.Close()
+
+	batch := &messages.Batch{
+		Submitted: messages.Now(),
+		State:     messages.Batch_READY,
+		Vo:        "dteam",
+		Transfers: []*messages.Transfer{
+			{TransferId: uuid.NewV4().String(), JobId: "job1"},
+			{TransferId: uuid.NewV4().String(), JobId: "job2"},
+		},
+	}
+	pid := 64
+	if err := supervisor.storeProcess(batch, pid); err != nil {
+		t.Fatal(err)
+	}
+
+	targets := supervisor.GetKillTargets(&messages.Kill{JobId: "job2"})
+	if len(targets) != 1 || targets[0].Pid != pid {
+		t.Fatal("Expecting a single target, got ", targets)
+	} else if targets[0].All || len(targets[0].Transfers) != 1 || targets[0].Transfers[0] != batch.Transfers[1].TransferId {
+		t.Fatal("Expecting only the second transfer, got ", targets[0])
+	}
+
+	targets = supervisor.GetKillTargets(&messages.Kill{Vo: "dteam"})
+	if len(targets) != 1 || !targets[0].All {
+		t.Fatal("Expecting the whole batch, got ", targets)
+	}
+
+	if targets = supervisor.GetKillTargets(&messages.Kill{}); len(targets) != 0 {
+		t.Fatal("An empty kill must match nothing, got ", targets)
+	}
+}
+
+// The ids of the transfers to cancel must be added to the cancel file of the process,
+// never followed if a link.
+func TestCancelTransfers(t *testing.T) {
+	supervisor, err := NewSupervisor(localDbTestPath, localDirQTestPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer supervisor.Close()
+
+	cmd := exec.Command("sleep", "100s")
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Wait()
+	pid := cmd.Process.Pid
+	cancelFile := config.CancelFile(localDirQTestPath, pid)
+	defer os.Remove(cancelFile)
+
+	if err := supervisor.CancelTransfers(pid, []string{"a"}); err != nil {
+		t.Fatal(err)
+	}
+	supervisor.CancelTransfers(pid, []string{"b", "c"})
+	if data, _ := ioutil.ReadFile(cancelFile); string(data) != "a\nb\nc\n" {
+		t.Fatal("Expecting the ids of the three transfers, got ", string(data))
+	}
+
+	os.Remove(cancelFile)
+	if err := os.Symlink("/dev/null", cancelFile); err != nil {
+		t.Fatal(err)
+	}
+	if err := supervisor.CancelTransfers(pid, []string{"a"}); err == nil {
+		t.Fatal("Expecting a link not to be followed")
+	}
+}
+
+// Kills must stop the whole process when all its transfers match, only cancel those
+// matched otherwise, and be answered even when nothing matches.
+func TestKiller(t *testing.T) {
+	os.RemoveAll(localDbTestPath)
+	supervisor, err := NewSupervisor(localDbTestPath, localDirQTestPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer supervisor.Close()
+	killer := &Killer{Context: &Worker{supervisor: supervisor}}
+
+	pids := make([]int, 0, 2)
+	for _, vo := range []string{"dteam", "atlas"} {
+		cmd := exec.Command("sleep", "100s")
+		if err := cmd.Start(); err != nil {
+			t.Fatal(err)
+		}
+		defer cmd.Process.Kill()
+		batch := &messages.Batch{
+			Submitted: messages.Now(),
+			State:     messages.Batch_READY,
+			Vo:        vo,
+			Transfers: []*messages.Transfer{
+				{TransferId: uuid.NewV4().String(), JobId: "job1-" + vo},
+				{TransferId: uuid.NewV4().String(), JobId: "job2-" + vo},
+			},
+		}
+		if err := supervisor.storeProcess(batch, cmd.Process.Pid); err != nil {
+			t.Fatal(err)
+		}
+		pids = append(pids, cmd.Process.Pid)
+	}
+	defer os.Remove(config.CancelFile(localDirQTestPath, pids[0]))
+
+	result := killer.kill(&messages.Kill{JobId: "job2-dteam"})
+	if result.Agent != "fts-workerd" || result.Received == nil || result.Finished == nil || len(result.Targets) != 1 {
+		t.Fatal("Expecting a single target, got ", result)
+	}
+	if target := result.Targets[0]; target.Pid != int32(pids[0]) || target.Signal != "SIGUSR1" || len(target.TransferIds) != 1 || target.Error != "" {
+		t.Fatal("Expecting only the second transfer to be canceled, got ", target)
+	}
+
+	result = killer.kill(&messages.Kill{Vo: "atlas"})
+	if len(result.Targets) != 1 || result.Targets[0].Pid != int32(pids[1]) || result.Targets[0].Signal != "SIGTERM" ||
+		len(result.Targets[0].TransferIds) != 2 {
+		t.Fatal("Expecting the whole process to be killed, got ", result)
+	}
+
+	if result = killer.kill(&messages.Kill{Vo: "cms"}); len(result.Targets) != 0 {
+		t.Fatal("Expecting no target, got ", result.Targets)
+	}
+}